@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// modeAPILambda serves the web API as a Lambda function behind API Gateway.
+const modeAPILambda = "api-lambda"
+
+// apiGatewayRequest is a proxy integration event of either a REST API
+// (payload format 1.0) or an HTTP API (payload format 2.0), told apart by
+// Version.
+type apiGatewayRequest struct {
+	Version string `json:"version"`
+
+	// Payload format 1.0
+	HTTPMethod                      string              `json:"httpMethod"`
+	Path                            string              `json:"path"`
+	MultiValueHeaders               map[string][]string `json:"multiValueHeaders"`
+	MultiValueQueryStringParameters map[string][]string `json:"multiValueQueryStringParameters"`
+
+	// Payload format 2.0
+	RawPath        string   `json:"rawPath"`
+	RawQueryString string   `json:"rawQueryString"`
+	Cookies        []string `json:"cookies"`
+
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	RequestContext  struct {
+		RequestID string `json:"requestId"`
+		Identity  struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+		HTTP struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+	} `json:"requestContext"`
+}
+
+func (e apiGatewayRequest) isV2() bool {
+	return e.Version == "2.0"
+}
+
+// UnmarshalJSON rejects the events that are not proxy integrations, so they
+// are not served as requests by mistake.
+func (e *apiGatewayRequest) UnmarshalJSON(data []byte) error {
+	type plain apiGatewayRequest
+	if err := json.Unmarshal(data, (*plain)(e)); err != nil {
+		return err
+	}
+	if e.HTTPMethod == "" && e.RequestContext.HTTP.Method == "" {
+		return fmt.Errorf("not an API Gateway proxy event")
+	}
+	return nil
+}
+
+// apiGatewayResponse is the proxy integration response of both payload
+// formats: 1.0 reads MultiValueHeaders, 2.0 reads Headers and Cookies.
+type apiGatewayResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Cookies           []string            `json:"cookies,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// runAPILambda serves router to API Gateway proxy events until the function
+// is shut down. Binary request bodies, e.g. the images sent to uploadImage,
+// arrive base64 encoded; for a REST API their media types, such as
+// multipart/form-data and image/*, must be listed in its binary media types.
+// Binary response bodies, e.g. from getImage, are sent base64 encoded.
+func runAPILambda(router http.Handler) {
+	lambda.Start(func(ctx context.Context, event apiGatewayRequest) (apiGatewayResponse, error) {
+		return serveAPIGateway(ctx, router, event)
+	})
+}
+
+func serveAPIGateway(ctx context.Context, handler http.Handler, event apiGatewayRequest) (apiGatewayResponse, error) {
+	r, err := newAPIGatewayHTTPRequest(ctx, event)
+	if err != nil {
+		return apiGatewayResponse{
+			StatusCode: http.StatusBadRequest,
+			Headers:    map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+			Body:       err.Error(),
+		}, nil
+	}
+	w := &bufferedResponseWriter{header: http.Header{}}
+	handler.ServeHTTP(w, r)
+	return w.apiGatewayResponse(event.isV2()), nil
+}
+
+// newAPIGatewayHTTPRequest turns a proxy event into the request it stands for.
+func newAPIGatewayHTTPRequest(ctx context.Context, event apiGatewayRequest) (*http.Request, error) {
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(event.Body); err != nil {
+			return nil, fmt.Errorf("decoding the base64 body: %w", err)
+		}
+	}
+
+	method, path, sourceIP := event.HTTPMethod, event.Path, event.RequestContext.Identity.SourceIP
+	query := url.Values(event.MultiValueQueryStringParameters).Encode()
+	if event.isV2() {
+		method, path, sourceIP = event.RequestContext.HTTP.Method, event.RawPath, event.RequestContext.HTTP.SourceIP
+		query = event.RawQueryString
+	}
+	target := &url.URL{Path: path, RawQuery: query}
+
+	r, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range event.MultiValueHeaders {
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+	for name, value := range event.Headers {
+		if _, ok := event.MultiValueHeaders[name]; !ok {
+			r.Header.Set(name, value)
+		}
+	}
+	// Correlate the logs with the ones of API Gateway, unless the client sent an id
+	if r.Header.Get(requestIDHeader) == "" && event.RequestContext.RequestID != "" {
+		r.Header.Set(requestIDHeader, event.RequestContext.RequestID)
+	}
+	if len(event.Cookies) > 0 {
+		r.Header.Set("Cookie", strings.Join(event.Cookies, "; "))
+	}
+	r.Host = r.Header.Get("Host")
+	r.RemoteAddr = sourceIP
+	r.RequestURI = target.RequestURI()
+	r.ContentLength = int64(len(body))
+	return r, nil
+}
+
+// bufferedResponseWriter keeps a whole response, as a proxy integration
+// returns the response at once.
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponseWriter) apiGatewayResponse(v2 bool) apiGatewayResponse {
+	response := apiGatewayResponse{StatusCode: b.status}
+	if response.StatusCode == 0 {
+		response.StatusCode = http.StatusOK
+	}
+	if b.header.Get("Content-Type") == "" && b.body.Len() > 0 {
+		b.header.Set("Content-Type", http.DetectContentType(b.body.Bytes()))
+	}
+
+	if v2 {
+		response.Headers = map[string]string{}
+		for name, values := range b.header {
+			if name == "Set-Cookie" {
+				response.Cookies = values
+				continue
+			}
+			response.Headers[name] = strings.Join(values, ",")
+		}
+	} else {
+		response.MultiValueHeaders = b.header
+	}
+
+	if isTextContentType(b.header.Get("Content-Type")) {
+		response.Body = b.body.String()
+	} else {
+		response.Body = base64.StdEncoding.EncodeToString(b.body.Bytes())
+		response.IsBase64Encoded = true
+	}
+	return response
+}
+
+// isTextContentType reports whether a body of the content type can be sent
+// to API Gateway as is, rather than base64 encoded.
+func isTextContentType(contentType string) bool {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.TrimSpace(strings.ToLower(contentType))
+	switch {
+	case contentType == "", strings.HasPrefix(contentType, "text/"):
+		return true
+	case strings.HasSuffix(contentType, "+json"), strings.HasSuffix(contentType, "+xml"):
+		return true
+	}
+	switch contentType {
+	case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestNewAPIGatewayHTTPRequest(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x01")
+
+	tests := []struct {
+		name        string
+		event       string
+		wantMethod  string
+		wantURI     string
+		wantBody    []byte
+		wantHeaders map[string]string
+		wantRemote  string
+		wantErr     bool
+	}{
+		{
+			name: "v1 text body",
+			event: `{"httpMethod":"POST","path":"/image/tags","multiValueQueryStringParameters":{"tag":["a","b"]},
+				"multiValueHeaders":{"Content-Type":["application/json"],"Host":["api.example.com"]},
+				"body":"{\"name\":\"a.png\"}","requestContext":{"requestId":"req-1","identity":{"sourceIp":"203.0.113.1"}}}`,
+			wantMethod:  "POST",
+			wantURI:     "/image/tags?tag=a&tag=b",
+			wantBody:    []byte(`{"name":"a.png"}`),
+			wantHeaders: map[string]string{"Content-Type": "application/json", "Host": "api.example.com", requestIDHeader: "req-1"},
+			wantRemote:  "203.0.113.1",
+		},
+		{
+			name: "v1 base64 body",
+			event: `{"httpMethod":"PUT","path":"/image","multiValueHeaders":{"Content-Type":["image/png"]},
+				"body":"` + base64.StdEncoding.EncodeToString(png) + `","isBase64Encoded":true,"requestContext":{}}`,
+			wantMethod:  "PUT",
+			wantURI:     "/image",
+			wantBody:    png,
+			wantHeaders: map[string]string{"Content-Type": "image/png"},
+		},
+		{
+			name: "v2 base64 body with cookies",
+			event: `{"version":"2.0","rawPath":"/image/my cat.png","rawQueryString":"width=100",
+				"headers":{"content-type":"image/png","x-request-id":"client-id"},"cookies":["a=1","b=2"],
+				"body":"` + base64.StdEncoding.EncodeToString(png) + `","isBase64Encoded":true,
+				"requestContext":{"requestId":"req-2","http":{"method":"POST","sourceIp":"198.51.100.7"}}}`,
+			wantMethod:  "POST",
+			wantURI:     "/image/my%20cat.png?width=100",
+			wantBody:    png,
+			wantHeaders: map[string]string{"Content-Type": "image/png", "Cookie": "a=1; b=2", requestIDHeader: "client-id"},
+			wantRemote:  "198.51.100.7",
+		},
+		{
+			name:    "invalid base64 body",
+			event:   `{"version":"2.0","rawPath":"/image","body":"not base64!","isBase64Encoded":true,"requestContext":{"http":{"method":"POST"}}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var event apiGatewayRequest
+			if err := json.Unmarshal([]byte(tt.event), &event); err != nil {
+				t.Fatalf("decoding event: %v", err)
+			}
+			r, err := newAPIGatewayHTTPRequest(context.Background(), event)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if r.Method != tt.wantMethod {
+				t.Errorf("Method = %q, want %q", r.Method, tt.wantMethod)
+			}
+			if r.RequestURI != tt.wantURI {
+				t.Errorf("RequestURI = %q, want %q", r.RequestURI, tt.wantURI)
+			}
+			body, _ := io.ReadAll(r.Body)
+			if string(body) != string(tt.wantBody) || r.ContentLength != int64(len(tt.wantBody)) {
+				t.Errorf("body = %q (length %d), want %q", body, r.ContentLength, tt.wantBody)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := r.Header.Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+			if r.RemoteAddr != tt.wantRemote {
+				t.Errorf("RemoteAddr = %q, want %q", r.RemoteAddr, tt.wantRemote)
+			}
+		})
+	}
+}
+
+func TestAPIGatewayRequestRejectsOtherEvents(t *testing.T) {
+	var event apiGatewayRequest
+	if err := json.Unmarshal([]byte(`{"Records":[]}`), &event); err == nil {
+		t.Error("expected an error for an event that is not a proxy integration")
+	}
+}
+
+func TestAPIGatewayResponse(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x01")
+
+	tests := []struct {
+		name   string
+		v2     bool
+		write  func(w http.ResponseWriter)
+		want   apiGatewayResponse
+		header string
+	}{
+		{
+			name: "v1 JSON",
+			write: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Add("Set-Cookie", "a=1")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"id":1}`))
+			},
+			want: apiGatewayResponse{
+				StatusCode:        http.StatusCreated,
+				MultiValueHeaders: map[string][]string{"Content-Type": {"application/json"}, "Set-Cookie": {"a=1"}},
+				Body:              `{"id":1}`,
+			},
+		},
+		{
+			name: "v1 binary",
+			write: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(png)
+			},
+			want: apiGatewayResponse{
+				StatusCode:        http.StatusOK,
+				MultiValueHeaders: map[string][]string{"Content-Type": {"image/png"}},
+				Body:              base64.StdEncoding.EncodeToString(png),
+				IsBase64Encoded:   true,
+			},
+		},
+		{
+			name: "v2 binary with cookies",
+			v2:   true,
+			write: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "image/png")
+				w.Header().Add("Set-Cookie", "a=1")
+				w.Header().Add("Set-Cookie", "b=2")
+				w.Header().Add("Vary", "Accept")
+				w.Header().Add("Vary", "Origin")
+				w.Write(png)
+			},
+			want: apiGatewayResponse{
+				StatusCode:      http.StatusOK,
+				Headers:         map[string]string{"Content-Type": "image/png", "Vary": "Accept,Origin"},
+				Cookies:         []string{"a=1", "b=2"},
+				Body:            base64.StdEncoding.EncodeToString(png),
+				IsBase64Encoded: true,
+			},
+		},
+		{
+			name: "v2 sniffed text",
+			v2:   true,
+			write: func(w http.ResponseWriter) {
+				w.Write([]byte("hello"))
+			},
+			want: apiGatewayResponse{
+				StatusCode: http.StatusOK,
+				Headers:    map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+				Body:       "hello",
+			},
+		},
+		{
+			name:  "v2 empty",
+			v2:    true,
+			write: func(w http.ResponseWriter) { w.WriteHeader(http.StatusNoContent) },
+			want:  apiGatewayResponse{StatusCode: http.StatusNoContent, Headers: map[string]string{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bufferedResponseWriter{header: http.Header{}}
+			tt.write(w)
+			got := w.apiGatewayResponse(tt.v2)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTextContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"", true},
+		{"text/plain; charset=utf-8", true},
+		{"text/html", true},
+		{"application/json", true},
+		{"Application/JSON; charset=utf-8", true},
+		{"application/problem+json", true},
+		{"application/atom+xml", true},
+		{"application/xml", true},
+		{"application/javascript", true},
+		{"application/x-www-form-urlencoded", true},
+		{"image/png", false},
+		{"image/svg+xml", true},
+		{"application/zip", false},
+		{"application/octet-stream", false},
+		{"multipart/form-data; boundary=x", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := isTextContentType(tt.contentType); got != tt.want {
+				t.Errorf("isTextContentType(%q) = %v, want %v", tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// archiveConcurrency bounds the number of S3 objects opened ahead of the
+// one currently being written to the archive.
+const archiveConcurrency = 4
+
+// archiveManifestName is the name of the manifest in the archive, which no
+// image gets.
+const archiveManifestName = "metadata.json"
+
+// archiveManifest is written to the archive as metadata.json. Files maps the
+// name of each image in the archive to its name in the bucket, when they
+// differ.
+type archiveManifest struct {
+	GeneratedAt time.Time         `json:"generatedAt"`
+	Images      []Image           `json:"images"`
+	Files       map[string]string `json:"files,omitempty"`
+	Missing     []string          `json:"missing"`
+}
+
+// archiveNames gives the images unique file names in an archive. Names only
+// differing by case are told apart too, since they collide once extracted on
+// most desktops.
+type archiveNames map[string]bool
+
+func newArchiveNames() archiveNames {
+	return archiveNames{archiveManifestName: true}
+}
+
+// unique returns the base name of the image, with a " (2)", " (3)" and so on
+// suffix before its extension when another file already has it.
+func (n archiveNames) unique(name string) string {
+	base := path.Base(name)
+	if base == "." || base == "/" {
+		base = "image"
+	}
+	extension := path.Ext(base)
+	stem := strings.TrimSuffix(base, extension)
+	candidate := base
+	for i := 2; n[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", stem, i, extension)
+	}
+	n[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// archiveEntry is an S3 object fetched for the archive, or the reason it could not be.
+type archiveEntry struct {
+	image Image
+	file  *s3.GetObjectOutput
+	err   error
+}
+
+func getImageArchive(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := imageFilter{
+		Names: query["name"],
+		Tag:   strings.ToLower(strings.TrimSpace(query.Get("tag"))),
+		Album: query.Get("album"),
+	}
+	var err error
+	if filter.From, err = parseDateParam(query.Get("from")); err != nil {
+		http.Error(w, "from must be a date such as 2006-01-02 or 2006-01-02T15:04:05Z", http.StatusBadRequest)
+		return
+	}
+	if filter.To, err = parseDateParam(query.Get("to")); err != nil {
+		http.Error(w, "to must be a date such as 2006-01-02 or 2006-01-02T15:04:05Z", http.StatusBadRequest)
+		return
+	}
+	if len(filter.Names) == 0 && filter.Tag == "" && filter.Album == "" && filter.From.IsZero() && filter.To.IsZero() {
+		http.Error(w, "Please select the images through the name, album, tag, from or to query parameters", http.StatusBadRequest)
+		return
+	}
+
+	images, err := getImagesByFilter(r.Context(), filter)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading metadata from RDS", "error", err)
+		http.Error(w, "Error reading metadata from RDS", http.StatusInternalServerError)
+		return
+	}
+	if len(images) == 0 {
+		http.Error(w, "No image matches the given filters", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=images.zip")
+
+	if err := writeImageArchive(r.Context(), w, images); err != nil {
+		// The response has already started, all that is left is to cut it short
+		slog.ErrorContext(r.Context(), "Error streaming image archive", "error", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Image archive downloaded", "images", len(images))
+}
+
+// writeImageArchive streams a zip with the given images, under unique names,
+// and a metadata.json manifest to w. Objects are fetched from S3 concurrently but written in
+// order, so at most archiveConcurrency of them are open at any time.
+func writeImageArchive(ctx context.Context, w io.Writer, images []Image) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s3Svc := s3.New(awsSession)
+	pending := make(chan chan archiveEntry, archiveConcurrency)
+	go func() {
+		defer close(pending)
+		for _, image := range images {
+			entry := make(chan archiveEntry, 1)
+			select {
+			case pending <- entry:
+			case <-ctx.Done():
+				return
+			}
+			go func(image Image) {
+				file, err := s3Svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+					Bucket: aws.String(s3Name),
+					Key:    aws.String(objectKey(image.Name)),
+				})
+				entry <- archiveEntry{image: image, file: file, err: err}
+			}(image)
+		}
+	}()
+	// Whatever happens, close the bodies of the objects fetched but not written
+	defer func() {
+		cancel()
+		for entry := range pending {
+			if fetched := <-entry; fetched.err == nil {
+				fetched.file.Body.Close()
+			}
+		}
+	}()
+
+	archive := zip.NewWriter(w)
+	manifest := archiveManifest{GeneratedAt: time.Now(), Files: map[string]string{}}
+	names := newArchiveNames()
+	for entry := range pending {
+		fetched := <-entry
+		if fetched.err != nil {
+			slog.WarnContext(ctx, "Error downloading image, leaving it out of the archive", "name", fetched.image.Name, "error", fetched.err)
+			manifest.Missing = append(manifest.Missing, fetched.image.Name)
+			continue
+		}
+
+		name := names.unique(fetched.image.Name)
+		err := writeArchiveFile(archive, name, fetched)
+		fetched.file.Body.Close()
+		if err != nil {
+			return err
+		}
+		manifest.Images = append(manifest.Images, fetched.image)
+		if name != fetched.image.Name {
+			manifest.Files[name] = fetched.image.Name
+		}
+	}
+
+	// The manifest goes last so it only lists what actually made it into the archive
+	file, err := archive.Create(archiveManifestName)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func writeArchiveFile(archive *zip.Writer, name string, fetched archiveEntry) error {
+	// Images are already compressed, storing them saves CPU for nothing lost
+	file, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: fetched.image.LastUpdate,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, fetched.file.Body); err != nil {
+		return fmt.Errorf("copying image '%s': %w", fetched.image.Name, err)
+	}
+	return nil
+}
+
+// parseDateParam accepts either a date or an RFC 3339 timestamp; an empty
+// value gives the zero time.
+func parseDateParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestArchiveNamesUnique(t *testing.T) {
+	tests := []struct {
+		name   string
+		images []string
+		want   []string
+	}{
+		{"distinct", []string{"a.png", "b.png"}, []string{"a.png", "b.png"}},
+		{"same base name", []string{"2024/cat.png", "2025/cat.png", "cat.png"}, []string{"cat.png", "cat (2).png", "cat (3).png"}},
+		{"differing by case", []string{"Cat.png", "cat.PNG"}, []string{"Cat.png", "cat (2).PNG"}},
+		{"manifest name reserved", []string{"metadata.json", "METADATA.json"}, []string{"metadata (2).json", "METADATA (3).json"}},
+		{"suffix taken already", []string{"cat (2).png", "cat.png", "cat.png"}, []string{"cat (2).png", "cat.png", "cat (3).png"}},
+		{"no extension", []string{"README", "docs/README"}, []string{"README", "README (2)"}},
+		{"no base name", []string{"albums/", ""}, []string{"albums", "image"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := newArchiveNames()
+			var got []string
+			for _, image := range tt.images {
+				got = append(got, names.unique(image))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
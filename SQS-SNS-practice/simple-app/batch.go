@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// batchConcurrency bounds the number of S3 calls a batch runs at once.
+	batchConcurrency = 5
+	// maxBatchMemory is the part of a batch upload kept in memory, the rest is spooled to disk.
+	maxBatchMemory = 32 << 20
+	// maxBatchDelete is the number of names and ids a batch delete accepts,
+	// the number of keys S3 accepts in one DeleteObjects call.
+	maxBatchDelete = 1000
+)
+
+// batchResult reports the outcome of one item of a batch request.
+type batchResult struct {
+	ID     int64  `json:"id,omitempty"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchDeleteRequest struct {
+	Names []string `json:"names"`
+	IDs   []int64  `json:"ids"`
+}
+
+func uploadImages(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(maxBatchMemory); err != nil {
+		slog.WarnContext(r.Context(), "Invalid multipart form", "error", err)
+		http.Error(w, "Error reading multipart form", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		http.Error(w, "Please provide the images through the 'images' form field", http.StatusBadRequest)
+		return
+	}
+	tags := normalizeTags(r.FormValue("tags"))
+	album := r.FormValue("album")
+
+	results := make([]batchResult, len(files))
+	images := make([]*Image, len(files))
+	uploader := s3manager.NewUploader(awsSession)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchConcurrency)
+	for i, file := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, file *multipart.FileHeader) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			image, err := uploadBatchImage(r.Context(), uploader, file, tags, album)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error uploading image", "name", file.Filename, "error", err)
+				results[i] = batchResult{Name: file.Filename, Status: "failed", Error: err.Error()}
+				return
+			}
+			images[i] = &image
+			results[i] = batchResult{ID: image.ID, Name: image.Name, Status: "uploaded"}
+		}(i, file)
+	}
+	wg.Wait()
+
+	var uploaded []Image
+	for _, image := range images {
+		if image != nil {
+			uploaded = append(uploaded, *image)
+		}
+	}
+	if len(uploaded) > 0 {
+		if err := publishEventToSQS(r.Context(), eventImageUploaded, uploaded); err != nil {
+			slog.ErrorContext(r.Context(), "Error publishing event", "event_type", eventImageUploaded, "error", err)
+		}
+	}
+
+	writeBatchResults(w, results, len(uploaded))
+}
+
+func uploadBatchImage(ctx context.Context, uploader *s3manager.Uploader, file *multipart.FileHeader, tags, album string) (Image, error) {
+	imageFile, err := file.Open()
+	if err != nil {
+		return Image{}, err
+	}
+	defer imageFile.Close()
+
+	contentType := file.Header.Get("Content-Type")
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(s3Name),
+		Key:         aws.String(objectKey(file.Filename)),
+		Body:        imageFile,
+		ContentType: aws.String(contentType),
+		Metadata:    apiUploadMetadata(),
+	})
+	if err != nil {
+		return Image{}, fmt.Errorf("uploading to S3: %w", err)
+	}
+
+	image := Image{
+		Name:        file.Filename,
+		Size:        file.Size,
+		Extension:   getFileExtension(file.Filename),
+		Tags:        tags,
+		Album:       album,
+		ContentType: contentType,
+		LastUpdate:  time.Now(),
+	}
+	image.ID, err = insertImage(ctx, db, image)
+	if err != nil {
+		return Image{}, fmt.Errorf("inserting metadata into RDS: %w", err)
+	}
+	return image, nil
+}
+
+func deleteImages(w http.ResponseWriter, r *http.Request) {
+	var request batchDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Please provide a JSON body such as {\"names\": [\"a.png\"], \"ids\": [1, 2]}", http.StatusBadRequest)
+		return
+	}
+	if len(request.Names) == 0 && len(request.IDs) == 0 {
+		http.Error(w, "Please provide at least one image name or id", http.StatusBadRequest)
+		return
+	}
+	if len(request.Names)+len(request.IDs) > maxBatchDelete {
+		http.Error(w, fmt.Sprintf("Please provide at most %d image names and ids", maxBatchDelete), http.StatusBadRequest)
+		return
+	}
+
+	// Resolve the ids to names, the names are what the S3 keys are made of
+	var results []batchResult
+	seen := map[string]bool{}
+	var names []string
+	for _, name := range request.Names {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	byID, err := getImagesByIDs(r.Context(), request.IDs)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading metadata from RDS", "error", err)
+		http.Error(w, "Error reading metadata from RDS", http.StatusInternalServerError)
+		return
+	}
+	for _, id := range request.IDs {
+		image, ok := byID[id]
+		if !ok {
+			results = append(results, batchResult{ID: id, Status: "not_found"})
+			continue
+		}
+		if !seen[image.Name] {
+			seen[image.Name] = true
+			names = append(names, image.Name)
+		}
+	}
+
+	// Keep the metadata for the event, it is gone once the rows are deleted
+	byName := map[string]Image{}
+	if len(names) > 0 {
+		known, err := getImagesByFilter(r.Context(), imageFilter{Names: names})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error reading metadata from RDS", "error", err)
+			http.Error(w, "Error reading metadata from RDS", http.StatusInternalServerError)
+			return
+		}
+		for _, image := range known {
+			byName[image.Name] = image
+		}
+	}
+
+	// Delete the objects, the batch fits in one DeleteObjects call
+	deleteErrors := map[string]string{}
+	if len(names) > 0 {
+		deleteErrors = deleteObjects(r.Context(), s3.New(awsSession), names)
+	}
+
+	// Delete the metadata of every image whose object is gone
+	var deleted []Image
+	for _, name := range names {
+		if reason, ok := deleteErrors[name]; ok {
+			results = append(results, batchResult{Name: name, Status: "failed", Error: reason})
+			continue
+		}
+		if _, err := deleteImageByName(r.Context(), name); err != nil {
+			slog.ErrorContext(r.Context(), "Error deleting metadata from RDS", "name", name, "error", err)
+			results = append(results, batchResult{Name: name, Status: "failed", Error: err.Error()})
+			continue
+		}
+		results = append(results, batchResult{Name: name, Status: "deleted"})
+		image, ok := byName[name]
+		if !ok {
+			image = Image{Name: name, Extension: getFileExtension(name)}
+		}
+		deleted = append(deleted, image)
+	}
+	if len(deleted) > 0 {
+		if err := publishEventToSQS(r.Context(), eventImageDeleted, deleted); err != nil {
+			slog.ErrorContext(r.Context(), "Error publishing event", "event_type", eventImageDeleted, "error", err)
+		}
+	}
+
+	writeBatchResults(w, results, len(deleted))
+}
+
+// deleteObjects removes the images with the given names from S3 and returns
+// the reason for every name that could not be deleted.
+func deleteObjects(ctx context.Context, s3Svc *s3.S3, names []string) map[string]string {
+	failed := map[string]string{}
+	objects := make([]*s3.ObjectIdentifier, len(names))
+	for i, name := range names {
+		objects[i] = &s3.ObjectIdentifier{Key: aws.String(objectKey(name))}
+	}
+
+	output, err := s3Svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(s3Name),
+		Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting images from S3", "images", len(names), "error", err)
+		for _, name := range names {
+			failed[name] = "Error deleting image from S3"
+		}
+		return failed
+	}
+	for _, deleteError := range output.Errors {
+		name := strings.TrimPrefix(aws.StringValue(deleteError.Key), s3Prefix)
+		failed[name] = aws.StringValue(deleteError.Message)
+	}
+	return failed
+}
+
+// writeBatchResults answers 200 when every item succeeded and 207 otherwise.
+func writeBatchResults(w http.ResponseWriter, results []batchResult, succeeded int) {
+	status := http.StatusOK
+	if succeeded < len(results) {
+		status = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Results []batchResult `json:"results"`
+	}{
+		Results: results,
+	})
+}
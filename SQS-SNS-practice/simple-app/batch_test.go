@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func decodeBatchResults(t *testing.T, rec *httptest.ResponseRecorder) []batchResult {
+	t.Helper()
+	var body struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding the results: %v", err)
+	}
+	return body.Results
+}
+
+func TestWriteBatchResultsStatus(t *testing.T) {
+	results := []batchResult{{Name: "a.png", Status: "deleted"}, {Name: "b.png", Status: "failed", Error: "AccessDenied"}}
+
+	rec := httptest.NewRecorder()
+	writeBatchResults(rec, results, 2)
+	if rec.Code != http.StatusOK {
+		t.Errorf("every item succeeded: status = %d, want 200", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	writeBatchResults(rec, results, 1)
+	if rec.Code != http.StatusMultiStatus {
+		t.Errorf("one item failed: status = %d, want 207", rec.Code)
+	}
+	got := decodeBatchResults(t, rec)
+	if len(got) != 2 || got[1].Error != "AccessDenied" {
+		t.Errorf("results = %+v", got)
+	}
+}
+
+func TestDeleteImagesRejectsInvalidRequests(t *testing.T) {
+	tooMany := make([]string, maxBatchDelete+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("%d.png", i)
+	}
+	tooManyBody, _ := json.Marshal(batchDeleteRequest{Names: tooMany})
+
+	for name, body := range map[string]string{
+		"not JSON": "names=a.png",
+		"empty":    `{"names": [], "ids": []}`,
+		"too many": string(tooManyBody),
+	} {
+		rec := httptest.NewRecorder()
+		deleteImages(rec, httptest.NewRequest(http.MethodDelete, "/images", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, rec.Code)
+		}
+	}
+}
+
+func TestDeleteImagesReportsUnknownIDs(t *testing.T) {
+	table := &scriptedDB{query: func(query string, args []driver.Value) (*scriptedRows, error) {
+		return imageRows(), nil
+	}}
+	useScriptedDB(t, table)
+
+	rec := httptest.NewRecorder()
+	deleteImages(rec, httptest.NewRequest(http.MethodDelete, "/images", strings.NewReader(`{"ids": [7, 8]}`)))
+
+	if rec.Code != http.StatusMultiStatus {
+		t.Errorf("status = %d, want 207", rec.Code)
+	}
+	results := decodeBatchResults(t, rec)
+	if len(results) != 2 || results[0].ID != 7 || results[0].Status != "not_found" || results[1].Status != "not_found" {
+		t.Errorf("results = %+v, want both ids not_found", results)
+	}
+	if deletes := table.ranMatching("DELETE"); len(deletes) != 0 {
+		t.Errorf("deleted rows of unknown images: %v", deletes)
+	}
+}
+
+func TestUploadImagesRequiresImagesField(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("image", "a.png")
+	part.Write([]byte("\x89PNG"))
+	form.WriteField("tags", "cats")
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/images/batch", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	uploadImages(rec, req)
+
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "'images'") {
+		t.Errorf("status = %d, body %q, want 400 naming the images field", rec.Code, rec.Body)
+	}
+}
+
+func TestUploadImagesRejectsNonMultipartBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/images/batch", strings.NewReader(`{"images": []}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	uploadImages(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rec.Code)
+	}
+}
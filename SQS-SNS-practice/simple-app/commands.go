@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+)
+
+// runCommand runs one of the maintenance commands that can be given on the
+// command line instead of starting the web server, e.g. `go run . import -dry-run`.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "import":
+		return importCommand(args)
+	case "reconcile":
+		return reconcileCommand(args)
+	case "dlq":
+		return deadLetterCommand(args)
+	case "notify":
+		return notifyCommand(args)
+	default:
+		return fmt.Errorf("unknown command '%s', expected one of: import, reconcile, dlq, notify", name)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// maxReceiveMessages is the largest batch SQS returns from one receive or accepts in one delete.
+	maxReceiveMessages = 10
+	// longPollSeconds is how long a receive waits for messages to arrive.
+	longPollSeconds = 20
+	// deleteFlushInterval bounds how long a handled message waits for its batch delete.
+	deleteFlushInterval = time.Second
+	// receiveRetryDelay is the pause after a failed receive.
+	receiveRetryDelay = 5 * time.Second
+)
+
+// messageHandler processes one message. The message is deleted from the
+// queue only when the handler returns nil; otherwise it becomes visible
+// again once its visibility timeout expires and is retried.
+type messageHandler func(ctx context.Context, msg *sqs.Message) error
+
+// sqsConsumer long polls a queue and runs a handler for each message, with
+// at most concurrency handlers at once. While a handler runs, the visibility
+// timeout of its message is extended so slow handlers do not see their
+// message delivered a second time. Handled messages are deleted in batches.
+//
+// When a dead-letter queue is configured, a message that has been received
+// maxReceiveCount times without being handled is moved there instead of
+// being retried forever.
+type sqsConsumer struct {
+	client             sqsiface.SQSAPI
+	queueURL           string
+	deadLetterQueueURL string
+	maxReceiveCount    int
+	concurrency        int
+	visibilityTimeout  time.Duration
+	handler            messageHandler
+}
+
+// newSQSConsumer creates a consumer configured from the environment:
+// SQS_CONSUMER_CONCURRENCY (default 4), SQS_VISIBILITY_TIMEOUT (default 30s),
+// SQS_DLQ_URL (no dead-lettering when unset) and SQS_MAX_RECEIVE_COUNT (default 5).
+func newSQSConsumer(queueURL string, handler messageHandler) *sqsConsumer {
+	consumer := &sqsConsumer{
+		client:             sqs.New(awsSession),
+		queueURL:           queueURL,
+		deadLetterQueueURL: getEnv("SQS_DLQ_URL", ""),
+		maxReceiveCount:    getEnvInt("SQS_MAX_RECEIVE_COUNT", 5),
+		concurrency:        getEnvInt("SQS_CONSUMER_CONCURRENCY", 4),
+		visibilityTimeout:  getEnvDuration("SQS_VISIBILITY_TIMEOUT", 30*time.Second),
+		handler:            handler,
+	}
+	if consumer.concurrency < 1 {
+		fatal("SQS_CONSUMER_CONCURRENCY must be at least 1")
+	}
+	if consumer.maxReceiveCount < 1 {
+		fatal("SQS_MAX_RECEIVE_COUNT must be at least 1")
+	}
+	if consumer.visibilityTimeout < 2*time.Second {
+		fatal("SQS_VISIBILITY_TIMEOUT must be at least 2s")
+	}
+	return consumer
+}
+
+// run receives and handles messages until ctx is done, then waits for the
+// handlers still running and deletes their messages before returning.
+func (c *sqsConsumer) run(ctx context.Context) {
+	slots := make(chan struct{}, c.concurrency)
+	deletes := make(chan *sqs.Message, maxReceiveMessages)
+	var deleter sync.WaitGroup
+	deleter.Add(1)
+	go func() {
+		defer deleter.Done()
+		c.deleteHandled(deletes)
+	}()
+
+	var handlers sync.WaitGroup
+	for ctx.Err() == nil {
+		// Only ask for as many messages as there are idle handlers, so no
+		// message waits in memory while its visibility timeout runs out
+		free := c.acquireSlots(ctx, slots)
+		if free == 0 {
+			break
+		}
+
+		resp, err := c.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(c.queueURL),
+			MaxNumberOfMessages: aws.Int64(int64(free)),
+			WaitTimeSeconds:     aws.Int64(longPollSeconds),
+			VisibilityTimeout:   aws.Int64(int64(c.visibilityTimeout / time.Second)),
+			AttributeNames: aws.StringSlice([]string{
+				sqs.MessageSystemAttributeNameApproximateReceiveCount,
+				sqs.MessageSystemAttributeNameSentTimestamp,
+			}),
+			MessageAttributeNames: aws.StringSlice([]string{"All"}),
+		})
+		if err != nil {
+			releaseSlots(slots, free)
+			if ctx.Err() != nil {
+				break
+			}
+			slog.Error("Error receiving messages from SQS", "queue_url", c.queueURL, "error", err)
+			sleepContext(ctx, receiveRetryDelay)
+			continue
+		}
+		releaseSlots(slots, free-len(resp.Messages))
+		observeReceived(c.queueURL, resp.Messages)
+
+		for _, msg := range resp.Messages {
+			handlers.Add(1)
+			go func(msg *sqs.Message) {
+				defer handlers.Done()
+				defer releaseSlots(slots, 1)
+				if c.handle(msg) {
+					deletes <- msg
+				}
+			}(msg)
+		}
+	}
+
+	handlers.Wait()
+	close(deletes)
+	deleter.Wait()
+}
+
+// acquireSlots blocks until at least one handler slot is free, then takes as
+// many free slots as a single receive can use. It returns 0 if ctx is done first.
+func (c *sqsConsumer) acquireSlots(ctx context.Context, slots chan struct{}) int {
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return 0
+	}
+	free := 1
+	for free < maxReceiveMessages {
+		select {
+		case slots <- struct{}{}:
+			free++
+		default:
+			return free
+		}
+	}
+	return free
+}
+
+func releaseSlots(slots chan struct{}, n int) {
+	for i := 0; i < n; i++ {
+		<-slots
+	}
+}
+
+// handle runs the handler for msg, keeping the message invisible to other
+// consumers until it returns, and reports whether the message can be deleted:
+// either it was handled or it was moved to the dead-letter queue. Handlers
+// are not cancelled on shutdown, they are allowed to finish.
+func (c *sqsConsumer) handle(msg *sqs.Message) (deletable bool) {
+	result := "retried"
+	defer func() {
+		sqsMessagesHandled.WithLabelValues(queueName(c.queueURL), result).Inc()
+	}()
+
+	receiveCount, _ := strconv.Atoi(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	if receiveCount > c.maxReceiveCount && c.deadLetterQueueURL != "" {
+		result = "dead_lettered"
+		return c.deadLetter(msg, fmt.Sprintf("received %d times", receiveCount))
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go c.extendVisibility(msg, done)
+
+	ctx, span := tracer.Start(messageContext(msg), queueName(c.queueURL)+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "aws_sqs"),
+			attribute.String("messaging.destination.name", queueName(c.queueURL)),
+			attribute.String("messaging.message.id", aws.StringValue(msg.MessageId)),
+			attribute.Int("messaging.sqs.receive_count", receiveCount),
+		),
+	)
+	err := c.handler(ctx, msg)
+	endSpan(span, err)
+	if err == nil {
+		result = outcomeSuccess
+		return true
+	}
+	var permanent permanentError
+	if errors.As(err, &permanent) && c.deadLetterQueueURL != "" {
+		result = "dead_lettered"
+		return c.deadLetter(msg, fmt.Sprintf("rejected: %v", err))
+	}
+	if receiveCount >= c.maxReceiveCount && c.deadLetterQueueURL != "" {
+		result = "dead_lettered"
+		return c.deadLetter(msg, fmt.Sprintf("failed %d times, last error: %v", receiveCount, err))
+	}
+	slog.WarnContext(ctx, "Error handling SQS message, it will be retried",
+		"message_id", aws.StringValue(msg.MessageId),
+		"attempt", receiveCount,
+		"max_attempts", c.maxReceiveCount,
+		"error", err,
+	)
+	return false
+}
+
+// deadLetter copies msg to the dead-letter queue, recording where it came from
+// and why, and reports whether it was copied and can be deleted.
+func (c *sqsConsumer) deadLetter(msg *sqs.Message, reason string) bool {
+	attributes := map[string]*sqs.MessageAttributeValue{}
+	for name, value := range msg.MessageAttributes {
+		attributes[name] = value
+	}
+	attributes[dlqSourceQueueAttribute] = stringAttribute(c.queueURL)
+	attributes[dlqReasonAttribute] = stringAttribute(reason)
+
+	ctx := messageContext(msg)
+	_, err := c.client.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(c.deadLetterQueueURL),
+		MessageBody:       msg.Body,
+		MessageAttributes: attributes,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error moving SQS message to the dead-letter queue",
+			"message_id", aws.StringValue(msg.MessageId), "error", err)
+		return false
+	}
+	slog.WarnContext(ctx, "Moved SQS message to the dead-letter queue",
+		"message_id", aws.StringValue(msg.MessageId), "reason", reason)
+	return true
+}
+
+// messageContext returns a context with the request id and the trace
+// context msg was sent with, if any, so what its handler logs and traces can
+// be correlated with that request.
+func messageContext(msg *sqs.Message) context.Context {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), messageAttributesCarrier(msg.MessageAttributes))
+	if value, ok := msg.MessageAttributes[requestIDAttribute]; ok {
+		ctx = withRequestID(ctx, aws.StringValue(value.StringValue))
+	}
+	return ctx
+}
+
+func stringAttribute(value string) *sqs.MessageAttributeValue {
+	return &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(value),
+	}
+}
+
+// extendVisibility pushes the visibility timeout of msg back every half
+// timeout until done is closed.
+func (c *sqsConsumer) extendVisibility(msg *sqs.Message, done chan struct{}) {
+	ticker := time.NewTicker(c.visibilityTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ctx := messageContext(msg)
+			_, err := c.client.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(c.queueURL),
+				ReceiptHandle:     msg.ReceiptHandle,
+				VisibilityTimeout: aws.Int64(int64(c.visibilityTimeout / time.Second)),
+			})
+			if err != nil {
+				slog.WarnContext(ctx, "Error extending visibility of SQS message",
+					"message_id", aws.StringValue(msg.MessageId), "error", err)
+			}
+		}
+	}
+}
+
+// deleteHandled deletes the messages sent on deletes in batches of up to
+// maxReceiveMessages, flushing at least every deleteFlushInterval, until
+// deletes is closed.
+func (c *sqsConsumer) deleteHandled(deletes chan *sqs.Message) {
+	ticker := time.NewTicker(deleteFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*sqs.Message
+	for {
+		select {
+		case msg, ok := <-deletes:
+			if !ok {
+				c.deleteBatch(batch)
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) == maxReceiveMessages {
+				c.deleteBatch(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			c.deleteBatch(batch)
+			batch = nil
+		}
+	}
+}
+
+func (c *sqsConsumer) deleteBatch(batch []*sqs.Message) {
+	if len(batch) == 0 {
+		return
+	}
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(batch))
+	for i, msg := range batch {
+		entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: msg.ReceiptHandle,
+		}
+	}
+
+	resp, err := c.client.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(c.queueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		slog.Error("Error deleting messages from SQS", "queue_url", c.queueURL, "messages", len(batch), "error", err)
+		return
+	}
+	for _, failed := range resp.Failed {
+		i, _ := strconv.Atoi(aws.StringValue(failed.Id))
+		slog.ErrorContext(messageContext(batch[i]), "Error deleting message from SQS",
+			"message_id", aws.StringValue(batch[i].MessageId), "error", aws.StringValue(failed.Message))
+	}
+	slog.Info("Deleted messages from SQS", "queue_url", c.queueURL, "messages", len(resp.Successful))
+}
+
+// sleepContext sleeps for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// fakeSQS serves the messages it holds to the receives of a consumer, then
+// long polls until the receive is cancelled, or returns no message at once
+// when drained is set. It records what the consumer deletes, sends and
+// extends.
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	drained bool
+
+	mu          sync.Mutex
+	messages    []*sqs.Message
+	deleted     []string
+	sent        []*sqs.SendMessageInput
+	extended    int
+	maxReceived int64
+}
+
+func newFakeSQS(messages ...*sqs.Message) *fakeSQS {
+	return &fakeSQS{messages: messages}
+}
+
+// queuedMessage is a message received receiveCount times so far, this time
+// included.
+func queuedMessage(id string, receiveCount int) *sqs.Message {
+	return &sqs.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String("receipt-" + id),
+		Body:          aws.String(`{"id":"` + id + `"}`),
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String(fmt.Sprint(receiveCount)),
+		},
+	}
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	f.mu.Lock()
+	n := min(int(aws.Int64Value(in.MaxNumberOfMessages)), len(f.messages))
+	received := f.messages[:n]
+	f.messages = f.messages[n:]
+	f.maxReceived = max(f.maxReceived, aws.Int64Value(in.MaxNumberOfMessages))
+	f.mu.Unlock()
+
+	if len(received) > 0 || f.drained {
+		return &sqs.ReceiveMessageOutput{Messages: received}, nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *fakeSQS) DeleteMessageBatch(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, entry := range in.Entries {
+		f.deleted = append(f.deleted, aws.StringValue(entry.ReceiptHandle))
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: entry.Id})
+	}
+	return out, nil
+}
+
+func (f *fakeSQS) DeleteMessageWithContext(ctx aws.Context, in *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, aws.StringValue(in.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (f *fakeSQS) SendMessageWithContext(ctx aws.Context, in *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, in)
+	return &sqs.SendMessageOutput{MessageId: aws.String("dead-letter")}, nil
+}
+
+func (f *fakeSQS) ChangeMessageVisibilityWithContext(ctx aws.Context, in *sqs.ChangeMessageVisibilityInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.extended++
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (f *fakeSQS) deletedCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.deleted)
+}
+
+func testConsumer(client *fakeSQS, handler messageHandler) *sqsConsumer {
+	return &sqsConsumer{
+		client:             client,
+		queueURL:           "https://sqs.eu-west-1.amazonaws.com/123456789012/uploads",
+		deadLetterQueueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/uploads-dlq",
+		maxReceiveCount:    3,
+		concurrency:        4,
+		visibilityTimeout:  30 * time.Second,
+		handler:            handler,
+	}
+}
+
+// waitFor polls condition until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConsumerRunHandlesEveryMessageWithBoundedConcurrency(t *testing.T) {
+	var messages []*sqs.Message
+	for i := 0; i < 25; i++ {
+		messages = append(messages, queuedMessage(fmt.Sprint(i), 1))
+	}
+	client := newFakeSQS(messages...)
+
+	var running, peak, handled atomic.Int32
+	consumer := testConsumer(client, func(ctx context.Context, msg *sqs.Message) error {
+		now := running.Add(1)
+		defer running.Add(-1)
+		for {
+			old := peak.Load()
+			if now <= old || peak.CompareAndSwap(old, now) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		handled.Add(1)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		consumer.run(ctx)
+		close(done)
+	}()
+	waitFor(t, "every message to be handled", func() bool { return handled.Load() == 25 })
+	cancel()
+	<-done
+
+	if peak.Load() > 4 {
+		t.Errorf("%d handlers ran at once, want at most 4", peak.Load())
+	}
+	if client.maxReceived > 4 {
+		t.Errorf("asked for %d messages with 4 handlers", client.maxReceived)
+	}
+	if client.deletedCount() != 25 {
+		t.Errorf("deleted %d messages, want 25", client.deletedCount())
+	}
+}
+
+func TestConsumerHandle(t *testing.T) {
+	transient := errors.New("database is unreachable")
+
+	t.Run("success is deleted", func(t *testing.T) {
+		client := newFakeSQS()
+		consumer := testConsumer(client, func(ctx context.Context, msg *sqs.Message) error { return nil })
+		if !consumer.handle(queuedMessage("ok", 1)) {
+			t.Error("handled message is not deletable")
+		}
+	})
+
+	t.Run("failure is retried", func(t *testing.T) {
+		client := newFakeSQS()
+		consumer := testConsumer(client, func(ctx context.Context, msg *sqs.Message) error { return transient })
+		if consumer.handle(queuedMessage("retry", 1)) {
+			t.Error("failed message is deletable")
+		}
+		if len(client.sent) != 0 {
+			t.Errorf("failed message was dead-lettered on its first attempt")
+		}
+	})
+
+	t.Run("permanent failure is dead-lettered", func(t *testing.T) {
+		client := newFakeSQS()
+		consumer := testConsumer(client, func(ctx context.Context, msg *sqs.Message) error {
+			return permanentError{errors.New("unknown event version")}
+		})
+		if !consumer.handle(queuedMessage("poison", 1)) {
+			t.Error("dead-lettered message is not deletable")
+		}
+		assertDeadLettered(t, client, "rejected: unknown event version")
+	})
+
+	t.Run("last attempt is dead-lettered", func(t *testing.T) {
+		client := newFakeSQS()
+		consumer := testConsumer(client, func(ctx context.Context, msg *sqs.Message) error { return transient })
+		if !consumer.handle(queuedMessage("tired", 3)) {
+			t.Error("dead-lettered message is not deletable")
+		}
+		assertDeadLettered(t, client, "failed 3 times, last error: database is unreachable")
+	})
+
+	t.Run("over-received message skips the handler", func(t *testing.T) {
+		client := newFakeSQS()
+		consumer := testConsumer(client, func(ctx context.Context, msg *sqs.Message) error {
+			t.Error("handler ran for a message past its receive count")
+			return nil
+		})
+		consumer.handle(queuedMessage("stale", 4))
+		assertDeadLettered(t, client, "received 4 times")
+	})
+
+	t.Run("without a dead-letter queue failures stay", func(t *testing.T) {
+		client := newFakeSQS()
+		consumer := testConsumer(client, func(ctx context.Context, msg *sqs.Message) error {
+			return permanentError{errors.New("not JSON")}
+		})
+		consumer.deadLetterQueueURL = ""
+		if consumer.handle(queuedMessage("kept", 9)) {
+			t.Error("message is deletable without a dead-letter queue to keep it")
+		}
+	})
+}
+
+func assertDeadLettered(t *testing.T, client *fakeSQS, reason string) {
+	t.Helper()
+	if len(client.sent) != 1 {
+		t.Fatalf("sent %d messages to the dead-letter queue, want 1", len(client.sent))
+	}
+	attributes := client.sent[0].MessageAttributes
+	if got := aws.StringValue(attributes[dlqReasonAttribute].StringValue); got != reason {
+		t.Errorf("reason = %q, want %q", got, reason)
+	}
+	if got := aws.StringValue(attributes[dlqSourceQueueAttribute].StringValue); got != "https://sqs.eu-west-1.amazonaws.com/123456789012/uploads" {
+		t.Errorf("source queue = %q", got)
+	}
+}
+
+func TestConsumerExtendsVisibilityOfSlowHandler(t *testing.T) {
+	client := newFakeSQS()
+	consumer := testConsumer(client, func(ctx context.Context, msg *sqs.Message) error {
+		time.Sleep(250 * time.Millisecond)
+		return nil
+	})
+	// Extended every half timeout, at 50ms, 100ms, 150ms and 200ms
+	consumer.visibilityTimeout = 100 * time.Millisecond
+
+	consumer.handle(queuedMessage("slow", 1))
+	client.mu.Lock()
+	extended := client.extended
+	client.mu.Unlock()
+	if extended < 2 {
+		t.Errorf("visibility extended %d times during a handler of 2.5 timeouts", extended)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.extended != extended {
+		t.Error("visibility still extended after the handler returned")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// Message attributes added to a message when it is dead-lettered.
+const (
+	dlqSourceQueueAttribute = "dlq_source_queue"
+	dlqReasonAttribute      = "dlq_reason"
+)
+
+// dlqScanVisibility hides the dead-lettered messages already seen while the
+// queue is scanned, so each one is only visited once per scan.
+const dlqScanVisibility = 60
+
+// deadLetter is how a dead-lettered message is shown by the dlq command.
+type deadLetter struct {
+	MessageID    string            `json:"messageId"`
+	SentAt       time.Time         `json:"sentAt"`
+	ReceiveCount int               `json:"receiveCount"`
+	SourceQueue  string            `json:"sourceQueue"`
+	Reason       string            `json:"reason"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Body         string            `json:"body"`
+}
+
+// deadLetterCommand lists, inspects, redrives and purges the messages of the
+// dead-letter queue configured through SQS_DLQ_URL:
+//
+//	dlq list [-max 100]
+//	dlq inspect <message-id>...
+//	dlq redrive [-max 100] [-all | <message-id>...]
+//	dlq purge -yes
+//
+// Scanning the queue counts as receiving its messages, so it increases their
+// receive count.
+func deadLetterCommand(args []string) error {
+	dlqURL := getEnv("SQS_DLQ_URL", "")
+	if dlqURL == "" {
+		return errors.New("SQS_DLQ_URL must be set to the URL of the dead-letter queue")
+	}
+	if len(args) == 0 {
+		return errors.New("expected one of: list, inspect, redrive, purge")
+	}
+
+	flags := flag.NewFlagSet("dlq "+args[0], flag.ExitOnError)
+	max := flags.Int("max", 100, "maximum number of messages to scan")
+	all := flags.Bool("all", false, "redrive every message")
+	yes := flags.Bool("yes", false, "confirm purging the dead-letter queue")
+	flags.Parse(args[1:])
+	ids := map[string]bool{}
+	for _, id := range flags.Args() {
+		ids[id] = true
+	}
+
+	ctx := context.Background()
+	client := sqs.New(awsSession)
+	switch args[0] {
+	case "list":
+		var letters []deadLetter
+		err := scanDeadLetters(ctx, client, dlqURL, *max, func(msg *sqs.Message) error {
+			letter := newDeadLetter(msg)
+			letter.Attributes = nil
+			letters = append(letters, letter)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return printJSON(letters)
+
+	case "inspect":
+		if len(ids) == 0 {
+			return errors.New("expected the ids of the messages to inspect")
+		}
+		var letters []deadLetter
+		err := scanDeadLetters(ctx, client, dlqURL, *max, func(msg *sqs.Message) error {
+			if ids[aws.StringValue(msg.MessageId)] {
+				letters = append(letters, newDeadLetter(msg))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return printJSON(letters)
+
+	case "redrive":
+		if len(ids) == 0 && !*all {
+			return errors.New("expected the ids of the messages to redrive, or -all")
+		}
+		redriven := 0
+		err := scanDeadLetters(ctx, client, dlqURL, *max, func(msg *sqs.Message) error {
+			if !*all && !ids[aws.StringValue(msg.MessageId)] {
+				return nil
+			}
+			if err := redriveDeadLetter(ctx, client, dlqURL, msg); err != nil {
+				return err
+			}
+			redriven++
+			return nil
+		})
+		slog.Info("Redrove messages from the dead-letter queue", "messages", redriven)
+		return err
+
+	case "purge":
+		if !*yes {
+			return errors.New("purging deletes every dead-lettered message, confirm with -yes")
+		}
+		_, err := client.PurgeQueueWithContext(ctx, &sqs.PurgeQueueInput{QueueUrl: aws.String(dlqURL)})
+		if err == nil {
+			slog.Info("Dead-letter queue purged", "queue_url", dlqURL)
+		}
+		return err
+
+	default:
+		return fmt.Errorf("unknown dlq command '%s', expected one of: list, inspect, redrive, purge", args[0])
+	}
+}
+
+// scanDeadLetters receives up to max messages of the dead-letter queue and
+// calls visit for each, stopping at the first error.
+func scanDeadLetters(ctx context.Context, client sqsiface.SQSAPI, dlqURL string, max int, visit func(*sqs.Message) error) error {
+	for scanned := 0; scanned < max; {
+		batch := max - scanned
+		if batch > maxReceiveMessages {
+			batch = maxReceiveMessages
+		}
+		resp, err := client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(dlqURL),
+			MaxNumberOfMessages:   aws.Int64(int64(batch)),
+			WaitTimeSeconds:       aws.Int64(1),
+			VisibilityTimeout:     aws.Int64(dlqScanVisibility),
+			AttributeNames:        aws.StringSlice([]string{"All"}),
+			MessageAttributeNames: aws.StringSlice([]string{"All"}),
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Messages) == 0 {
+			return nil
+		}
+		for _, msg := range resp.Messages {
+			if err := visit(msg); err != nil {
+				return err
+			}
+		}
+		scanned += len(resp.Messages)
+	}
+	return nil
+}
+
+// redriveDeadLetter sends msg back to the queue it was dead-lettered from,
+// without the dead-letter attributes, and removes it from the dead-letter queue.
+func redriveDeadLetter(ctx context.Context, client sqsiface.SQSAPI, dlqURL string, msg *sqs.Message) error {
+	source := attributeString(msg.MessageAttributes[dlqSourceQueueAttribute])
+	if source == "" {
+		source = queueURL
+	}
+	attributes := map[string]*sqs.MessageAttributeValue{}
+	for name, value := range msg.MessageAttributes {
+		if !strings.HasPrefix(name, "dlq_") {
+			attributes[name] = value
+		}
+	}
+	if len(attributes) == 0 {
+		attributes = nil
+	}
+
+	_, err := client.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(source),
+		MessageBody:       msg.Body,
+		MessageAttributes: attributes,
+	})
+	if err != nil {
+		return fmt.Errorf("redriving message %s: %w", aws.StringValue(msg.MessageId), err)
+	}
+	_, err = client.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(dlqURL),
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	if err != nil {
+		return fmt.Errorf("deleting redriven message %s: %w", aws.StringValue(msg.MessageId), err)
+	}
+	slog.InfoContext(messageContext(msg), "Redrove message", "message_id", aws.StringValue(msg.MessageId), "queue_url", source)
+	return nil
+}
+
+func newDeadLetter(msg *sqs.Message) deadLetter {
+	letter := deadLetter{
+		MessageID:   aws.StringValue(msg.MessageId),
+		SourceQueue: attributeString(msg.MessageAttributes[dlqSourceQueueAttribute]),
+		Reason:      attributeString(msg.MessageAttributes[dlqReasonAttribute]),
+		Attributes:  map[string]string{},
+		Body:        aws.StringValue(msg.Body),
+	}
+	letter.ReceiveCount, _ = strconv.Atoi(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	if sent, err := strconv.ParseInt(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64); err == nil {
+		letter.SentAt = time.UnixMilli(sent)
+	}
+	for name, value := range msg.MessageAttributes {
+		letter.Attributes[name] = attributeString(value)
+	}
+	return letter
+}
+
+func attributeString(value *sqs.MessageAttributeValue) string {
+	if value == nil {
+		return ""
+	}
+	return aws.StringValue(value.StringValue)
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
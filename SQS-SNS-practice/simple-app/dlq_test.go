@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const testDLQURL = "https://sqs.eu-west-1.amazonaws.com/123456789012/uploads-dlq"
+
+// deadLetteredMessage is a message the consumer of source moved to the
+// dead-letter queue for reason.
+func deadLetteredMessage(id, source, reason string) *sqs.Message {
+	msg := queuedMessage(id, 2)
+	msg.Attributes[sqs.MessageSystemAttributeNameSentTimestamp] = aws.String("1767225600000")
+	msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		requestIDAttribute:      stringAttribute("req-" + id),
+		dlqSourceQueueAttribute: stringAttribute(source),
+		dlqReasonAttribute:      stringAttribute(reason),
+	}
+	return msg
+}
+
+func TestNewDeadLetter(t *testing.T) {
+	letter := newDeadLetter(deadLetteredMessage("m-1", "https://sqs/uploads", "rejected: not JSON"))
+
+	if letter.MessageID != "m-1" || letter.ReceiveCount != 2 || letter.Reason != "rejected: not JSON" || letter.SourceQueue != "https://sqs/uploads" {
+		t.Errorf("letter = %+v", letter)
+	}
+	if want := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC); !letter.SentAt.Equal(want) {
+		t.Errorf("SentAt = %s, want %s", letter.SentAt, want)
+	}
+	if letter.Attributes[requestIDAttribute] != "req-m-1" {
+		t.Errorf("Attributes = %v, want the request id", letter.Attributes)
+	}
+
+	encoded, _ := json.Marshal(letter)
+	var keys map[string]interface{}
+	json.Unmarshal(encoded, &keys)
+	for _, key := range []string{"messageId", "sentAt", "receiveCount", "sourceQueue", "reason", "body"} {
+		if _, ok := keys[key]; !ok {
+			t.Errorf("%s is missing from %s", key, encoded)
+		}
+	}
+}
+
+func TestScanDeadLettersStopsAtMax(t *testing.T) {
+	var messages []*sqs.Message
+	for i := 0; i < 25; i++ {
+		messages = append(messages, deadLetteredMessage(fmt.Sprint(i), "https://sqs/uploads", "received 6 times"))
+	}
+	client := newFakeSQS(messages...)
+	client.drained = true
+
+	visited := 0
+	err := scanDeadLetters(context.Background(), client, testDLQURL, 12, func(msg *sqs.Message) error {
+		visited++
+		return nil
+	})
+	if err != nil || visited != 12 {
+		t.Errorf("visited %d messages (err %v), want 12", visited, err)
+	}
+	if client.maxReceived > maxReceiveMessages {
+		t.Errorf("asked for %d messages in one receive", client.maxReceived)
+	}
+
+	// The rest of the queue, then nothing once it is empty
+	visited = 0
+	scanDeadLetters(context.Background(), client, testDLQURL, 100, func(msg *sqs.Message) error {
+		visited++
+		return nil
+	})
+	if visited != 13 {
+		t.Errorf("second scan visited %d messages, want the 13 left", visited)
+	}
+}
+
+func TestRedriveDeadLetter(t *testing.T) {
+	client := newFakeSQS()
+	msg := deadLetteredMessage("m-2", "https://sqs/uploads-eu", "failed 5 times")
+
+	if err := redriveDeadLetter(context.Background(), client, testDLQURL, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(client.sent))
+	}
+	sent := client.sent[0]
+	if aws.StringValue(sent.QueueUrl) != "https://sqs/uploads-eu" || aws.StringValue(sent.MessageBody) != aws.StringValue(msg.Body) {
+		t.Errorf("redrove %s to %s", aws.StringValue(sent.MessageBody), aws.StringValue(sent.QueueUrl))
+	}
+	if _, ok := sent.MessageAttributes[dlqReasonAttribute]; ok {
+		t.Error("the redriven message still carries the dead-letter reason")
+	}
+	if attributeString(sent.MessageAttributes[requestIDAttribute]) != "req-m-2" {
+		t.Error("the redriven message lost its request id")
+	}
+	if len(client.deleted) != 1 || client.deleted[0] != "receipt-m-2" {
+		t.Errorf("deleted %v, want the dead-lettered copy", client.deleted)
+	}
+}
+
+func TestRedriveDeadLetterDefaultsToQueue(t *testing.T) {
+	previous := queueURL
+	queueURL = "https://sqs/default-uploads"
+	defer func() { queueURL = previous }()
+
+	client := newFakeSQS()
+	msg := queuedMessage("m-3", 1)
+	if err := redriveDeadLetter(context.Background(), client, testDLQURL, msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := aws.StringValue(client.sent[0].QueueUrl); got != queueURL {
+		t.Errorf("redrove a message without a source to %s, want %s", got, queueURL)
+	}
+	if client.sent[0].MessageAttributes != nil {
+		t.Errorf("attributes = %v, want none", client.sent[0].MessageAttributes)
+	}
+}
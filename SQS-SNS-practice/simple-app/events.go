@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Event types, see schemas/<type>.v<version>.json for their payloads.
+const (
+	eventImageUploaded = "image.uploaded"
+	eventImageDeleted  = "image.deleted"
+)
+
+// eventSchemaVersion is the version of the envelope and payloads published.
+// Messages from before the envelope existed are treated as version 0.
+const eventSchemaVersion = 1
+
+// Message attributes set on every event, so queues and topics can route on
+// them without parsing the body.
+const (
+	eventIDAttribute            = "event_id"
+	eventTypeAttribute          = "event_type"
+	eventSchemaVersionAttribute = "schema_version"
+)
+
+// eventEnvelope is the body of every message sent to the queue.
+type eventEnvelope struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	SchemaVersion int             `json:"schema_version"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// imageEventPayload is the payload of both image.uploaded and image.deleted:
+// the images the operation applied to, several for batch operations.
+type imageEventPayload struct {
+	Images []eventImage `json:"images"`
+}
+
+// eventImage is an Image as it appears in events. It is kept separate from
+// Image so that the table can change without changing the schema.
+type eventImage struct {
+	ID          int64     `json:"id,omitempty"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Extension   string    `json:"extension"`
+	Tags        string    `json:"tags,omitempty"`
+	Album       string    `json:"album,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	LastUpdate  time.Time `json:"last_update"`
+}
+
+// legacyEvent covers the bodies published before the envelope: a single
+// Image for uploads, or an Action with its Images for batches.
+type legacyEvent struct {
+	Image
+	Action string
+	Images []Image
+}
+
+// permanentError marks a message that will never be handled, however many
+// times it is retried, so the consumer dead-letters it straight away.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// publishEventToSQS sends a single event of the given type for the images to
+// the queue, with the request id and the trace context of ctx so its
+// consumers can log it and continue the trace. The send is not cancelled
+// with ctx: once the images are stored, their event should go out.
+func publishEventToSQS(ctx context.Context, eventType string, images []Image) error {
+	event, err := newImageEvent(eventType, images)
+	if err != nil {
+		return err
+	}
+	bodyMessage, _ := json.Marshal(event)
+	attributes := eventAttributes(event)
+	if requestID := requestIDFrom(ctx); requestID != "" {
+		attributes[requestIDAttribute] = stringAttribute(requestID)
+	}
+	injectTraceContext(ctx, attributes)
+
+	// Send a message to the SQS queue
+	svc := sqs.New(awsSession)
+	_, err = svc.SendMessageWithContext(context.WithoutCancel(ctx), &sqs.SendMessageInput{
+		MessageBody:       aws.String(string(bodyMessage)),
+		MessageAttributes: attributes,
+		QueueUrl:          aws.String(queueURL),
+	})
+	sqsMessagesPublished.WithLabelValues(eventType, outcome(err)).Inc()
+	if err != nil {
+		return fmt.Errorf("sending event %s to SQS: %w", event.ID, err)
+	}
+	slog.InfoContext(ctx, "Event sent to SQS", "event_id", event.ID, "event_type", event.Type, "images", len(images))
+	liveFeed.publish(event)
+	return nil
+}
+
+func newImageEvent(eventType string, images []Image) (eventEnvelope, error) {
+	payload := imageEventPayload{Images: make([]eventImage, len(images))}
+	for i, image := range images {
+		payload.Images[i] = eventImage{
+			ID:          image.ID,
+			Name:        image.Name,
+			Size:        image.Size,
+			Extension:   image.Extension,
+			Tags:        image.Tags,
+			Album:       image.Album,
+			ContentType: image.ContentType,
+			LastUpdate:  image.LastUpdate,
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return eventEnvelope{}, err
+	}
+	return eventEnvelope{
+		ID:            newEventID(),
+		Type:          eventType,
+		OccurredAt:    time.Now().UTC(),
+		SchemaVersion: eventSchemaVersion,
+		Payload:       body,
+	}, nil
+}
+
+func eventAttributes(event eventEnvelope) map[string]*sqs.MessageAttributeValue {
+	return map[string]*sqs.MessageAttributeValue{
+		eventIDAttribute:   stringAttribute(event.ID),
+		eventTypeAttribute: stringAttribute(event.Type),
+		eventSchemaVersionAttribute: {
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(event.SchemaVersion)),
+		},
+	}
+}
+
+// decodeEvent parses the body of a queue message into an event of the
+// current schema version, upgrading bodies published before the envelope.
+// Bodies of an unknown type or a newer version are a permanentError.
+func decodeEvent(msg *sqs.Message) (eventEnvelope, imageEventPayload, error) {
+	var event eventEnvelope
+	var payload imageEventPayload
+	body := []byte(aws.StringValue(msg.Body))
+	// Tell legacy bodies apart first: their numeric ID would not decode into
+	// the id of the envelope, field names matching regardless of case
+	var version struct {
+		Type          string `json:"type"`
+		SchemaVersion int    `json:"schema_version"`
+	}
+	if err := json.Unmarshal(body, &version); err != nil {
+		return event, payload, permanentError{fmt.Errorf("decoding event: %w", err)}
+	}
+	if version.Type == "" && version.SchemaVersion == 0 {
+		return upgradeLegacyEvent(msg, body)
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return event, payload, permanentError{fmt.Errorf("decoding event: %w", err)}
+	}
+
+	switch {
+	case event.SchemaVersion != eventSchemaVersion:
+		return event, payload, permanentError{fmt.Errorf("unsupported schema version %d of event %s", event.SchemaVersion, event.ID)}
+	case event.Type != eventImageUploaded && event.Type != eventImageDeleted:
+		return event, payload, permanentError{fmt.Errorf("unknown type '%s' of event %s", event.Type, event.ID)}
+	}
+
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return event, payload, permanentError{fmt.Errorf("decoding payload of event %s: %w", event.ID, err)}
+	}
+	return event, payload, nil
+}
+
+func upgradeLegacyEvent(msg *sqs.Message, body []byte) (eventEnvelope, imageEventPayload, error) {
+	var legacy legacyEvent
+	if err := json.Unmarshal(body, &legacy); err != nil {
+		return eventEnvelope{}, imageEventPayload{}, permanentError{fmt.Errorf("decoding legacy event: %w", err)}
+	}
+
+	eventType := eventImageUploaded
+	images := legacy.Images
+	switch legacy.Action {
+	case "":
+		if legacy.Name == "" {
+			return eventEnvelope{}, imageEventPayload{}, permanentError{fmt.Errorf("unrecognised message body: %s", body)}
+		}
+		images = []Image{legacy.Image}
+	case "uploaded":
+	case "deleted":
+		eventType = eventImageDeleted
+	default:
+		return eventEnvelope{}, imageEventPayload{}, permanentError{fmt.Errorf("unknown legacy action '%s'", legacy.Action)}
+	}
+
+	event, err := newImageEvent(eventType, images)
+	if err != nil {
+		return event, imageEventPayload{}, err
+	}
+	// Keep the id stable across retries of the same message
+	event.ID = aws.StringValue(msg.MessageId)
+	if sent, err := strconv.ParseInt(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64); err == nil {
+		event.OccurredAt = time.UnixMilli(sent).UTC()
+	}
+
+	var payload imageEventPayload
+	err = json.Unmarshal(event.Payload, &payload)
+	return event, payload, err
+}
+
+// newEventID returns a random (version 4) UUID.
+func newEventID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestDecodeEvent(t *testing.T) {
+	sent := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	message := func(body string) *sqs.Message {
+		return &sqs.Message{
+			MessageId: aws.String("message-1"),
+			Body:      aws.String(body),
+			Attributes: map[string]*string{
+				sqs.MessageSystemAttributeNameSentTimestamp: aws.String("1709294400000"),
+			},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		body           string
+		wantID         string
+		wantType       string
+		wantNames      []string
+		wantOccurredAt time.Time
+		wantPermanent  bool
+	}{
+		{
+			name:      "current envelope",
+			body:      `{"id":"event-1","type":"image.deleted","occurred_at":"2024-03-01T11:00:00Z","schema_version":1,"payload":{"images":[{"name":"a.png","size":1,"extension":".png","last_update":"2024-03-01T10:00:00Z"}]}}`,
+			wantID:    "event-1",
+			wantType:  eventImageDeleted,
+			wantNames: []string{"a.png"},
+		},
+		{
+			name:           "legacy single upload",
+			body:           `{"ID":3,"Name":"cat.png","Size":10,"Extension":".png","Tags":"cute"}`,
+			wantID:         "message-1",
+			wantType:       eventImageUploaded,
+			wantNames:      []string{"cat.png"},
+			wantOccurredAt: sent,
+		},
+		{
+			name:           "legacy batch upload",
+			body:           `{"Action":"uploaded","Images":[{"Name":"a.png"},{"Name":"b.png"}]}`,
+			wantID:         "message-1",
+			wantType:       eventImageUploaded,
+			wantNames:      []string{"a.png", "b.png"},
+			wantOccurredAt: sent,
+		},
+		{
+			name:           "legacy batch delete",
+			body:           `{"Action":"deleted","Images":[{"Name":"a.png"}]}`,
+			wantID:         "message-1",
+			wantType:       eventImageDeleted,
+			wantNames:      []string{"a.png"},
+			wantOccurredAt: sent,
+		},
+		{name: "legacy unknown action", body: `{"Action":"renamed","Images":[]}`, wantPermanent: true},
+		{name: "unrecognised body", body: `{"hello":"world"}`, wantPermanent: true},
+		{name: "not JSON", body: `not json`, wantPermanent: true},
+		{name: "newer schema version", body: `{"id":"event-2","type":"image.uploaded","schema_version":2,"payload":{}}`, wantPermanent: true},
+		{name: "unknown type", body: `{"id":"event-3","type":"image.renamed","schema_version":1,"payload":{}}`, wantPermanent: true},
+		{name: "unreadable payload", body: `{"id":"event-4","type":"image.uploaded","schema_version":1,"payload":"oops"}`, wantPermanent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, payload, err := decodeEvent(message(tt.body))
+			if tt.wantPermanent {
+				var permanent permanentError
+				if !errors.As(err, &permanent) {
+					t.Fatalf("error = %v, want a permanent error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if event.ID != tt.wantID || event.Type != tt.wantType || event.SchemaVersion != eventSchemaVersion {
+				t.Errorf("got event %s of type %s version %d, want %s of type %s version %d",
+					event.ID, event.Type, event.SchemaVersion, tt.wantID, tt.wantType, eventSchemaVersion)
+			}
+			if !tt.wantOccurredAt.IsZero() && !event.OccurredAt.Equal(tt.wantOccurredAt) {
+				t.Errorf("OccurredAt = %s, want %s", event.OccurredAt, tt.wantOccurredAt)
+			}
+			var names []string
+			for _, image := range payload.Images {
+				names = append(names, image.Name)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("images = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// feedHeartbeat is how often idle connections to the live feed are pinged, so
+// proxies do not close them and dead clients are noticed.
+const feedHeartbeat = 15 * time.Second
+
+// feedSubscriberBuffer is how many events a connection may fall behind by
+// before it is dropped; the client can then reconnect and resume.
+const feedSubscriberBuffer = 64
+
+// feedRelayLookback is how many ids before the last one relayed are read
+// again, to relay the events whose insert committed after a later one's.
+const feedRelayLookback = 100
+
+// feedRelayBatch bounds the number of events relayed at once.
+const feedRelayBatch = 500
+
+// eventFeed fans the image events out to the live feed connections, keeping
+// the most recent ones so a client reconnecting with the id of the last event
+// it received gets the ones it missed.
+//
+// It is fed with the events this instance publishes, as soon as they are, and
+// with every event of the application by runFeedRelay, whichever instance
+// consumed it from the queue. Each event is only sent once, by its id.
+type eventFeed struct {
+	mu          sync.Mutex
+	size        int
+	recent      []eventEnvelope
+	seen        map[string]bool
+	subscribers map[chan eventEnvelope]bool
+	closed      bool
+}
+
+// liveFeed is the feed of the image events, keeping the last FEED_BUFFER_SIZE
+// (default 1000) of them.
+var liveFeed = newEventFeed(getEnvInt("FEED_BUFFER_SIZE", 1000))
+
+func newEventFeed(size int) *eventFeed {
+	if size < 1 {
+		size = 1
+	}
+	return &eventFeed{
+		size:        size,
+		seen:        map[string]bool{},
+		subscribers: map[chan eventEnvelope]bool{},
+	}
+}
+
+// publish sends event to every connection, unless it was already sent.
+func (f *eventFeed) publish(event eventEnvelope) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.seen[event.ID] {
+		return
+	}
+	if len(f.recent) == f.size {
+		delete(f.seen, f.recent[0].ID)
+		f.recent = append(f.recent[:0], f.recent[1:]...)
+	}
+	f.recent = append(f.recent, event)
+	f.seen[event.ID] = true
+
+	for ch := range f.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Too slow to keep up, it can reconnect and resume
+			delete(f.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends every connection, when the server shuts down: the channels of
+// the subscribers are closed, and so are those of the later ones.
+func (f *eventFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for ch := range f.subscribers {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+// subscribe returns the events after lastEventID still kept, none when it is
+// empty and all of them when it is too old, followed by a channel of the new
+// events. The channel is closed when the subscriber falls behind, calls
+// cancel or the feed is closed.
+func (f *eventFeed) subscribe(lastEventID string) (backlog []eventEnvelope, events chan eventEnvelope, cancel func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if lastEventID != "" {
+		start := 0
+		for i, event := range f.recent {
+			if event.ID == lastEventID {
+				start = i + 1
+				break
+			}
+		}
+		backlog = append(backlog, f.recent[start:]...)
+	}
+
+	events = make(chan eventEnvelope, feedSubscriberBuffer)
+	if f.closed {
+		close(events)
+		return backlog, events, func() {}
+	}
+	f.subscribers[events] = true
+	cancel = func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.subscribers[events] {
+			delete(f.subscribers, events)
+			close(events)
+		}
+	}
+	return backlog, events, cancel
+}
+
+// feedEventsTableName is the table the consumers of every instance append
+// the events to, for the relay of each instance to feed them to its clients.
+func feedEventsTableName() string {
+	return dbTableName + "_feed_events"
+}
+
+func createFeedEventsTable() {
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id BIGINT NOT NULL AUTO_INCREMENT,
+			event_id VARCHAR(64) NOT NULL,
+			event MEDIUMTEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (id),
+			UNIQUE KEY (event_id),
+			KEY (created_at)
+		)`, feedEventsTableName()))
+	if err != nil {
+		panic(err.Error())
+	}
+	slog.Info("Table created or already exists", "table", feedEventsTableName())
+}
+
+// addFeedEvent hands event to the relays of every instance. Adding the same
+// event twice, e.g. when its message is redelivered, keeps a single copy.
+func addFeedEvent(ctx context.Context, event eventEnvelope) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(
+		"INSERT IGNORE INTO %s(event_id, event, created_at) VALUES( ?, ?, UTC_TIMESTAMP() )",
+		feedEventsTableName(),
+	), event.ID, string(body))
+	return err
+}
+
+// runFeedRelay feeds liveFeed with the events added by every instance, until
+// ctx is done. It starts with the last FEED_BUFFER_SIZE of them, so a client
+// resumes from any instance, then checks for new ones every
+// FEED_POLL_INTERVAL (default 1s). Events are kept FEED_RETENTION (default
+// 1h), long enough for every relay to read them.
+func runFeedRelay(ctx context.Context) {
+	interval := getEnvDuration("FEED_POLL_INTERVAL", time.Second)
+	retention := getEnvDuration("FEED_RETENTION", time.Hour)
+	relay := newFeedRelay(liveFeed)
+	if err := relay.prime(ctx, liveFeed.size); err != nil && ctx.Err() == nil {
+		slog.ErrorContext(ctx, "Error reading the recent events of the live feed", "error", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	purged := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := relay.poll(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Error reading the events of the live feed", "error", err)
+		}
+		if time.Since(purged) > time.Minute {
+			purged = time.Now()
+			_, err := db.ExecContext(ctx, fmt.Sprintf(
+				"DELETE FROM %s WHERE created_at < DATE_SUB(UTC_TIMESTAMP(), INTERVAL ? SECOND) LIMIT ?",
+				feedEventsTableName(),
+			), int64(retention.Seconds()), feedRelayBatch)
+			if err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Error purging the events of the live feed", "error", err)
+			}
+		}
+	}
+}
+
+// feedRelay publishes the rows of the feed events table to a feed, each once.
+type feedRelay struct {
+	feed    *eventFeed
+	lastID  int64
+	relayed map[int64]bool
+}
+
+func newFeedRelay(feed *eventFeed) *feedRelay {
+	return &feedRelay{feed: feed, relayed: map[int64]bool{}}
+}
+
+// prime relays the last n events.
+func (r *feedRelay) prime(ctx context.Context, n int) error {
+	return r.query(ctx, fmt.Sprintf(
+		"SELECT id, event FROM (SELECT id, event FROM %s ORDER BY id DESC LIMIT ?) recent ORDER BY id",
+		feedEventsTableName(),
+	), n)
+}
+
+// poll relays the events added since the last poll.
+func (r *feedRelay) poll(ctx context.Context) error {
+	return r.query(ctx, fmt.Sprintf(
+		"SELECT id, event FROM %s WHERE id > ? ORDER BY id LIMIT ?",
+		feedEventsTableName(),
+	), r.lastID-feedRelayLookback, feedRelayBatch+feedRelayLookback)
+}
+
+func (r *feedRelay) query(ctx context.Context, query string, args ...interface{}) error {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var body string
+		if err := rows.Scan(&id, &body); err != nil {
+			return err
+		}
+		var event eventEnvelope
+		if err := json.Unmarshal([]byte(body), &event); err != nil {
+			slog.WarnContext(ctx, "Skipping unreadable event of the live feed", "id", id, "error", err)
+			event = eventEnvelope{}
+		}
+		r.deliver(id, event)
+	}
+	return rows.Err()
+}
+
+// deliver publishes the event of row id, unless it already did. The rows
+// before the lookback are forgotten, they are not read again.
+func (r *feedRelay) deliver(id int64, event eventEnvelope) {
+	if r.relayed[id] {
+		return
+	}
+	r.relayed[id] = true
+	if event.ID != "" {
+		r.feed.publish(event)
+	}
+	if id > r.lastID {
+		r.lastID = id
+		for relayed := range r.relayed {
+			if relayed <= r.lastID-feedRelayLookback {
+				delete(r.relayed, relayed)
+			}
+		}
+	}
+}
+
+// feedFilter selects the events sent to a connection, from the query
+// parameters types (comma separated), extension, album and tag. An event
+// matches when one of its images does.
+type feedFilter struct {
+	Types     map[string]bool
+	Extension string
+	Album     string
+	Tag       string
+}
+
+func newFeedFilter(r *http.Request) (feedFilter, error) {
+	query := r.URL.Query()
+	filter := feedFilter{
+		Extension: strings.ToLower(strings.TrimPrefix(query.Get("extension"), ".")),
+		Album:     query.Get("album"),
+		Tag:       strings.ToLower(strings.TrimSpace(query.Get("tag"))),
+	}
+	if types := query.Get("types"); types != "" {
+		filter.Types = map[string]bool{}
+		for _, eventType := range strings.Split(types, ",") {
+			if eventType != eventImageUploaded && eventType != eventImageDeleted {
+				return filter, fmt.Errorf("unknown event type: %s", eventType)
+			}
+			filter.Types[eventType] = true
+		}
+	}
+	return filter, nil
+}
+
+func (f feedFilter) matches(event eventEnvelope) bool {
+	if f.Types != nil && !f.Types[event.Type] {
+		return false
+	}
+	if f.Extension == "" && f.Album == "" && f.Tag == "" {
+		return true
+	}
+	var payload imageEventPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return false
+	}
+	for _, image := range payload.Images {
+		if f.Extension != "" && strings.ToLower(image.Extension) != f.Extension {
+			continue
+		}
+		if f.Album != "" && image.Album != f.Album {
+			continue
+		}
+		if f.Tag != "" && !containsTag(image.Tags, f.Tag) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func containsTag(tags, tag string) bool {
+	for _, t := range strings.Split(tags, ",") {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// lastEventID is where a client resumes the feed from: the Last-Event-ID
+// header sent by EventSource when it reconnects, or the lastEventId query
+// parameter for clients that cannot set headers.
+func lastEventID(r *http.Request) string {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("lastEventId")
+}
+
+// streamEvents pushes the image events as Server-Sent Events, each with the
+// event id as its id and the event type as its name.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := newFeedFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	backlog, events, cancel := liveFeed.subscribe(lastEventID(r))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event eventEnvelope) error {
+		if !filter.matches(event) {
+			return nil
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, body)
+		return err
+	}
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := send(event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+var feedUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// streamEventsWebSocket pushes the image events over a WebSocket, each as a
+// text message holding the event envelope.
+func streamEventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	filter, err := newFeedFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := feedUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied to the client
+		slog.WarnContext(r.Context(), "Error upgrading live feed connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	backlog, events, cancel := liveFeed.subscribe(lastEventID(r))
+	defer cancel()
+
+	// The client only sends control messages, read them so pongs and the
+	// closing handshake are handled, and stop when it goes away
+	closed := make(chan struct{})
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(2 * feedHeartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * feedHeartbeat))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(event eventEnvelope) error {
+		if !filter.matches(event) {
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(feedHeartbeat))
+		return conn.WriteJSON(event)
+	}
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(feedHeartbeat)); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "reconnect to resume"),
+					time.Now().Add(time.Second))
+				return
+			}
+			if err := send(event); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// testEvent builds an event of eventType for images.
+func testEvent(t *testing.T, id, eventType string, images ...eventImage) eventEnvelope {
+	t.Helper()
+	payload, err := json.Marshal(imageEventPayload{Images: images})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return eventEnvelope{ID: id, Type: eventType, SchemaVersion: eventSchemaVersion, Payload: payload}
+}
+
+func eventIDs(events []eventEnvelope) []string {
+	ids := []string{}
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestFeedFilterMatches(t *testing.T) {
+	cat := eventImage{Name: "cat.PNG", Extension: "PNG", Album: "pets", Tags: "cute,cat"}
+	beach := eventImage{Name: "beach.jpg", Extension: "jpg", Album: "holidays", Tags: "sea"}
+	upload := testEvent(t, "1", eventImageUploaded, cat, beach)
+	deletion := testEvent(t, "2", eventImageDeleted, beach)
+
+	tests := []struct {
+		name  string
+		query string
+		event eventEnvelope
+		want  bool
+	}{
+		{"no filter", "", upload, true},
+		{"type matches", "?types=image.uploaded", upload, true},
+		{"type does not match", "?types=image.uploaded", deletion, false},
+		{"several types", "?types=image.uploaded,image.deleted", deletion, true},
+		{"extension of one image", "?extension=.png", upload, true},
+		{"extension of no image", "?extension=gif", upload, false},
+		{"album", "?album=pets", upload, true},
+		{"album is case sensitive", "?album=Pets", upload, false},
+		{"tag", "?tag=Cute", upload, true},
+		{"tag is not a substring match", "?tag=cut", upload, false},
+		{"filters apply to the same image", "?album=pets&extension=jpg", upload, false},
+		{"filters of one image", "?album=holidays&extension=jpg&tag=sea", upload, true},
+		{"type and album", "?types=image.deleted&album=holidays", deletion, true},
+		{"unreadable payload", "?album=pets", eventEnvelope{ID: "3", Type: eventImageUploaded, Payload: json.RawMessage(`"oops"`)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := newFeedFilter(httptest.NewRequest("GET", "/image/events"+tt.query, nil))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := filter.matches(tt.event); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFeedFilterRejectsUnknownTypes(t *testing.T) {
+	if _, err := newFeedFilter(httptest.NewRequest("GET", "/image/events?types=image.renamed", nil)); err == nil {
+		t.Error("expected an error for an unknown event type")
+	}
+}
+
+func TestEventFeedSubscribeResume(t *testing.T) {
+	tests := []struct {
+		name        string
+		published   []string
+		lastEventID string
+		wantBacklog []string
+	}{
+		{"no last event id", []string{"1", "2", "3"}, "", []string{}},
+		{"resume after an event", []string{"1", "2", "3"}, "1", []string{"2", "3"}},
+		{"up to date", []string{"1", "2", "3"}, "3", []string{}},
+		{"unknown id gets everything kept", []string{"1", "2", "3"}, "0", []string{"1", "2", "3"}},
+		{"evicted id gets everything kept", []string{"1", "2", "3", "4", "5"}, "1", []string{"3", "4", "5"}},
+		{"duplicates are sent once", []string{"1", "2", "2", "3"}, "1", []string{"2", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feed := newEventFeed(3)
+			for _, id := range tt.published {
+				feed.publish(testEvent(t, id, eventImageUploaded))
+			}
+			backlog, events, cancel := feed.subscribe(tt.lastEventID)
+			defer cancel()
+			if got := eventIDs(backlog); !reflect.DeepEqual(got, tt.wantBacklog) {
+				t.Errorf("backlog = %v, want %v", got, tt.wantBacklog)
+			}
+
+			feed.publish(testEvent(t, "new", eventImageUploaded))
+			select {
+			case event := <-events:
+				if event.ID != "new" {
+					t.Errorf("received %s, want new", event.ID)
+				}
+			default:
+				t.Error("the new event was not sent to the subscriber")
+			}
+		})
+	}
+}
+
+func TestEventFeedClose(t *testing.T) {
+	feed := newEventFeed(10)
+	_, before, _ := feed.subscribe("")
+	feed.close()
+	if _, ok := <-before; ok {
+		t.Error("the channel of a subscriber was not closed")
+	}
+	_, after, cancel := feed.subscribe("")
+	cancel()
+	if _, ok := <-after; ok {
+		t.Error("the channel of a later subscriber was not closed")
+	}
+}
+
+func TestFeedRelayDeliversEachRowOnce(t *testing.T) {
+	feed := newEventFeed(1)
+	_, events, cancel := feed.subscribe("")
+	defer cancel()
+	relay := newFeedRelay(feed)
+
+	// Published locally first, then read from the table by the relay
+	feed.publish(testEvent(t, "local", eventImageUploaded))
+	relay.deliver(1, testEvent(t, "local", eventImageUploaded))
+	relay.deliver(3, testEvent(t, "b", eventImageDeleted))
+	// Row 2 committed after row 3, and row 3 is read again with it
+	relay.deliver(2, testEvent(t, "a", eventImageUploaded))
+	relay.deliver(3, testEvent(t, "b", eventImageDeleted))
+	relay.deliver(4, eventEnvelope{})
+
+	var got []string
+	for len(events) > 0 {
+		got = append(got, (<-events).ID)
+	}
+	if want := []string{"local", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("relayed %v, want %v", got, want)
+	}
+	if relay.lastID != 4 {
+		t.Errorf("lastID = %d, want 4", relay.lastID)
+	}
+}
+
+func TestFeedRelayForgetsRowsBeforeLookback(t *testing.T) {
+	relay := newFeedRelay(newEventFeed(10))
+	relay.deliver(1, testEvent(t, "old", eventImageUploaded))
+	relay.deliver(1+feedRelayLookback, testEvent(t, "new", eventImageUploaded))
+	if relay.relayed[1] {
+		t.Error("a row before the lookback is still remembered")
+	}
+	if !relay.relayed[1+feedRelayLookback] {
+		t.Error("the last row relayed is forgotten")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// maxDependencyBackoff bounds the pause between two rounds of checks while
+// waiting for the dependencies at startup.
+const maxDependencyBackoff = 30 * time.Second
+
+// dependencyCheck reports whether a dependency of the application can be
+// reached, with the permissions the application needs.
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// dependencyStatus is the result of a check, as served by /readyz.
+type dependencyStatus struct {
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"durationMs"`
+	CheckedAt  time.Time `json:"checkedAt"`
+}
+
+// readinessReport is the body of /readyz.
+type readinessReport struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+}
+
+func (r readinessReport) ready() bool {
+	return r.Status == "ok"
+}
+
+// failed lists the names of the dependencies that could not be reached.
+func (r readinessReport) failed() []string {
+	var names []string
+	for name, status := range r.Dependencies {
+		if status.Status != "ok" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dependencyChecks lists the checks of the database, the bucket, the topic
+// and the queues the application uses. HEAD on the bucket needs the
+// s3:ListBucket permission.
+func dependencyChecks() []dependencyCheck {
+	s3Svc := s3.New(awsSession)
+	snsSvc := sns.New(awsSession)
+	sqsSvc := sqs.New(awsSession)
+
+	checks := []dependencyCheck{
+		{name: "mysql", check: db.PingContext},
+		{name: "s3", check: func(ctx context.Context) error {
+			_, err := s3Svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(s3Name)})
+			return err
+		}},
+		{name: "sns", check: func(ctx context.Context) error {
+			_, err := snsSvc.GetTopicAttributesWithContext(ctx, &sns.GetTopicAttributesInput{TopicArn: aws.String(topicARN)})
+			return err
+		}},
+	}
+	queues := []string{queueURL}
+	for _, key := range []string{"SQS_DLQ_URL", "INGEST_QUEUE_URL"} {
+		if url := getEnv(key, ""); url != "" {
+			queues = append(queues, url)
+		}
+	}
+	for _, url := range queues {
+		url := url
+		checks = append(checks, dependencyCheck{name: "sqs:" + queueName(url), check: func(ctx context.Context) error {
+			_, err := sqsSvc.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+				QueueUrl:       aws.String(url),
+				AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameQueueArn}),
+			})
+			return err
+		}})
+	}
+	return checks
+}
+
+// readinessChecker runs the dependency checks concurrently, each within
+// timeout, and keeps their results for ttl so frequent probes do not load
+// the dependencies.
+type readinessChecker struct {
+	checks  []dependencyCheck
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu     sync.Mutex
+	report readinessReport
+	expiry time.Time
+}
+
+// newReadinessChecker checks the dependencies within HEALTH_CHECK_TIMEOUT
+// (default 2s) each, and keeps the results for HEALTH_CHECK_CACHE_TTL
+// (default 5s).
+func newReadinessChecker() *readinessChecker {
+	return &readinessChecker{
+		checks:  dependencyChecks(),
+		timeout: getEnvDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second),
+		ttl:     getEnvDuration("HEALTH_CHECK_CACHE_TTL", 5*time.Second),
+	}
+}
+
+// cached returns the last report, checking the dependencies again once it
+// has expired. Concurrent callers wait for the same round of checks, which
+// is not cancelled with the context of the caller that started it.
+func (c *readinessChecker) cached(ctx context.Context) readinessReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().Before(c.expiry) {
+		return c.report
+	}
+	c.report = c.check(context.WithoutCancel(ctx))
+	c.expiry = time.Now().Add(c.ttl)
+	return c.report
+}
+
+// check runs every check now.
+func (c *readinessChecker) check(ctx context.Context) readinessReport {
+	report := readinessReport{Status: "ok", Dependencies: map[string]dependencyStatus{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, dependency := range c.checks {
+		wg.Add(1)
+		go func(dependency dependencyCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			started := time.Now()
+			err := dependency.check(checkCtx)
+			status := dependencyStatus{
+				Status:     "ok",
+				DurationMS: time.Since(started).Milliseconds(),
+				CheckedAt:  started,
+			}
+			if err != nil {
+				status.Status = "error"
+				status.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Dependencies[dependency.name] = status
+			if err != nil {
+				report.Status = "error"
+			}
+		}(dependency)
+	}
+	wg.Wait()
+	return report
+}
+
+// waitForDependencies checks the dependencies until they can all be reached,
+// pausing between rounds with an exponential backoff, and fails once timeout
+// has elapsed.
+func (c *readinessChecker) waitForDependencies(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		report := c.check(ctx)
+		if report.ready() {
+			slog.InfoContext(ctx, "Dependencies reachable", "attempts", attempt)
+			return nil
+		}
+		failed := report.failed()
+		slog.WarnContext(ctx, "Waiting for dependencies", "unreachable", failed, "attempt", attempt, "retry_in", backoff.String())
+
+		sleepContext(ctx, backoff)
+		if ctx.Err() != nil {
+			return fmt.Errorf("dependencies still unreachable after %s: %s", timeout, strings.Join(failed, ", "))
+		}
+		backoff *= 2
+		if backoff > maxDependencyBackoff {
+			backoff = maxDependencyBackoff
+		}
+	}
+}
+
+// serveLiveness answers /healthz: the process is up and serving, whatever
+// the state of its dependencies, so it is not restarted for their outages.
+func serveLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// serveReadiness answers /readyz with the state of every dependency, and 503
+// Service Unavailable when one of them cannot be reached.
+func (c *readinessChecker) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	report := c.cached(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.ready() {
+		slog.WarnContext(r.Context(), "Not ready", "unreachable", report.failed())
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
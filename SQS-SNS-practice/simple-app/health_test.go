@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// countedCheck is a dependency check failing with err, which counts its runs.
+func countedCheck(name string, runs *atomic.Int32, err error) dependencyCheck {
+	return dependencyCheck{name: name, check: func(ctx context.Context) error {
+		runs.Add(1)
+		return err
+	}}
+}
+
+func TestServeLiveness(t *testing.T) {
+	rec := httptest.NewRecorder()
+	serveLiveness(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"status":"ok"}` {
+		t.Errorf("/healthz answered %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestServeReadiness(t *testing.T) {
+	var runs atomic.Int32
+	serve := func(checker *readinessChecker) (*httptest.ResponseRecorder, readinessReport) {
+		rec := httptest.NewRecorder()
+		checker.serveReadiness(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var report readinessReport
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return rec, report
+	}
+
+	t.Run("every dependency reachable", func(t *testing.T) {
+		rec, report := serve(&readinessChecker{timeout: time.Second, checks: []dependencyCheck{
+			countedCheck("mysql", &runs, nil),
+			countedCheck("s3", &runs, nil),
+		}})
+		if rec.Code != http.StatusOK || !report.ready() || len(report.Dependencies) != 2 {
+			t.Errorf("/readyz answered %d %+v", rec.Code, report)
+		}
+		if rec.Header().Get("Cache-Control") != "no-store" {
+			t.Error("readiness may be cached by proxies")
+		}
+	})
+
+	t.Run("one dependency unreachable", func(t *testing.T) {
+		rec, report := serve(&readinessChecker{timeout: time.Second, checks: []dependencyCheck{
+			countedCheck("mysql", &runs, nil),
+			countedCheck("sns", &runs, errors.New("AuthorizationError: not authorized to perform SNS:GetTopicAttributes")),
+		}})
+		if rec.Code != http.StatusServiceUnavailable || report.Status != "error" {
+			t.Errorf("/readyz answered %d %+v, want 503", rec.Code, report)
+		}
+		if got := report.Dependencies["sns"]; got.Status != "error" || !strings.HasPrefix(got.Error, "AuthorizationError") {
+			t.Errorf("sns = %+v, want its error", got)
+		}
+		if got := report.Dependencies["mysql"]; got.Status != "ok" || got.Error != "" || got.CheckedAt.IsZero() {
+			t.Errorf("mysql = %+v, want ok", got)
+		}
+	})
+}
+
+func TestReadinessCheckerCachesResults(t *testing.T) {
+	var runs atomic.Int32
+	checker := &readinessChecker{
+		timeout: time.Second,
+		ttl:     100 * time.Millisecond,
+		checks:  []dependencyCheck{countedCheck("mysql", &runs, nil)},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checker.cached(context.Background())
+		}()
+	}
+	wg.Wait()
+	if got := runs.Load(); got != 1 {
+		t.Errorf("10 probes within the ttl ran the check %d times, want 1", got)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	checker.cached(context.Background())
+	if got := runs.Load(); got != 2 {
+		t.Errorf("probe after the ttl ran the check %d times in all, want 2", got)
+	}
+}
+
+func TestReadinessCheckerTimesOutEachCheck(t *testing.T) {
+	checker := &readinessChecker{timeout: 50 * time.Millisecond, checks: []dependencyCheck{
+		{name: "s3", check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		{name: "sqs:uploads", check: func(ctx context.Context) error {
+			time.Sleep(30 * time.Millisecond)
+			return nil
+		}},
+	}}
+
+	started := time.Now()
+	report := checker.check(context.Background())
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("checks took %s with a timeout of 50ms", elapsed)
+	}
+	if got := report.failed(); len(got) != 1 || got[0] != "s3" {
+		t.Errorf("failed = %v, want the hanging check only", got)
+	}
+	if got := report.Dependencies["s3"].Error; got != context.DeadlineExceeded.Error() {
+		t.Errorf("s3 error = %q", got)
+	}
+}
+
+func TestWaitForDependencies(t *testing.T) {
+	t.Run("returns once reachable", func(t *testing.T) {
+		var runs atomic.Int32
+		checker := &readinessChecker{timeout: time.Second, checks: []dependencyCheck{{name: "mysql", check: func(ctx context.Context) error {
+			if runs.Add(1) == 1 {
+				return errors.New("connection refused")
+			}
+			return nil
+		}}}}
+		if err := checker.waitForDependencies(context.Background(), 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if runs.Load() != 2 {
+			t.Errorf("checked %d times, want 2", runs.Load())
+		}
+	})
+
+	t.Run("fails after timeout naming the unreachable", func(t *testing.T) {
+		var runs atomic.Int32
+		checker := &readinessChecker{timeout: time.Second, checks: []dependencyCheck{
+			countedCheck("sns", &runs, errors.New("no route to host")),
+			countedCheck("mysql", &runs, errors.New("connection refused")),
+			countedCheck("s3", &runs, nil),
+		}}
+		err := checker.waitForDependencies(context.Background(), 100*time.Millisecond)
+		if err == nil || !strings.HasSuffix(err.Error(), ": mysql, sns") {
+			t.Errorf("waitForDependencies() = %v, want the unreachable listed", err)
+		}
+	})
+}
+
+func TestDependencyChecksCoverEveryQueue(t *testing.T) {
+	previousSession, previousQueue := awsSession, queueURL
+	awsSession = session.Must(session.NewSession(&aws.Config{Region: aws.String("eu-west-1")}))
+	queueURL = "https://sqs.eu-west-1.amazonaws.com/123456789012/uploads"
+	t.Cleanup(func() { awsSession, queueURL = previousSession, previousQueue })
+	t.Setenv("SQS_DLQ_URL", "https://sqs.eu-west-1.amazonaws.com/123456789012/uploads-dlq")
+	t.Setenv("INGEST_QUEUE_URL", "")
+
+	var names []string
+	for _, check := range dependencyChecks() {
+		names = append(names, check.name)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != "mysql s3 sns sqs:uploads sqs:uploads-dlq" {
+		t.Errorf("checks = %s", got)
+	}
+}
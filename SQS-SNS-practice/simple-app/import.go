@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// importCommand adds the objects already in the bucket, e.g. uploaded with the
+// AWS CLI, to the metadata table. Progress is saved to a state file after every
+// listed page, so an interrupted import carries on where it stopped.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only import the images whose name starts with this prefix")
+	dryRun := flags.Bool("dry-run", false, "report what would change without writing to the database")
+	stateFile := flags.String("state", ".import-state", "file where the last imported key is saved")
+	restart := flags.Bool("restart", false, "ignore the state file and import from the first key")
+	flags.Parse(args)
+
+	startAfter := ""
+	if !*restart && !*dryRun {
+		state, err := os.ReadFile(*stateFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		startAfter = strings.TrimSpace(string(state))
+		if startAfter != "" {
+			slog.Info("Resuming import", "start_after", startAfter)
+		}
+	}
+
+	ctx := context.Background()
+	s3Svc := s3.New(awsSession)
+	counts := map[string]int{}
+	var importErr error
+	err := s3Svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:     aws.String(s3Name),
+		Prefix:     aws.String(objectKey(*prefix)),
+		StartAfter: aws.String(startAfter),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for action, count := range importObjects(ctx, s3Svc, page.Contents, *dryRun) {
+			counts[action] += count
+		}
+		if counts["failed"] > 0 {
+			importErr = fmt.Errorf("%d objects could not be imported", counts["failed"])
+			return false
+		}
+		if *dryRun || len(page.Contents) == 0 {
+			return true
+		}
+
+		lastKey := aws.StringValue(page.Contents[len(page.Contents)-1].Key)
+		if importErr = os.WriteFile(*stateFile, []byte(lastKey), 0644); importErr != nil {
+			return false
+		}
+		return true
+	})
+	slog.Info("Import finished",
+		"dry_run", *dryRun,
+		"inserted", counts["inserted"],
+		"updated", counts["updated"],
+		"unchanged", counts["unchanged"],
+		"skipped", counts["skipped"],
+		"failed", counts["failed"],
+	)
+	if err != nil {
+		return err
+	}
+	if importErr != nil {
+		return importErr
+	}
+
+	// Everything is in, the next import starts from scratch
+	if !*dryRun {
+		if err := os.Remove(*stateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// importObjects upserts the listed objects, with at most batchConcurrency
+// HEAD requests in flight, and counts the actions taken.
+func importObjects(ctx context.Context, s3Svc *s3.S3, objects []*s3.Object, dryRun bool) map[string]int {
+	counts := map[string]int{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchConcurrency)
+	for _, object := range objects {
+		key := aws.StringValue(object.Key)
+		if strings.HasSuffix(key, "/") {
+			// Folder placeholders created by the console are not images
+			mu.Lock()
+			counts["skipped"]++
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			action := "failed"
+			image, err := headImage(ctx, s3Svc, key)
+			if err == nil {
+				action, err = upsertImage(ctx, db, image, dryRun)
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "Error importing image", "key", key, "error", err)
+				action = "failed"
+			} else if action != "unchanged" {
+				slog.InfoContext(ctx, "Image imported", "name", image.Name, "action", action)
+			}
+
+			mu.Lock()
+			counts[action]++
+			mu.Unlock()
+		}(key)
+	}
+	wg.Wait()
+	return counts
+}
+
+// headImage builds the metadata of the image stored under key from its S3 headers.
+func headImage(ctx context.Context, s3Svc *s3.S3, key string) (Image, error) {
+	head, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return Image{}, err
+	}
+
+	name := strings.TrimPrefix(key, s3Prefix)
+	return Image{
+		Name:        name,
+		Size:        aws.Int64Value(head.ContentLength),
+		Extension:   getFileExtension(name),
+		ContentType: aws.StringValue(head.ContentType),
+		LastUpdate:  aws.TimeValue(head.LastModified),
+	}, nil
+}
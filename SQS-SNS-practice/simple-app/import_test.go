@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// importTable holds the images already imported, by name, and accepts the
+// inserts and updates of upsertImage.
+func importTable(existing ...Image) *scriptedDB {
+	byName := map[string]Image{}
+	for _, image := range existing {
+		byName[image.Name] = image
+	}
+	return &scriptedDB{
+		query: func(query string, args []driver.Value) (*scriptedRows, error) {
+			if image, ok := byName[args[0].(string)]; ok {
+				return imageRows(image), nil
+			}
+			return imageRows(), nil
+		},
+		exec: func(query string, args []driver.Value) (int64, error) { return 1, nil },
+	}
+}
+
+func TestUpsertImage(t *testing.T) {
+	modified := time.Date(2026, 3, 1, 12, 30, 15, 0, time.UTC)
+	stored := Image{ID: 9, Name: "cat.png", Size: 2048, Extension: "png", ContentType: "image/png", LastUpdate: modified}
+
+	t.Run("new object is inserted", func(t *testing.T) {
+		table := importTable()
+		useScriptedDB(t, table)
+
+		action, err := upsertImage(context.Background(), db, Image{Name: "dog.png", Size: 10, LastUpdate: modified}, false)
+		if err != nil || action != "inserted" {
+			t.Fatalf("upsertImage() = %q, %v, want inserted", action, err)
+		}
+		if len(table.ranMatching("INSERT INTO images")) != 1 {
+			t.Errorf("statements = %v, want one insert", table.ran())
+		}
+	})
+
+	t.Run("same object is left alone", func(t *testing.T) {
+		table := importTable(stored)
+		useScriptedDB(t, table)
+
+		// S3 reports the date with sub-second precision, the table without
+		image := stored
+		image.LastUpdate = modified.Add(400 * time.Millisecond)
+		action, err := upsertImage(context.Background(), db, image, false)
+		if err != nil || action != "unchanged" {
+			t.Fatalf("upsertImage() = %q, %v, want unchanged", action, err)
+		}
+		for _, statement := range table.ran() {
+			if !strings.HasPrefix(statement, "SELECT") {
+				t.Errorf("wrote to the table: %s", statement)
+			}
+		}
+	})
+
+	t.Run("changed object updates its row", func(t *testing.T) {
+		table := importTable(stored)
+		useScriptedDB(t, table)
+
+		image := stored
+		image.Size = 4096
+		action, err := upsertImage(context.Background(), db, image, false)
+		if err != nil || action != "updated" {
+			t.Fatalf("upsertImage() = %q, %v, want updated", action, err)
+		}
+		if len(table.ranMatching("UPDATE images SET")) != 1 {
+			t.Errorf("statements = %v, want one update", table.ran())
+		}
+	})
+
+	t.Run("dry run only reports", func(t *testing.T) {
+		table := importTable(stored)
+		useScriptedDB(t, table)
+
+		changed := stored
+		changed.ContentType = "image/webp"
+		for want, image := range map[string]Image{"inserted": {Name: "new.png"}, "updated": changed} {
+			action, err := upsertImage(context.Background(), db, image, true)
+			if err != nil || action != want {
+				t.Errorf("upsertImage(%s) = %q, %v, want %s", image.Name, action, err, want)
+			}
+		}
+		if len(table.ranMatching("INSERT")) != 0 || len(table.ranMatching("UPDATE")) != 0 {
+			t.Errorf("a dry run wrote to the table: %v", table.ran())
+		}
+	})
+}
+
+func TestImportObjectsSkipsFolderPlaceholders(t *testing.T) {
+	table := importTable()
+	useScriptedDB(t, table)
+
+	// Placeholders are skipped before any request to S3 is made
+	counts := importObjects(context.Background(), nil, []*s3.Object{{Key: aws.String("image/")}, {Key: aws.String("image/2024/")}}, false)
+	if counts["skipped"] != 2 || len(counts) != 1 {
+		t.Errorf("counts = %v, want 2 skipped", counts)
+	}
+	if len(table.ran()) != 0 {
+		t.Errorf("placeholders reached the table: %v", table.ran())
+	}
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// modeIngestLambda is a function consuming the S3 notifications of the
+// bucket, directly or through a queue.
+const modeIngestLambda = "ingest-lambda"
+
+// uploadedByMetadata marks the objects the web API uploads: it writes their
+// metadata itself, so ingestion leaves them alone.
+const (
+	uploadedByMetadata = "uploaded-by"
+	uploadedByAPI      = "simple-app"
+)
+
+// sniffLength is how much of an object is read to detect its content type,
+// as http.DetectContentType looks at no more.
+const sniffLength = 512
+
+// apiUploadMetadata is the S3 metadata of the objects the web API uploads.
+func apiUploadMetadata() map[string]*string {
+	return map[string]*string{uploadedByMetadata: aws.String(uploadedByAPI)}
+}
+
+// s3Notification is an S3 event notification. It reaches the application
+// directly from S3, or as the body of an SQS message, wrapped in an SNS
+// notification when the bucket publishes to a topic.
+type s3Notification struct {
+	// Event is s3:TestEvent for the message S3 sends when notifications are
+	// configured.
+	Event   string          `json:"Event"`
+	Records []s3EventRecord `json:"Records"`
+}
+
+type s3EventRecord struct {
+	EventSource string `json:"eventSource"`
+	EventName   string `json:"eventName"`
+	S3          struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key       string `json:"key"`
+			Sequencer string `json:"sequencer"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// objectKey returns the key of the object, which S3 sends URL encoded.
+func (r s3EventRecord) objectKey() (string, error) {
+	return url.QueryUnescape(r.S3.Object.Key)
+}
+
+func (r s3EventRecord) created() bool {
+	return strings.HasPrefix(r.EventName, "ObjectCreated:")
+}
+
+func (r s3EventRecord) removed() bool {
+	return strings.HasPrefix(r.EventName, "ObjectRemoved:")
+}
+
+// decodeS3Notification reads a notification, unwrapping it from an SNS
+// notification when needed. Its errors are permanent.
+func decodeS3Notification(body []byte) (s3Notification, error) {
+	var envelope struct {
+		Type    string `json:"Type"`
+		Message string `json:"Message"`
+	}
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Type == "Notification" {
+		body = []byte(envelope.Message)
+	}
+	var notification s3Notification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return notification, permanentError{fmt.Errorf("decoding S3 notification: %w", err)}
+	}
+	if notification.Event == "" && len(notification.Records) == 0 {
+		return notification, permanentError{errors.New("not an S3 notification")}
+	}
+	return notification, nil
+}
+
+// ingester keeps the table in line with the objects written to and removed
+// from the bucket by other means than the web API: presigned URLs, the
+// console or the CLI.
+//
+// Notifications may be delivered more than once and out of order. The
+// sequencer of the last one applied to each key is stored, and older or
+// repeated ones are skipped.
+type ingester struct {
+	s3Svc             *s3.S3
+	allowedExtensions map[string]bool
+	maxSize           int64
+	deleteRejected    bool
+	renditionWidth    int
+	renditionPrefix   string
+	maxPixels         int
+}
+
+// newIngester creates an ingester configured from the environment:
+// INGEST_ALLOWED_EXTENSIONS (default png,jpg,jpeg,gif,webp), INGEST_MAX_SIZE
+// in bytes (default 20 MiB), INGEST_DELETE_REJECTED (default false) to delete
+// the objects failing validation, and INGEST_RENDITION_WIDTH (default 0, no
+// renditions) to store a copy of each image scaled to that width under
+// INGEST_RENDITION_PREFIX (default renditions/), for the images of at most
+// INGEST_RENDITION_MAX_PIXELS (default 40 megapixels).
+func newIngester() *ingester {
+	ing := &ingester{
+		s3Svc:             s3.New(awsSession),
+		allowedExtensions: map[string]bool{},
+		maxSize:           int64(getEnvInt("INGEST_MAX_SIZE", 20<<20)),
+		deleteRejected:    getEnv("INGEST_DELETE_REJECTED", "false") == "true",
+		renditionWidth:    getEnvInt("INGEST_RENDITION_WIDTH", 0),
+		renditionPrefix:   getEnv("INGEST_RENDITION_PREFIX", "renditions/"),
+		maxPixels:         getEnvInt("INGEST_RENDITION_MAX_PIXELS", 40_000_000),
+	}
+	for _, extension := range strings.Split(getEnv("INGEST_ALLOWED_EXTENSIONS", "png,jpg,jpeg,gif,webp"), ",") {
+		if extension = strings.ToLower(strings.TrimSpace(extension)); extension != "" {
+			ing.allowedExtensions[strings.TrimPrefix(extension, ".")] = true
+		}
+	}
+	if ing.renditionWidth > 0 && ing.renditionPrefix == "" {
+		fatal("INGEST_RENDITION_PREFIX must be set when INGEST_RENDITION_WIDTH is")
+	}
+	return ing
+}
+
+// sequencerTableName is the table holding the sequencer of the last
+// notification applied to each object.
+func sequencerTableName() string {
+	return dbTableName + "_s3_sequencers"
+}
+
+func createSequencerTable() {
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			object_key VARBINARY(1024) NOT NULL,
+			sequencer VARCHAR(64) NOT NULL,
+			updated_at DATETIME NOT NULL,
+			PRIMARY KEY (object_key)
+		)`, sequencerTableName()))
+	if err != nil {
+		panic(err.Error())
+	}
+	slog.Info("Table created or already exists", "table", sequencerTableName())
+}
+
+// handleNotification applies each record of notification in turn. It stops
+// at the first failure, the records before it being skipped on the retry.
+func (ing *ingester) handleNotification(ctx context.Context, notification s3Notification) error {
+	if notification.Event == "s3:TestEvent" {
+		slog.InfoContext(ctx, "Received the S3 test event")
+		return nil
+	}
+	for _, record := range notification.Records {
+		if err := ing.handleRecord(ctx, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ing *ingester) handleRecord(ctx context.Context, record s3EventRecord) error {
+	key, err := record.objectKey()
+	if err != nil {
+		return permanentError{fmt.Errorf("decoding object key '%s': %w", record.S3.Object.Key, err)}
+	}
+	switch {
+	case record.S3.Bucket.Name != s3Name:
+		slog.WarnContext(ctx, "Ignoring notification of another bucket",
+			"event_name", record.EventName, "bucket", record.S3.Bucket.Name, "key", key)
+		return nil
+	case !strings.HasPrefix(key, s3Prefix) || strings.HasSuffix(key, "/"):
+		return nil
+	case ing.renditionPrefix != "" && strings.HasPrefix(key, ing.renditionPrefix):
+		// Written by ingestion itself
+		return nil
+	case !record.created() && !record.removed():
+		slog.InfoContext(ctx, "Ignoring notification", "event_name", record.EventName, "key", key)
+		return nil
+	}
+
+	sequencer := record.S3.Object.Sequencer
+	if sequencer != "" {
+		// Skip the S3 calls of a notification applied already; it is checked
+		// again with the row locked before anything is written
+		applied, err := ing.appliedSequencer(ctx, key)
+		if err != nil {
+			return err
+		}
+		if ing.superseded(ctx, key, sequencer, applied) {
+			return nil
+		}
+	}
+	if record.created() {
+		return ing.ingestObject(ctx, key, sequencer)
+	}
+	return ing.removeObject(ctx, key, sequencer)
+}
+
+// appliedSequencer returns the sequencer of the last notification applied to
+// key, or "" when there was none.
+func (ing *ingester) appliedSequencer(ctx context.Context, key string) (string, error) {
+	var applied string
+	err := db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT sequencer FROM %s WHERE object_key = ?",
+		sequencerTableName(),
+	), key).Scan(&applied)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return applied, err
+}
+
+// superseded reports whether a notification at or after sequencer, the
+// applied one, was already applied to key.
+func (ing *ingester) superseded(ctx context.Context, key, sequencer, applied string) bool {
+	if applied == "" || compareSequencers(applied, sequencer) < 0 {
+		return false
+	}
+	slog.InfoContext(ctx, "Skipping notification already applied",
+		"key", key, "sequencer", sequencer, "applied_sequencer", applied)
+	return true
+}
+
+// applyInOrder runs write in a transaction unless a notification at or after
+// sequencer was already applied to key, records sequencer in the same
+// transaction, and reports whether write ran. write must make its changes
+// through the querier it is given, so they are committed or rolled back with
+// the sequencer. The row of the key stays locked meanwhile, so concurrent
+// notifications of the same key are applied one at a time: write only updates
+// the table, the S3 calls and the decoding happen before or after it.
+func (ing *ingester) applyInOrder(ctx context.Context, key, sequencer string, write func(q querier) error) (bool, error) {
+	if sequencer == "" {
+		return true, write(db)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT IGNORE INTO %s(object_key, sequencer, updated_at) VALUES( ?, '', UTC_TIMESTAMP() )",
+		sequencerTableName(),
+	), key)
+	if err != nil {
+		return false, err
+	}
+	var applied string
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT sequencer FROM %s WHERE object_key = ? FOR UPDATE",
+		sequencerTableName(),
+	), key).Scan(&applied)
+	if err != nil {
+		return false, err
+	}
+	if ing.superseded(ctx, key, sequencer, applied) {
+		return false, nil
+	}
+
+	if err := write(tx); err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET sequencer = ?, updated_at = UTC_TIMESTAMP() WHERE object_key = ?",
+		sequencerTableName(),
+	), sequencer, key)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// compareSequencers orders two sequencers of the same key. They are
+// hexadecimal strings of varying length, compared once the shorter is
+// right-padded with zeros.
+func compareSequencers(a, b string) int {
+	a, b = strings.ToUpper(a), strings.ToUpper(b)
+	for len(a) < len(b) {
+		a += "0"
+	}
+	for len(b) < len(a) {
+		b += "0"
+	}
+	return strings.Compare(a, b)
+}
+
+// ingestObject validates the object and upserts its row, then stores its
+// rendition. An image appearing for the first time is announced like an
+// upload through the API.
+func (ing *ingester) ingestObject(ctx context.Context, key, sequencer string) error {
+	head, err := ing.s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Name),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		// Removed since, its ObjectRemoved notification follows
+		slog.InfoContext(ctx, "Skipping object that no longer exists", "key", key)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", key, err)
+	}
+	for name, value := range head.Metadata {
+		if strings.EqualFold(name, uploadedByMetadata) && aws.StringValue(value) == uploadedByAPI {
+			return nil
+		}
+	}
+
+	name := strings.TrimPrefix(key, s3Prefix)
+	img := Image{
+		Name:        name,
+		Size:        aws.Int64Value(head.ContentLength),
+		Extension:   getFileExtension(name),
+		ContentType: aws.StringValue(head.ContentType),
+		LastUpdate:  aws.TimeValue(head.LastModified),
+	}
+	if isGenericContentType(img.ContentType) {
+		if img.ContentType, err = ing.sniffContentType(ctx, key); err != nil {
+			return err
+		}
+	}
+	if reason := ing.validate(img); reason != "" {
+		return ing.reject(ctx, key, reason)
+	}
+
+	var action string
+	var stored Image
+	applied, err := ing.applyInOrder(ctx, key, sequencer, func(q querier) error {
+		var err error
+		if action, err = upsertImage(ctx, q, img, false); err != nil || action != "inserted" {
+			return err
+		}
+		stored, err = getImageByName(ctx, q, name)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("storing metadata of %s: %w", key, err)
+	}
+	if !applied {
+		return nil
+	}
+	slog.InfoContext(ctx, "Object ingested", "key", key, "action", action)
+
+	if ing.renditionWidth > 0 {
+		if err := ing.storeRendition(ctx, key, img); err != nil {
+			// The image is still usable without it
+			slog.WarnContext(ctx, "Error creating the rendition", "key", key, "error", err)
+		}
+	}
+	if action == "inserted" {
+		// The row is stored either way, a lost event only means a lost notification
+		if err := publishEventToSQS(ctx, eventImageUploaded, []Image{stored}); err != nil {
+			slog.ErrorContext(ctx, "Error publishing event", "event_type", eventImageUploaded, "error", err)
+		}
+	}
+	return nil
+}
+
+// removeObject deletes the row of a removed object and its rendition. Rows
+// of images deleted through the API are already gone.
+func (ing *ingester) removeObject(ctx context.Context, key, sequencer string) error {
+	// The object may have been written again since
+	_, err := ing.s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Name),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		slog.InfoContext(ctx, "Keeping object written again since", "key", key)
+		return nil
+	}
+	if !isNotFound(err) {
+		return fmt.Errorf("reading %s: %w", key, err)
+	}
+
+	name := strings.TrimPrefix(key, s3Prefix)
+	var existing Image
+	removed := false
+	_, err = ing.applyInOrder(ctx, key, sequencer, func(q querier) error {
+		var err error
+		existing, err = getImageByName(ctx, q, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = q.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE name = ?", dbTableName), name)
+		removed = err == nil
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("deleting metadata of %s: %w", key, err)
+	}
+	if !removed {
+		return nil
+	}
+	slog.InfoContext(ctx, "Object removed", "key", key)
+	if ing.renditionWidth > 0 {
+		_, err := ing.s3Svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s3Name),
+			Key:    aws.String(ing.renditionKey(key)),
+		})
+		if err != nil {
+			slog.WarnContext(ctx, "Error deleting the rendition", "key", key, "error", err)
+		}
+	}
+	if err := publishEventToSQS(ctx, eventImageDeleted, []Image{existing}); err != nil {
+		slog.ErrorContext(ctx, "Error publishing event", "event_type", eventImageDeleted, "error", err)
+	}
+	return nil
+}
+
+// validate returns why img cannot be ingested, or "" when it can.
+func (ing *ingester) validate(img Image) string {
+	switch {
+	case !ing.allowedExtensions[strings.ToLower(img.Extension)]:
+		return fmt.Sprintf("extension '%s' is not allowed", img.Extension)
+	case img.Size == 0:
+		return "the object is empty"
+	case ing.maxSize > 0 && img.Size > ing.maxSize:
+		return fmt.Sprintf("size %d is over the limit of %d bytes", img.Size, ing.maxSize)
+	case !strings.HasPrefix(img.ContentType, "image/"):
+		return fmt.Sprintf("content type '%s' is not an image", img.ContentType)
+	}
+	return ""
+}
+
+// reject leaves the object out of the table, deleting it when configured to.
+func (ing *ingester) reject(ctx context.Context, key, reason string) error {
+	slog.WarnContext(ctx, "Rejecting object", "key", key, "reason", reason)
+	if !ing.deleteRejected {
+		return nil
+	}
+	_, err := ing.s3Svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s3Name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("deleting rejected %s: %w", key, err)
+	}
+	return nil
+}
+
+// isGenericContentType reports whether contentType says nothing of the
+// object, as when the uploader did not set one.
+func isGenericContentType(contentType string) bool {
+	switch contentType {
+	case "", "binary/octet-stream", "application/octet-stream":
+		return true
+	}
+	return false
+}
+
+// sniffContentType detects the content type of the object from its first bytes.
+func (ing *ingester) sniffContentType(ctx context.Context, key string) (string, error) {
+	object, err := ing.s3Svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s3Name),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", sniffLength-1)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", key, err)
+	}
+	defer object.Body.Close()
+	head, err := io.ReadAll(io.LimitReader(object.Body, sniffLength))
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", key, err)
+	}
+	return http.DetectContentType(head), nil
+}
+
+func (ing *ingester) renditionKey(key string) string {
+	return fmt.Sprintf("%s%d/%s", ing.renditionPrefix, ing.renditionWidth, strings.TrimPrefix(key, s3Prefix))
+}
+
+// storeRendition stores a copy of the image scaled down to the rendition
+// width. Images already narrower, formats the standard library cannot decode,
+// and images over the pixel limit are left without one: their dimensions are
+// read from the header first, as a small file may decode to gigabytes.
+func (ing *ingester) storeRendition(ctx context.Context, key string, img Image) error {
+	var encode func(io.Writer, image.Image) error
+	switch img.ContentType {
+	case "image/png", "image/gif":
+		// GIFs lose their animation, a PNG of the first frame is enough
+		encode = png.Encode
+	case "image/jpeg":
+		encode = func(w io.Writer, m image.Image) error {
+			return jpeg.Encode(w, m, &jpeg.Options{Quality: 85})
+		}
+	default:
+		return nil
+	}
+
+	object, err := ing.s3Svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s3Name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+	// The size was validated, the object fits in memory
+	data, err := io.ReadAll(object.Body)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", key, err)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("decoding: %w", err)
+	}
+	if config.Width <= ing.renditionWidth {
+		return nil
+	}
+	if ing.maxPixels > 0 && int64(config.Width)*int64(config.Height) > int64(ing.maxPixels) {
+		slog.WarnContext(ctx, "Skipping the rendition of an image over the pixel limit",
+			"key", key, "width", config.Width, "height", config.Height, "max_pixels", ing.maxPixels)
+		return nil
+	}
+
+	var source image.Image
+	if img.ContentType == "image/gif" {
+		source, err = gif.Decode(bytes.NewReader(data))
+	} else {
+		source, _, err = image.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return fmt.Errorf("decoding: %w", err)
+	}
+
+	var body bytes.Buffer
+	if err := encode(&body, scaleToWidth(source, ing.renditionWidth)); err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+	contentType := img.ContentType
+	if contentType == "image/gif" {
+		contentType = "image/png"
+	}
+	_, err = ing.s3Svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s3Name),
+		Key:         aws.String(ing.renditionKey(key)),
+		ContentType: aws.String(contentType),
+		Body:        bytes.NewReader(body.Bytes()),
+	})
+	return err
+}
+
+// scaleToWidth resizes m to width, keeping its aspect ratio, by nearest
+// neighbour sampling.
+func scaleToWidth(m image.Image, width int) image.Image {
+	bounds := m.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			scaled.Set(x, y, m.At(
+				bounds.Min.X+x*bounds.Dx()/width,
+				bounds.Min.Y+y*bounds.Dy()/height,
+			))
+		}
+	}
+	return scaled
+}
+
+func isNotFound(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	switch awsErr.Code() {
+	case s3.ErrCodeNoSuchKey, "NotFound":
+		return true
+	}
+	return false
+}
+
+// runIngestConsumer applies the S3 notifications of the INGEST_QUEUE_URL
+// queue until ctx is done.
+func runIngestConsumer(ctx context.Context, ingestQueueURL string) {
+	ing := newIngester()
+	consumer := newSQSConsumer(ingestQueueURL, func(ctx context.Context, msg *sqs.Message) error {
+		notification, err := decodeS3Notification([]byte(aws.StringValue(msg.Body)))
+		if err != nil {
+			return err
+		}
+		return ing.handleNotification(ctx, notification)
+	})
+	consumer.run(ctx)
+}
+
+// ingestLambdaEvent is what the ingest function is invoked with: the
+// notification itself when the bucket invokes it, or a batch of messages
+// holding notifications when a queue does.
+type ingestLambdaEvent struct {
+	Records []struct {
+		EventSource string `json:"eventSource"`
+		MessageID   string `json:"messageId"`
+		Body        string `json:"body"`
+	} `json:"Records"`
+}
+
+// sqsBatchResponse reports the messages of a batch to retry. It requires
+// ReportBatchItemFailures on the event source mapping, without it the whole
+// batch is retried when the function fails.
+type sqsBatchResponse struct {
+	BatchItemFailures []sqsBatchItemFailure `json:"batchItemFailures"`
+}
+
+type sqsBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// runIngestLambda serves the ingest function, invoked by the S3
+// notifications of the bucket, like lambda-trigger-S3-creation, or by an SQS
+// event source mapping of a queue they are sent to. Set APP_MODE=ingest-lambda
+// in the environment of the function, built as for runNotifierLambda.
+func runIngestLambda() {
+	ing := newIngester()
+	lambda.Start(func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		ctx = withInvocationRequestID(ctx)
+		var event ingestLambdaEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		if len(event.Records) == 0 || event.Records[0].EventSource != "aws:sqs" {
+			notification, err := decodeS3Notification(payload)
+			if err != nil {
+				return nil, err
+			}
+			// Failing makes Lambda retry the asynchronous invocation
+			return nil, ing.handleNotification(ctx, notification)
+		}
+
+		response := sqsBatchResponse{BatchItemFailures: []sqsBatchItemFailure{}}
+		for _, record := range event.Records {
+			notification, err := decodeS3Notification([]byte(record.Body))
+			if err == nil {
+				err = ing.handleNotification(ctx, notification)
+			}
+			var permanent permanentError
+			if err != nil && !errors.As(err, &permanent) {
+				slog.ErrorContext(ctx, "Error ingesting message", "message_id", record.MessageID, "error", err)
+				response.BatchItemFailures = append(response.BatchItemFailures, sqsBatchItemFailure{record.MessageID})
+			} else if err != nil {
+				// Retrying would not help
+				slog.WarnContext(ctx, "Dropping message", "message_id", record.MessageID, "error", err)
+			}
+		}
+		return response, nil
+	})
+}
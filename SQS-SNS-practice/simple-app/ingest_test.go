@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestCompareSequencers(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want int
+	}{
+		{"equal", "0055AED6DCD90281E5", "0055AED6DCD90281E5", 0},
+		{"older", "0055AED6DCD90281E5", "0055AED6DCD90281E6", -1},
+		{"newer", "0055AED6DCD90281E6", "0055AED6DCD90281E5", 1},
+		{"shorter is padded", "0055AED6DCD9028", "0055AED6DCD90280", 0},
+		{"shorter but newer", "0055AED6DCD9029", "0055AED6DCD90281E5", 1},
+		{"longer but older", "0055AED6DCD90281E5", "0055AED6DCD9029", -1},
+		{"case insensitive", "0055aed6dcd90281e5", "0055AED6DCD90281E5", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareSequencers(tt.a, tt.b); got != tt.want {
+				t.Errorf("compareSequencers(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeS3Notification(t *testing.T) {
+	record := `{"Records":[{"eventSource":"aws:s3","eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"bucket"},"object":{"key":"image/my+cat%282%29.png","sequencer":"0055AED6DCD90281E5"}}}]}`
+	wrapped, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": record})
+	wrappedTest, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": `{"Event":"s3:TestEvent","Bucket":"bucket"}`})
+
+	tests := []struct {
+		name      string
+		body      string
+		wantEvent string
+		wantKey   string
+		wantErr   bool
+	}{
+		{"direct", record, "", "image/my cat(2).png", false},
+		{"wrapped in SNS", string(wrapped), "", "image/my cat(2).png", false},
+		{"test event", `{"Event":"s3:TestEvent","Bucket":"bucket"}`, "s3:TestEvent", "", false},
+		{"wrapped test event", string(wrappedTest), "s3:TestEvent", "", false},
+		{"SNS message not a notification", `{"Type":"Notification","Message":"{\"hello\":\"world\"}"}`, "", "", true},
+		{"not JSON", `not json`, "", "", true},
+		{"other JSON", `{"event_type":"image.uploaded"}`, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notification, err := decodeS3Notification([]byte(tt.body))
+			if tt.wantErr {
+				var permanent permanentError
+				if !errors.As(err, &permanent) {
+					t.Fatalf("error = %v, want a permanent error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if notification.Event != tt.wantEvent {
+				t.Errorf("Event = %q, want %q", notification.Event, tt.wantEvent)
+			}
+			if tt.wantKey == "" {
+				if len(notification.Records) != 0 {
+					t.Errorf("got %d records, want none", len(notification.Records))
+				}
+				return
+			}
+			if len(notification.Records) != 1 {
+				t.Fatalf("got %d records, want 1", len(notification.Records))
+			}
+			key, err := notification.Records[0].objectKey()
+			if err != nil || key != tt.wantKey {
+				t.Errorf("objectKey() = %q, %v, want %q", key, err, tt.wantKey)
+			}
+			if !notification.Records[0].created() {
+				t.Errorf("created() = false for %s", notification.Records[0].EventName)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Deployment modes of the application, chosen at startup with APP_MODE.
+const (
+	// modeServer is the web server on EC2, the default.
+	modeServer = "server"
+	// modeNotifierLambda is the lambda-uploads-batch-notifier function.
+	modeNotifierLambda = "notifier-lambda"
+)
+
+// notifierReceiveWait is how long the notifier function waits for messages
+// before deciding the queue is drained.
+const notifierReceiveWait = 3
+
+// notifierDeadlineMargin is the time left to the function when it stops
+// receiving, to publish and delete what it already received.
+const notifierDeadlineMargin = 5 * time.Second
+
+// lambdaEvent has the fields telling apart the events the notifier function
+// is invoked with: EventBridge schedules and the lambdaTrigger endpoint set
+// detail-type, API Gateway sets resource (REST) or routeKey (HTTP API), and
+// S3 notifications carry Records.
+type lambdaEvent struct {
+	DetailType string          `json:"detail-type"`
+	Resource   string          `json:"resource"`
+	RouteKey   string          `json:"routeKey"`
+	Records    []s3EventRecord `json:"Records"`
+}
+
+func (e lambdaEvent) source() string {
+	switch {
+	case e.DetailType != "":
+		return e.DetailType
+	case e.Resource != "":
+		return e.Resource
+	case e.RouteKey != "":
+		return e.RouteKey
+	case len(e.Records) > 0:
+		return e.Records[0].EventSource
+	}
+	return "null"
+}
+
+// fromAPIGateway reports whether the event is an API Gateway proxy request,
+// which expects a response even when the function fails.
+func (e lambdaEvent) fromAPIGateway() bool {
+	return e.Resource != "" || e.RouteKey != ""
+}
+
+// fromS3 reports whether the event is an S3 notification.
+func (e lambdaEvent) fromS3() bool {
+	return len(e.Records) > 0 && e.Records[0].EventSource == "aws:s3"
+}
+
+// lambdaResponse is the result of the function, shaped as an API Gateway
+// proxy response so it can also be invoked through API Gateway.
+type lambdaResponse struct {
+	StatusCode int               `json:"statusCode"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body"`
+}
+
+// runNotifierLambda serves the lambda-uploads-batch-notifier function: each
+// invocation drains the queue and publishes its events to the topic as
+// digests, the same way the web server does. It reads its configuration
+// like the web server, SQS_QUEUE_URL and SNS_TOPIC_ARN taking over the queue
+// and the topic when set, as for the Python version.
+//
+// Build it for the provided.al2023 runtime with
+//
+//	GOOS=linux GOARCH=amd64 go build -tags lambda.norpc -o bootstrap .
+//
+// and set APP_MODE=notifier-lambda in the environment of the function.
+func runNotifierLambda() {
+	queueURL = getEnv("SQS_QUEUE_URL", queueURL)
+	topicARN = getEnv("SNS_TOPIC_ARN", topicARN)
+	lambda.Start(handleNotifierEvent)
+}
+
+// notifyCommand runs the notifier function once, outside of Lambda: it reads
+// the event from stdin and writes the response to stdout, e.g.
+//
+//	echo '{"detail-type": "Scheduled Event"}' | go run . notify -timeout 30s
+//
+// The local invoker of lambda-practice/simple-app runs the function this way.
+func notifyCommand(args []string) error {
+	flags := flag.NewFlagSet("notify", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 30*time.Second, "time the function has, as its Lambda timeout")
+	flags.Parse(args)
+
+	var event lambdaEvent
+	if err := json.NewDecoder(os.Stdin).Decode(&event); err != nil {
+		return fmt.Errorf("decoding the event: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	response, err := handleNotifierEvent(ctx, event)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(response)
+}
+
+// handleNotifierEvent handles an invocation of the notifier function. The
+// objects of an S3 notification are ingested first, so the events of the
+// ones written by other means than the API are part of the digests. API
+// Gateway gets its errors as a 500 response rather than a failed invocation.
+func handleNotifierEvent(ctx context.Context, event lambdaEvent) (lambdaResponse, error) {
+	ctx = withInvocationRequestID(ctx)
+	requestSource := "Request Resource: " + event.source()
+	slog.InfoContext(ctx, "Notifier invoked", "source", event.source())
+
+	sent, err := notify(ctx, event)
+	if err != nil {
+		if !event.fromAPIGateway() {
+			return lambdaResponse{}, err
+		}
+		slog.ErrorContext(ctx, "Error publishing events to SNS", "error", err)
+		return notifierResponse(http.StatusInternalServerError, map[string]string{"error": err.Error()}), nil
+	}
+	slog.InfoContext(ctx, "Published events to SNS", "events", sent)
+	if event.fromAPIGateway() {
+		return notifierResponse(http.StatusOK, map[string]interface{}{"source": event.source(), "events": sent}), nil
+	}
+	return lambdaResponse{StatusCode: 200, Body: requestSource}, nil
+}
+
+func notify(ctx context.Context, event lambdaEvent) (int, error) {
+	maxEvents := getEnvInt("DIGEST_MAX_EVENTS", 50)
+	if maxEvents < 1 {
+		return 0, errors.New("DIGEST_MAX_EVENTS must be at least 1")
+	}
+	if event.fromS3() {
+		if err := newIngester().handleNotification(ctx, s3Notification{Records: event.Records}); err != nil {
+			return 0, fmt.Errorf("ingesting the objects of the notification: %w", err)
+		}
+	}
+	snsClient := sns.New(awsSession)
+	publish := func(ctx context.Context, d digest) error {
+		return publishDigest(ctx, snsClient, d)
+	}
+	return drainQueueToSNS(ctx, newSQSConsumer(queueURL, storeQueuedEvent), pendingTable{}, publish, maxEvents)
+}
+
+// notifierResponse is the response to an API Gateway request, with body as
+// JSON.
+func notifierResponse(status int, body interface{}) lambdaResponse {
+	encoded, _ := json.Marshal(body)
+	return lambdaResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(encoded),
+	}
+}
+
+// withInvocationRequestID gives ctx the request id of the Lambda invocation
+// it belongs to, so the logs of the invocation can be told apart.
+func withInvocationRequestID(ctx context.Context) context.Context {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		return withRequestID(ctx, lc.AwsRequestID)
+	}
+	return ctx
+}
+
+// nearDeadline reports whether the function is about to time out, and should
+// only finish what it started.
+func nearDeadline(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < notifierDeadlineMargin
+}
+
+// drainQueueToSNS stores the events of the queue with the handler of the
+// consumer, until the queue is empty or the function is about to time out,
+// then publishes the events pending in queue as digests of up to maxEvents,
+// and returns how many it published. The consumer of the web server stores them
+// the same way, so an event received twice, by either, is sent once; and so
+// are the messages that cannot be handled dead-lettered.
+func drainQueueToSNS(ctx context.Context, consumer *sqsConsumer, queue digestQueue, publish func(context.Context, digest) error, maxEvents int) (int, error) {
+	var receiveErr error
+	for !nearDeadline(ctx) {
+		resp, err := consumer.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(consumer.queueURL),
+			MaxNumberOfMessages: aws.Int64(maxReceiveMessages),
+			WaitTimeSeconds:     aws.Int64(notifierReceiveWait),
+			AttributeNames: aws.StringSlice([]string{
+				sqs.MessageSystemAttributeNameApproximateReceiveCount,
+				sqs.MessageSystemAttributeNameSentTimestamp,
+			}),
+			MessageAttributeNames: aws.StringSlice([]string{"All"}),
+		})
+		if err != nil {
+			// Publish what was stored before giving up
+			receiveErr = fmt.Errorf("receiving from SQS: %w", err)
+			break
+		}
+		if len(resp.Messages) == 0 {
+			break
+		}
+		observeReceived(consumer.queueURL, resp.Messages)
+
+		var handled []*sqs.Message
+		for _, msg := range resp.Messages {
+			if consumer.handle(msg) {
+				handled = append(handled, msg)
+			}
+		}
+		consumer.deleteBatch(handled)
+	}
+
+	sent := 0
+	for !nearDeadline(ctx) {
+		n, err := publishDueDigest(ctx, queue, publish, 0, maxEvents)
+		sent += n
+		if err != nil {
+			return sent, errors.Join(receiveErr, err)
+		}
+		if n < maxEvents {
+			break
+		}
+	}
+	return sent, receiveErr
+}
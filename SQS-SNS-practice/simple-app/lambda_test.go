@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// eventMessage is the message publishEventToSQS sends for event, received
+// for the first time.
+func eventMessage(t *testing.T, messageID string, event eventEnvelope) *sqs.Message {
+	t.Helper()
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := queuedMessage(messageID, 1)
+	msg.Body = aws.String(string(body))
+	return msg
+}
+
+func uploadEvent(t *testing.T, name string) eventEnvelope {
+	t.Helper()
+	event, err := newImageEvent(eventImageUploaded, []Image{{Name: name, Extension: getFileExtension(name)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+// storingConsumer is a consumer storing the events of its messages in queue,
+// once per event id like the pending table.
+func storingConsumer(client *fakeSQS, queue *fakeQueue) *sqsConsumer {
+	return testConsumer(client, func(ctx context.Context, msg *sqs.Message) error {
+		event, _, err := decodeEvent(msg)
+		if err != nil {
+			return err
+		}
+		for _, pending := range queue.pending {
+			if pending.event.ID == event.ID {
+				return nil
+			}
+		}
+		queue.pending = append(queue.pending, &fakePending{event: event})
+		return nil
+	})
+}
+
+func TestDrainQueueToSNSPublishesEachEventOnce(t *testing.T) {
+	first, second := uploadEvent(t, "a.png"), uploadEvent(t, "b.png")
+	var messages []*sqs.Message
+	for i := 0; i < 12; i++ {
+		messages = append(messages, eventMessage(t, fmt.Sprint("unique-", i), uploadEvent(t, fmt.Sprintf("%d.png", i))))
+	}
+	// SQS delivers at least once, and the server consumer may have stored
+	// the same events already
+	messages = append(messages, eventMessage(t, "m-1", first), eventMessage(t, "m-2", second), eventMessage(t, "m-1-again", first))
+	client := newFakeSQS(messages...)
+	client.drained = true
+	queue := newFakeQueue()
+	queue.pending = append(queue.pending, &fakePending{event: second})
+
+	var digests []int
+	publish := func(ctx context.Context, d digest) error {
+		digests = append(digests, len(d.Events))
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	sent, err := drainQueueToSNS(ctx, storingConsumer(client, queue), queue, publish, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 14 || len(queue.sent) != 14 {
+		t.Errorf("published %d events (%d sent), want the 14 distinct ones", sent, len(queue.sent))
+	}
+	if fmt.Sprint(digests) != "[5 5 4]" {
+		t.Errorf("digest sizes = %v, want [5 5 4]", digests)
+	}
+	if client.deletedCount() != len(messages) {
+		t.Errorf("deleted %d messages, want all %d", client.deletedCount(), len(messages))
+	}
+}
+
+func TestDrainQueueToSNSDeadLettersInvalidMessages(t *testing.T) {
+	poison := queuedMessage("poison", 1)
+	poison.Body = aws.String(`{"type":"image.renamed","schema_version":1,"id":"e-1"}`)
+	client := newFakeSQS(poison, eventMessage(t, "ok", uploadEvent(t, "a.png")))
+	client.drained = true
+	queue := newFakeQueue()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	sent, err := drainQueueToSNS(ctx, storingConsumer(client, queue), queue, func(context.Context, digest) error { return nil }, 50)
+	if err != nil || sent != 1 {
+		t.Fatalf("drainQueueToSNS() = %d, %v, want the valid event sent", sent, err)
+	}
+	if len(client.sent) != 1 || aws.StringValue(client.sent[0].MessageBody) != aws.StringValue(poison.Body) {
+		t.Errorf("dead-lettered %d messages, want the invalid one", len(client.sent))
+	}
+	if client.deletedCount() != 2 {
+		t.Errorf("deleted %d messages, want both", client.deletedCount())
+	}
+}
+
+func TestDrainQueueToSNSStopsBeforeDeadline(t *testing.T) {
+	client := newFakeSQS(eventMessage(t, "late", uploadEvent(t, "a.png")))
+	queue := newFakeQueue()
+	// Less time left than notifierDeadlineMargin: nothing new is started
+	ctx, cancel := context.WithTimeout(context.Background(), notifierDeadlineMargin/2)
+	defer cancel()
+
+	sent, err := drainQueueToSNS(ctx, storingConsumer(client, queue), queue, func(context.Context, digest) error {
+		t.Error("published a digest past the deadline")
+		return nil
+	}, 50)
+	if err != nil || sent != 0 {
+		t.Errorf("drainQueueToSNS() = %d, %v", sent, err)
+	}
+	if len(client.messages) != 1 {
+		t.Error("received a message past the deadline")
+	}
+}
+
+func TestDrainQueueToSNSReturnsPublishError(t *testing.T) {
+	client := newFakeSQS(eventMessage(t, "m", uploadEvent(t, "a.png")))
+	client.drained = true
+	queue := newFakeQueue()
+	outage := awserr.New("RequestError", "send request failed", errors.New("connection reset"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, err := drainQueueToSNS(ctx, storingConsumer(client, queue), queue, func(context.Context, digest) error { return outage }, 50)
+	if !errors.Is(err, outage) {
+		t.Errorf("err = %v, want %v", err, outage)
+	}
+	// The event stays pending for the next invocation, its message is gone
+	if len(queue.pending) != 1 || client.deletedCount() != 1 {
+		t.Errorf("%d pending, %d deleted, want the event kept and its message deleted", len(queue.pending), client.deletedCount())
+	}
+}
+
+func TestStoreQueuedEvent(t *testing.T) {
+	var pendingIDs []string
+	table := &scriptedDB{exec: func(query string, args []driver.Value) (int64, error) {
+		switch {
+		case strings.Contains(query, feedEventsTableName()):
+			return 0, errors.New("feed table is locked")
+		case strings.Contains(query, pendingTableName()):
+			pendingIDs = append(pendingIDs, args[0].(string))
+		}
+		return 1, nil
+	}}
+	useScriptedDB(t, table)
+	event := uploadEvent(t, "a.png")
+
+	// The live feed is best effort, the event still goes to the digest and the webhooks
+	if err := storeQueuedEvent(context.Background(), eventMessage(t, "m", event)); err != nil {
+		t.Fatal(err)
+	}
+	if len(pendingIDs) != 1 || pendingIDs[0] != event.ID {
+		t.Errorf("pending ids = %v, want %s", pendingIDs, event.ID)
+	}
+	if len(table.ranMatching(webhookDeliveriesTableName())) != 1 {
+		t.Error("no webhook delivery was scheduled")
+	}
+
+	var permanent permanentError
+	if err := storeQueuedEvent(context.Background(), &sqs.Message{Body: aws.String("{")}); !errors.As(err, &permanent) {
+		t.Errorf("invalid body: err = %v, want a permanent error", err)
+	}
+}
+
+func TestLambdaEventSource(t *testing.T) {
+	for body, want := range map[string]struct {
+		source      string
+		s3, gateway bool
+	}{
+		`{"detail-type": "Scheduled Event", "source": "aws.events"}`:                 {"Scheduled Event", false, false},
+		`{"resource": "/notify", "httpMethod": "POST"}`:                              {"/notify", false, true},
+		`{"routeKey": "POST /notify", "version": "2.0"}`:                             {"POST /notify", false, true},
+		`{"Records": [{"eventSource": "aws:s3", "eventName": "ObjectCreated:Put"}]}`: {"aws:s3", true, false},
+		`{"Records": [{"eventSource": "aws:sqs", "body": "{}"}]}`:                    {"aws:sqs", false, false},
+		`{}`: {"null", false, false},
+	} {
+		var event lambdaEvent
+		if err := json.Unmarshal([]byte(body), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.source() != want.source || event.fromS3() != want.s3 || event.fromAPIGateway() != want.gateway {
+			t.Errorf("%s: source %q, S3 %t, API Gateway %t, want %+v", body, event.source(), event.fromS3(), event.fromAPIGateway(), want)
+		}
+	}
+}
+
+func TestHandleNotifierEventFailure(t *testing.T) {
+	t.Setenv("DIGEST_MAX_EVENTS", "0")
+
+	// Schedules fail the invocation, so it is retried and counted as an error
+	if _, err := handleNotifierEvent(context.Background(), lambdaEvent{DetailType: "Scheduled Event"}); err == nil {
+		t.Error("a failed scheduled invocation succeeded")
+	}
+
+	// API Gateway answers the client
+	response, err := handleNotifierEvent(context.Background(), lambdaEvent{RouteKey: "POST /notify"})
+	if err != nil {
+		t.Fatalf("API Gateway invocation failed: %v", err)
+	}
+	var body map[string]string
+	if response.StatusCode != http.StatusInternalServerError || response.Headers["Content-Type"] != "application/json" ||
+		json.Unmarshal([]byte(response.Body), &body) != nil || !strings.Contains(body["error"], "DIGEST_MAX_EVENTS") {
+		t.Errorf("response = %+v, want a JSON 500 with the error", response)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// captureLogs makes the default logger write JSON records to the returned
+// buffer, through contextHandler, until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(&logs, nil)}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &logs
+}
+
+// logRecords decodes the JSON records written to logs.
+func logRecords(t *testing.T, logs *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	decoder := json.NewDecoder(logs)
+	for {
+		var record map[string]interface{}
+		if err := decoder.Decode(&record); err == io.EOF {
+			return records
+		} else if err != nil {
+			t.Fatalf("log record is not JSON: %v", err)
+		}
+		records = append(records, record)
+	}
+}
+
+func TestRequestIDMiddlewareKeepsClientID(t *testing.T) {
+	logs := captureLogs(t)
+	var handlerID string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerID = requestIDFrom(r.Context())
+		slog.InfoContext(r.Context(), "Listing images")
+		io.WriteString(w, "[]")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/images", nil)
+	req.Header.Set(requestIDHeader, "lb-7f3a9c")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if handlerID != "lb-7f3a9c" || rec.Header().Get(requestIDHeader) != "lb-7f3a9c" {
+		t.Errorf("handler saw %q, response carries %q, want the id of the client", handlerID, rec.Header().Get(requestIDHeader))
+	}
+	records := logRecords(t, logs)
+	if len(records) != 2 {
+		t.Fatalf("logged %d records, want the handler's and the access log", len(records))
+	}
+	for _, record := range records {
+		if record["request_id"] != "lb-7f3a9c" {
+			t.Errorf("record %v is missing the request id", record["msg"])
+		}
+	}
+	access := records[1]
+	if access["msg"] != "Request served" || access["status"] != float64(200) || access["bytes"] != float64(2) || access["path"] != "/images" {
+		t.Errorf("access log = %v", access)
+	}
+}
+
+func TestRequestIDMiddlewareReplacesInvalidID(t *testing.T) {
+	captureLogs(t)
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, id := range []string{"", "has spaces", "line\nbreak", strings.Repeat("a", maxRequestIDLength+1)} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(requestIDHeader, id)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		got := rec.Header().Get(requestIDHeader)
+		if got == id || !validRequestID(got) {
+			t.Errorf("client id %q answered with %q, want a new valid id", id, got)
+		}
+	}
+}
+
+func TestRequestIDMiddlewareLogsServerErrorsAsErrors(t *testing.T) {
+	logs := captureLogs(t)
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Error reading metadata from RDS", http.StatusInternalServerError)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/images", nil))
+
+	records := logRecords(t, logs)
+	if len(records) != 1 || records[0]["level"] != "ERROR" || records[0]["status"] != float64(500) {
+		t.Errorf("records = %v, want one ERROR access log", records)
+	}
+}
+
+func TestContextHandlerAddsRequestIDToDerivedLoggers(t *testing.T) {
+	logs := captureLogs(t)
+	ctx := withRequestID(context.Background(), "req-42")
+
+	slog.Default().With("worker", "digest").InfoContext(ctx, "Digest published", "events", 3)
+	slog.Info("No request here")
+
+	records := logRecords(t, logs)
+	if records[0]["request_id"] != "req-42" || records[0]["worker"] != "digest" || records[0]["events"] != float64(3) {
+		t.Errorf("record = %v, want the request id and the logger's attributes", records[0])
+	}
+	if _, ok := records[1]["request_id"]; ok {
+		t.Errorf("record without a request has one: %v", records[1])
+	}
+}
+
+func TestMessageContextCarriesRequestID(t *testing.T) {
+	event := eventEnvelope{ID: "event-1", Type: eventImageUploaded}
+	ctx := withRequestID(context.Background(), "req-from-upload")
+	msg := &sqs.Message{MessageAttributes: eventAttributes(event)}
+	msg.MessageAttributes[requestIDAttribute] = stringAttribute(requestIDFrom(ctx))
+
+	if got := requestIDFrom(messageContext(msg)); got != "req-from-upload" {
+		t.Errorf("consumer logs with request id %q, want the one of the upload", got)
+	}
+	if got := requestIDFrom(messageContext(&sqs.Message{})); got != "" {
+		t.Errorf("message without a request id gave %q", got)
+	}
+}
+
+func TestStatusRecorderFlushes(t *testing.T) {
+	rec := httptest.NewRecorder()
+	recorder := &statusRecorder{ResponseWriter: rec}
+	io.WriteString(recorder, "data: hello\n\n")
+	recorder.Flush()
+
+	if !rec.Flushed || recorder.status != http.StatusOK || recorder.bytes != 13 {
+		t.Errorf("flushed %t, status %d, %d bytes", rec.Flushed, recorder.status, recorder.bytes)
+	}
+	if _, _, err := recorder.Hijack(); err == nil {
+		t.Error("hijacked a response writer that cannot be")
+	}
+}
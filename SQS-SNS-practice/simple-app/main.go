@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -19,14 +23,17 @@ import (
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/ssm"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
 	db          *sql.DB
 	awsSession  *session.Session
 	s3Bucket    string
+	s3Name      string // bucket part of s3Bucket
+	s3Prefix    string // key prefix part of s3Bucket, e.g. "image/"
 	awsRegion   string = "us-east-1"
 	dbUser      string
 	dbPass      string
@@ -40,183 +47,253 @@ var (
 )
 
 type Image struct {
-	Name       string    `db:"name"`
-	LastUpdate time.Time `db:"last_update"`
-	Size       int64     `db:"size"`
-	Extension  string    `db:"extension"`
+	ID          int64     `db:"id"`
+	Name        string    `db:"name"`
+	LastUpdate  time.Time `db:"last_update"`
+	Size        int64     `db:"size"`
+	Extension   string    `db:"extension"`
+	Tags        string    `db:"tags"`
+	Album       string    `db:"album"`
+	ContentType string    `db:"content_type"`
 }
 
 func main() {
+	setupLogging()
+
 	// Initialize a new session using the default AWS configuration.
 	var err error
 	awsSession, err = session.NewSession(&aws.Config{
 		Region: aws.String(awsRegion),
 	})
 	if err != nil {
-		log.Fatal(err)
+		fatal("Error creating the AWS session", "error", err)
+	}
+	instrumentAWSSession(awsSession)
+	traceAWSSession(awsSession)
+
+	mode := getEnv("APP_MODE", modeServer)
+	shutdownTracing, err := setupTracing(mode)
+	if err != nil {
+		fatal("Error setting up tracing", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	switch mode {
+	case modeServer, modeAPILambda, modeIngestLambda, modeNotifierLambda:
+	default:
+		fatal("Unknown APP_MODE", "mode", mode,
+			"expected", []string{modeServer, modeAPILambda, modeNotifierLambda, modeIngestLambda})
 	}
 
 	readEnv()
 
 	DNS := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", dbUser, dbPass, dbHost, dbPort, dbName)
-	db, err = sql.Open("mysql", DNS)
-	if err != nil {
-		log.Fatal(err)
-	}
+	db = openDB(DNS)
 	defer db.Close()
 
+	// Optionally wait for the dependencies before going on, e.g.
+	// WAIT_FOR_DEPENDENCIES=2m while the database is still starting
+	readiness := newReadinessChecker()
+	if wait := getEnvDuration("WAIT_FOR_DEPENDENCIES", 0); wait > 0 {
+		if err := readiness.waitForDependencies(context.Background(), wait); err != nil {
+			fatal("Error waiting for dependencies", "error", err)
+		}
+	}
+
 	createTable()
+	createPendingTable()
+	createSentEventsTable()
+	createWebhookTables()
+	createSequencerTable()
+	createFeedEventsTable()
 
-	// Define routes and their handlers
-	router := mux.NewRouter()
-	router.HandleFunc("/image", getImage).Methods("GET")
-	router.HandleFunc("/image", uploadImage).Methods("POST")
-	router.HandleFunc("/image", deleteImage).Methods("DELETE")
-	router.HandleFunc("/image/metadata", getAllMetadata).Methods("GET")
-	router.HandleFunc("/image/random/metadata", getRandomMetadata).Methods("GET")
-	router.HandleFunc("/notification/subscription", subscribeEmail).Methods("GET")
-	router.HandleFunc("/notification/unsubscription", unsubscription).Methods("GET")
+	renderer, err = newNotificationRenderer(getEnv("NOTIFICATION_LOCALE", defaultLocale))
+	if err != nil {
+		fatal("Error loading the notification templates", "error", err)
+	}
 
-	// Start the background process for sending SQS messages to SNS topic
-	go pollSQSAndSendToSNS(60)
+	// Run a one-off command instead of the web server when one is given
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fatal("Command failed", "command", os.Args[1], "error", err)
+		}
+		return
+	}
 
-	// Start the web server
-	log.Fatal(http.ListenAndServe(":8080", router))
-}
+	if mode == modeIngestLambda {
+		runIngestLambda()
+		return
+	}
+	if mode == modeNotifierLambda {
+		runNotifierLambda()
+		return
+	}
 
-func pollSQSAndSendToSNS(pollIntervalSecs int) {
-	sqsClient := sqs.New(awsSession)
-	snsClient := sns.New(awsSession)
+	router := newRouter()
+	router.Use(tracingMiddleware, requestIDMiddleware, metricsMiddleware)
+	if mode == modeAPILambda {
+		runAPILambda(router)
+		return
+	}
+	// The live feed streams, which API Gateway cannot relay
+	router.HandleFunc("/image/events", streamEvents).Methods("GET")
+	router.HandleFunc("/image/events/ws", streamEventsWebSocket).Methods("GET")
+	// The metrics of this instance, for Prometheus to scrape
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	// The liveness and readiness probes of this instance
+	router.HandleFunc("/healthz", serveLiveness).Methods("GET")
+	router.HandleFunc("/readyz", readiness.serveReadiness).Methods("GET")
 
-	// Set up polling interval
-	pollInterval := time.Duration(pollIntervalSecs) * time.Second
+	// Stop on SIGINT, e.g. Ctrl+C, or SIGTERM, e.g. from ECS or Kubernetes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Loop continuously, polling for messages and sending them to SNS
-	for {
-		// Poll SQS for up to 10 messages at a time
-		resp, err := sqsClient.ReceiveMessage(&sqs.ReceiveMessageInput{
-			QueueUrl:            aws.String(queueURL),
-			MaxNumberOfMessages: aws.Int64(10),
-			WaitTimeSeconds:     aws.Int64(20),
+	// Start the background process for sending SQS messages to SNS topic
+	workers := newWorkerGroup(ctx)
+	workers.start("sqs-consumer", pollSQSAndSendToSNS)
+	workers.start("digest-notifier", runDigestNotifier)
+	workers.start("webhook-dispatcher", runWebhookDispatcher)
+	workers.start("backlog-metrics", runBacklogMetrics)
+	workers.start("feed-relay", runFeedRelay)
+
+	// Optionally ingest the objects written to the bucket by other means, from
+	// the queue its S3 notifications are sent to
+	if ingestQueueURL := getEnv("INGEST_QUEUE_URL", ""); ingestQueueURL != "" {
+		workers.start("ingest-consumer", func(ctx context.Context) {
+			runIngestConsumer(ctx, ingestQueueURL)
 		})
-		if err != nil {
-			log.Printf("Error receiving messages from SQS: %v\n", err)
-			time.Sleep(pollInterval)
-			continue
-		}
+	}
 
-		// If there are no messages, wait and continue
-		if len(resp.Messages) == 0 {
-			time.Sleep(pollInterval)
-			continue
+	// Optionally compare the bucket with the table on a schedule, e.g. RECONCILE_INTERVAL=6h
+	if interval := getEnvDuration("RECONCILE_INTERVAL", 0); interval > 0 {
+		policy := getEnv("RECONCILE_REPAIR", repairNone)
+		if err := validateRepairPolicy(policy); err != nil {
+			fatal("Invalid RECONCILE_REPAIR", "error", err)
 		}
+		workers.start("reconciler", func(ctx context.Context) {
+			runReconciler(ctx, interval, policy)
+		})
+	}
 
-		// Send each message to the SNS topic
-		for _, msg := range resp.Messages {
-			_, err := snsClient.Publish(&sns.PublishInput{
-				Message:  aws.String(*msg.Body),
-				TopicArn: aws.String(topicARN),
-			})
-			if err != nil {
-				log.Printf("Error publishing message to SNS: %v\n", err)
-			} else {
-				log.Printf("Published message to SNS: %s\n", *msg.Body)
-			}
+	// Start the web server. Once it and the workers have stopped, the deferred
+	// calls close the database and flush the spans
+	slog.Info("Web server listening", "addr", ":8080", "mode", mode)
+	if err := serve(ctx, ":8080", router, workers); err != nil {
+		fatal("Web server stopped", "error", err)
+	}
+	slog.Info("Shut down")
+}
 
-			// Delete the message from SQS
-			_, err = sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
-				QueueUrl:      aws.String(queueURL),
-				ReceiptHandle: msg.ReceiptHandle,
-			})
-			if err != nil {
-				log.Printf("Error deleting message from SQS: %v\n", err)
-			} else {
-				log.Printf("Deleted message from SQS: %s\n", *msg.Body)
-			}
+// pollSQSAndSendToSNS collects the events of the queue until ctx is done.
+// They are sent to the SNS topic in digests by runDigestNotifier, so a
+// message is deleted as soon as its event is stored for the next digest.
+func pollSQSAndSendToSNS(ctx context.Context) {
+	consumer := newSQSConsumer(queueURL, func(ctx context.Context, msg *sqs.Message) error {
+		event, _, err := decodeEvent(msg)
+		if err != nil {
+			return err
 		}
+		liveFeed.publish(event)
+		return storeEvent(ctx, event)
+	})
+	consumer.run(ctx)
+}
 
-		// Wait for the polling interval
-		time.Sleep(pollInterval)
+// storeQueuedEvent is the messageHandler storing the event of a message, for
+// the consumers without a live feed of their own.
+func storeQueuedEvent(ctx context.Context, msg *sqs.Message) error {
+	event, _, err := decodeEvent(msg)
+	if err != nil {
+		return err
 	}
+	return storeEvent(ctx, event)
 }
 
-func subscribeEmail(w http.ResponseWriter, r *http.Request) {
-	// Get the email address from the query parameters
-	email := r.URL.Query().Get("email")
-	if email == "" {
-		http.Error(w, "Missing email parameter", http.StatusBadRequest)
-		return
+// storeEvent keeps event for the next digest, the webhooks and the live feed
+// of every instance. Storing the same event twice sends it once.
+func storeEvent(ctx context.Context, event eventEnvelope) error {
+	// The live feed is best effort, it must not hold back the notifications
+	if err := addFeedEvent(ctx, event); err != nil {
+		slog.ErrorContext(ctx, "Error adding event to the live feed", "event_id", event.ID, "error", err)
 	}
-
-	// Create an SNS client
-	snsSvc := sns.New(awsSession)
-
-	// Subscribe the email to the SNS topic
-	subResp, err := snsSvc.Subscribe(&sns.SubscribeInput{
-		Protocol: aws.String("email"),
-		Endpoint: aws.String(email),
-		TopicArn: aws.String(topicARN),
-	})
-	if err != nil {
-		log.Printf("Error subscribing email to topic: %s \n %s", email, err)
-		http.Error(w, "Error subscribing email to topic: "+err.Error(), http.StatusInternalServerError)
-		return
+	if err := addPendingEvent(ctx, event); err != nil {
+		return fmt.Errorf("storing event %s for the next digest: %w", event.ID, err)
 	}
-
-	// Return the subscription ARN as JSON
-	resp := struct {
-		SubscriptionARN string `json:"subscriptionARN"`
-	}{
-		SubscriptionARN: *subResp.SubscriptionArn,
+	slog.InfoContext(ctx, "Event added to the next digest", "event_id", event.ID, "event_type", event.Type)
+	if err := enqueueWebhookDeliveries(ctx, event); err != nil {
+		return fmt.Errorf("scheduling webhook deliveries of event %s: %w", event.ID, err)
 	}
-	json.NewEncoder(w).Encode(resp)
+	return nil
 }
 
-func unsubscription(w http.ResponseWriter, r *http.Request) {
-	// Get the email address from the query parameters
-	email := r.URL.Query().Get("email")
-	if email == "" {
-		http.Error(w, "Missing email parameter", http.StatusBadRequest)
+// newRouter defines the routes of the web API and their handlers.
+func newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/image", getImage).Methods("GET")
+	router.HandleFunc("/image", uploadImage).Methods("POST")
+	router.HandleFunc("/image", deleteImage).Methods("DELETE")
+	router.HandleFunc("/images", uploadImages).Methods("POST")
+	router.HandleFunc("/images", deleteImages).Methods("DELETE")
+	router.HandleFunc("/image/archive", getImageArchive).Methods("GET")
+	router.HandleFunc("/image/metadata", getAllMetadata).Methods("GET")
+	router.HandleFunc("/image/random/metadata", getRandomMetadata).Methods("GET")
+	router.HandleFunc("/notification/preview", previewNotification).Methods("GET")
+	router.HandleFunc("/notification/subscription", subscribeEmail).Methods("POST")
+	router.HandleFunc("/notification/subscription", unsubscription).Methods("DELETE")
+	router.HandleFunc("/notification/unsubscribe", confirmUnsubscription).Methods("GET")
+	router.HandleFunc("/notification/unsubscribe", unsubscribeWithToken).Methods("POST")
+	router.HandleFunc("/notification/subscriptions", listSubscriptions).Methods("GET")
+	router.HandleFunc("/notification/subscriptions", createSubscription).Methods("POST")
+	router.HandleFunc("/notification/subscriptions", unsubscription).Methods("DELETE")
+	router.HandleFunc("/admin/subscriptions", deleteSubscription).Methods("DELETE")
+	router.HandleFunc("/admin/subscriptions/reindex", reindexSubscriptions).Methods("POST")
+	router.HandleFunc("/webhooks", listWebhooks).Methods("GET")
+	router.HandleFunc("/webhooks", createWebhook).Methods("POST")
+	router.HandleFunc("/webhooks/{id}", getWebhookHandler).Methods("GET")
+	router.HandleFunc("/webhooks/{id}", updateWebhook).Methods("PATCH")
+	router.HandleFunc("/webhooks/{id}", deleteWebhook).Methods("DELETE")
+	router.HandleFunc("/webhooks/{id}/deliveries", listWebhookDeliveries).Methods("GET")
+	router.HandleFunc("/webhooks/{id}/deliveries/{deliveryID}", getWebhookDelivery).Methods("GET")
+	router.HandleFunc("/webhooks/{id}/deliveries/{deliveryID}/redeliver", redeliverWebhookDelivery).Methods("POST")
+
+	return router
+}
+
+func subscribeEmail(w http.ResponseWriter, r *http.Request) {
+	// Get the email address from the JSON body
+	var request struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Email == "" {
+		http.Error(w, "Please provide a JSON body such as {\"email\": \"me@example.com\"}", http.StatusBadRequest)
 		return
 	}
+	email := request.Email
 
 	// Create an SNS client
 	snsSvc := sns.New(awsSession)
 
-	// List the subscriptions for the topic to find the subscription ARN for the email
-	listResp, err := snsSvc.ListSubscriptionsByTopic(&sns.ListSubscriptionsByTopicInput{
-		TopicArn: aws.String(topicARN),
+	// Subscribe the email to the SNS topic, to its own copy of the digests
+	policy := filterPolicy(subscriptionRequest{Protocol: "email", Endpoint: email})
+	subResp, err := snsSvc.SubscribeWithContext(r.Context(), &sns.SubscribeInput{
+		Protocol:   aws.String("email"),
+		Endpoint:   aws.String(email),
+		TopicArn:   aws.String(topicARN),
+		Attributes: map[string]*string{"FilterPolicy": aws.String(policy)},
 	})
 	if err != nil {
-		http.Error(w, "Error listing subscriptions for topic: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	var subARN string
-	for _, sub := range listResp.Subscriptions {
-		if *sub.Protocol == "email" && *sub.Endpoint == email {
-			subARN = *sub.SubscriptionArn
-			break
-		}
-	}
-	if subARN == "" {
-		http.Error(w, "Email is not subscribed to the topic", http.StatusBadRequest)
-		return
-	}
-
-	// Unsubscribe the email from the SNS topic
-	_, err = snsSvc.Unsubscribe(&sns.UnsubscribeInput{
-		SubscriptionArn: aws.String(subARN),
-	})
-	if err != nil {
-		http.Error(w, "Error unsubscribing email from topic: "+err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error subscribing email to topic", "email", email, "error", err)
+		http.Error(w, "Error subscribing email to topic: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	subscriptionIndex.set("email", email, aws.StringValue(subResp.SubscriptionArn))
 
-	// Return success message as JSON
+	// Return the subscription ARN as JSON, the unsubscribe link comes with
+	// every digest
 	resp := struct {
-		Message string `json:"message"`
+		SubscriptionARN string `json:"subscriptionARN"`
 	}{
-		Message: "Email unsubscribed successfully",
+		SubscriptionARN: *subResp.SubscriptionArn,
 	}
 	json.NewEncoder(w).Encode(resp)
 }
@@ -230,12 +307,12 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create an S3 client and get the Image
-	file, err := s3.New(awsSession).GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(s3Bucket),
-		Key:    aws.String(name),
+	file, err := s3.New(awsSession).GetObjectWithContext(r.Context(), &s3.GetObjectInput{
+		Bucket: aws.String(s3Name),
+		Key:    aws.String(objectKey(name)),
 	})
 	if err != nil {
-		log.Println(err)
+		slog.ErrorContext(r.Context(), "Error downloading image from S3", "name", name, "error", err)
 		http.Error(w, "Error downloading image", http.StatusInternalServerError)
 		return
 	}
@@ -253,65 +330,57 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", aws.StringValue(file.ContentType))
 	w.Header().Set("Content-Length", strconv.FormatInt(aws.Int64Value(file.ContentLength), 10))
 
-	log.Printf("File '%s' downloaded...", filename)
+	slog.InfoContext(r.Context(), "Image downloaded", "name", name, "filename", filename,
+		"size", aws.Int64Value(file.ContentLength))
 	if _, err := io.Copy(w, file.Body); err != nil {
-		log.Println(err)
+		slog.ErrorContext(r.Context(), "Error sending image", "name", name, "error", err)
 	}
 }
 
 func uploadImage(w http.ResponseWriter, r *http.Request) {
 	imageFile, handler, err := r.FormFile("image")
 	if err != nil {
-		log.Println(err)
+		slog.WarnContext(r.Context(), "Invalid image upload", "error", err)
 		http.Error(w, "Error uploading image", http.StatusBadRequest)
 		return
 	}
 	defer imageFile.Close()
 
 	uploader := s3manager.NewUploader(awsSession)
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(s3Bucket),
-		Key:    aws.String(handler.Filename),
-		Body:   imageFile,
+	_, err = uploader.UploadWithContext(r.Context(), &s3manager.UploadInput{
+		Bucket:   aws.String(s3Name),
+		Key:      aws.String(objectKey(handler.Filename)),
+		Body:     imageFile,
+		Metadata: apiUploadMetadata(),
 	})
 	if err != nil {
-		log.Println(err)
+		slog.ErrorContext(r.Context(), "Error uploading image to S3", "name", handler.Filename, "error", err)
 		http.Error(w, "Error uploading image to S3", http.StatusInternalServerError)
 		return
 	}
 
 	image := Image{
-		Name:       handler.Filename,
-		Size:       handler.Size,
-		Extension:  getFileExtension(handler.Filename),
-		LastUpdate: time.Now(),
-	}
-	_, err = insertImage(image)
+		Name:        handler.Filename,
+		Size:        handler.Size,
+		Extension:   getFileExtension(handler.Filename),
+		Tags:        normalizeTags(r.FormValue("tags")),
+		Album:       r.FormValue("album"),
+		ContentType: handler.Header.Get("Content-Type"),
+		LastUpdate:  time.Now(),
+	}
+	_, err = insertImage(r.Context(), db, image)
 	if err != nil {
-		log.Println(err)
+		slog.ErrorContext(r.Context(), "Error inserting metadata into RDS", "name", image.Name, "error", err)
 		http.Error(w, "Error inserting metadata into RDS", http.StatusInternalServerError)
 		return
 	}
+	slog.InfoContext(r.Context(), "Image uploaded", "name", image.Name, "size", image.Size, "content_type", image.ContentType)
 
-	publishEventToSQS(image)
-	fmt.Fprintf(w, "Image uploaded successfully")
-}
-
-func publishEventToSQS(image Image) {
-	// Create a new SQS service client
-	svc := sqs.New(awsSession)
-
-	bodyMessage, _ := json.MarshalIndent(image, "", "  ")
-
-	// Send a message to the SQS queue
-	_, err := svc.SendMessage(&sqs.SendMessageInput{
-		MessageBody: aws.String(string(bodyMessage)),
-		QueueUrl:    aws.String(queueURL),
-	})
-	if err != nil {
-		log.Fatalf("The image fail to load to SQS \n %s", bodyMessage)
+	// The image is stored either way, a lost event only means a lost notification
+	if err := publishEventToSQS(r.Context(), eventImageUploaded, []Image{image}); err != nil {
+		slog.ErrorContext(r.Context(), "Error publishing event", "event_type", eventImageUploaded, "error", err)
 	}
-	log.Printf("Image loaded to SQS successfully \n %s", bodyMessage)
+	fmt.Fprintf(w, "Image uploaded successfully")
 }
 
 func deleteImage(w http.ResponseWriter, r *http.Request) {
@@ -322,47 +391,57 @@ func deleteImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Keep the metadata for the event, it is gone once the row is deleted
+	image, err := getImageByName(r.Context(), db, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		image = Image{Name: name, Extension: getFileExtension(name)}
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading metadata from RDS", "name", name, "error", err)
+		http.Error(w, "Error reading metadata from RDS", http.StatusInternalServerError)
+		return
+	}
+
 	// Create an S3 client
 	s3Svc := s3.New(awsSession)
 
 	// Delete image from S3
-	_, err := s3Svc.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(s3Bucket),
-		Key:    aws.String(name),
+	_, err = s3Svc.DeleteObjectWithContext(r.Context(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s3Name),
+		Key:    aws.String(objectKey(name)),
 	})
 	if err != nil {
-		log.Println(err)
+		slog.ErrorContext(r.Context(), "Error deleting image from S3", "name", name, "error", err)
 		http.Error(w, "Error deleting image from S3", http.StatusInternalServerError)
 		return
 	}
 
 	// Delete metadata from RDS
-	_, err = deleteImageByName(name)
+	_, err = deleteImageByName(r.Context(), name)
 	if err != nil {
-		log.Println(err)
+		slog.ErrorContext(r.Context(), "Error deleting metadata from RDS", "name", name, "error", err)
 		http.Error(w, "Error deleting metadata from RDS", http.StatusInternalServerError)
 		return
 	}
+	slog.InfoContext(r.Context(), "Image deleted", "name", name)
 
+	if err := publishEventToSQS(r.Context(), eventImageDeleted, []Image{image}); err != nil {
+		slog.ErrorContext(r.Context(), "Error publishing event", "event_type", eventImageDeleted, "error", err)
+	}
 	fmt.Fprintf(w, "Image '%s' deleted successfully", name)
 }
 
 func getAllMetadata(w http.ResponseWriter, r *http.Request) {
-	images, _ := getAllImages()
-	logImages(images)
+	images, _ := getAllImages(r.Context())
+	logImages(r.Context(), images)
 
 	// Write the Image list as a JSON response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(images)
 }
 
-func getRandomMetadata(w http.ResponseWriter, r *http.Request) {
-	image, _ := getRandomImage()
-	logImages([]Image{image})
-
-	// Write the Image as a JSON response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(image)
+// objectKey returns the S3 key under which the image with the given name is stored.
+func objectKey(name string) string {
+	return s3Prefix + name
 }
 
 func getFileExtension(filename string) string {
@@ -370,6 +449,22 @@ func getFileExtension(filename string) string {
 	return parts[len(parts)-1]
 }
 
+// normalizeTags turns a comma-separated tag list into the lower-case,
+// de-duplicated form stored in the tags column, so that FIND_IN_SET matches.
+func normalizeTags(tags string) string {
+	var normalized []string
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return strings.Join(normalized, ",")
+}
+
 func createTable() error {
 	// Create the table if it doesn't exist
 	_, err := db.Exec(fmt.Sprintf(`
@@ -378,51 +473,94 @@ func createTable() error {
 			name VARCHAR(255) NOT NULL,
 			size INT NOT NULL,
 			extension VARCHAR(255) NOT NULL,
+			tags VARCHAR(255) NOT NULL DEFAULT '',
+			album VARCHAR(255) NOT NULL DEFAULT '',
+			content_type VARCHAR(255) NOT NULL DEFAULT '',
 			last_update DATETIME NOT NULL,
 			PRIMARY KEY (id)
 		)`, dbTableName))
 	if err != nil {
 		panic(err.Error())
 	}
-	log.Printf("Table '%s' created or already exists.\n", dbTableName)
+	slog.Info("Table created or already exists", "table", dbTableName)
+
+	// Tables created before a column was introduced need it added explicitly
+	if err = addColumnIfMissing(dbTableName, "tags", "VARCHAR(255) NOT NULL DEFAULT ''"); err != nil {
+		panic(err.Error())
+	}
+	if err = addColumnIfMissing(dbTableName, "album", "VARCHAR(255) NOT NULL DEFAULT ''"); err != nil {
+		panic(err.Error())
+	}
+	if err = addColumnIfMissing(dbTableName, "content_type", "VARCHAR(255) NOT NULL DEFAULT ''"); err != nil {
+		panic(err.Error())
+	}
 	return err
 }
 
-func insertImage(image Image) (int64, error) {
-	stmt, err := db.Prepare(fmt.Sprintf(
-		"INSERT INTO %s(name, size, extension, last_update) VALUES( ?, ?, ?, ? )",
+func addColumnIfMissing(table, column, definition string) error {
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1060 { // ER_DUP_FIELDNAME
+		return nil
+	}
+	if err == nil {
+		slog.Info("Column added", "table", table, "column", column)
+	}
+	return err
+}
+
+// widenTextColumn changes column of table to definition if it is still a
+// TEXT column, limited to 64KB.
+func widenTextColumn(table, column, definition string) error {
+	var dataType string
+	err := db.QueryRow(
+		"SELECT DATA_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		table, column,
+	).Scan(&dataType)
+	if err != nil || !strings.EqualFold(dataType, "text") {
+		return err
+	}
+	if _, err = db.Exec(fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s", table, column, definition)); err != nil {
+		return err
+	}
+	slog.Info("Column widened", "table", table, "column", column)
+	return nil
+}
+
+func insertImage(ctx context.Context, q querier, image Image) (int64, error) {
+	stmt, err := q.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s(name, size, extension, tags, album, content_type, last_update) VALUES( ?, ?, ?, ?, ?, ?, ? )",
 		dbTableName,
 	))
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 	defer stmt.Close() // Prepared statements take up server resources and should be closed after use.
 
-	result, err := stmt.Exec(image.Name, image.Size, image.Extension, image.LastUpdate)
+	result, err := stmt.ExecContext(ctx, image.Name, image.Size, image.Extension, image.Tags, image.Album, image.ContentType, image.LastUpdate)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 	// Get the new album's generated ID for the client.
 	id, err := result.LastInsertId()
 	if err != nil {
-		log.Fatalf("AddAlbum: %v", err)
 		return 0, err
 	}
 	// Return the new album's ID.
 	return id, nil
 }
 
-func getAllImages() ([]Image, error) {
-	stmt, err := db.Prepare(fmt.Sprintf(
-		"SELECT name, size, extension, last_update FROM %s",
-		dbTableName,
+func getAllImages(ctx context.Context) ([]Image, error) {
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s",
+		imageColumns, dbTableName,
 	))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close() // Prepared statements take up server resources and should be closed after use.
 
-	rows, err := stmt.Query()
+	rows, err := stmt.QueryContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -430,17 +568,10 @@ func getAllImages() ([]Image, error) {
 
 	var images []Image
 	for rows.Next() {
-		var image Image
-		var lastUpdateStr string
-		if err := rows.Scan(
-			&image.Name,
-			&image.Size,
-			&image.Extension,
-			&lastUpdateStr,
-		); err != nil {
-			log.Fatal(err)
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, err
 		}
-		image.LastUpdate, _ = time.Parse(timeLayout, lastUpdateStr)
 		images = append(images, image)
 	}
 
@@ -450,70 +581,220 @@ func getAllImages() ([]Image, error) {
 	return images, nil
 }
 
-func getRandomImage() (Image, error) {
-	stmt, err := db.Prepare(fmt.Sprintf(
-		"SELECT name, size, extension, last_update FROM %s ORDER BY RAND() LIMIT 1",
-		dbTableName,
-	))
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer stmt.Close() // Prepared statements take up server resources and should be closed after use.
+// imageColumns lists the columns read by scanImage, in scan order.
+const imageColumns = "id, name, size, extension, tags, album, content_type, last_update"
 
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// querier runs statements on the database, or in a transaction of it.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func scanImage(row rowScanner) (Image, error) {
 	var image Image
 	var lastUpdateStr string
 
-	err = stmt.QueryRow().Scan(
+	err := row.Scan(
+		&image.ID,
 		&image.Name,
 		&image.Size,
 		&image.Extension,
+		&image.Tags,
+		&image.Album,
+		&image.ContentType,
 		&lastUpdateStr,
 	)
-	image.LastUpdate, _ = time.Parse(timeLayout, lastUpdateStr)
 	if err != nil {
 		return image, err
 	}
+	image.LastUpdate, _ = time.Parse(timeLayout, lastUpdateStr)
 	return image, nil
 }
 
-func deleteImageByName(name string) (int64, error) {
-	stmt, err := db.Prepare(fmt.Sprintf(
+// getImagesByIDs returns the images with the given ids, keyed by id.
+func getImagesByIDs(ctx context.Context, ids []int64) (map[int64]Image, error) {
+	images := map[int64]Image{}
+	if len(ids) == 0 {
+		return images, nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE id IN (?%s)",
+		imageColumns, dbTableName, strings.Repeat(", ?", len(ids)-1),
+	), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images[image.ID] = image
+	}
+	return images, rows.Err()
+}
+
+// imageFilter narrows the set of images a query may return. Empty fields
+// are ignored.
+type imageFilter struct {
+	Names     []string
+	Extension string
+	Tag       string
+	Album     string
+	From      time.Time
+	To        time.Time
+}
+
+// where returns the filter as SQL conditions, each prefixed with AND, and
+// the arguments for their placeholders.
+func (f imageFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if f.Extension != "" {
+		conditions = append(conditions, " AND extension = ?")
+		args = append(args, f.Extension)
+	}
+	if f.Tag != "" {
+		conditions = append(conditions, " AND FIND_IN_SET(?, tags) > 0")
+		args = append(args, f.Tag)
+	}
+	if f.Album != "" {
+		conditions = append(conditions, " AND album = ?")
+		args = append(args, f.Album)
+	}
+	if len(f.Names) > 0 {
+		conditions = append(conditions, " AND name IN (?"+strings.Repeat(", ?", len(f.Names)-1)+")")
+		for _, name := range f.Names {
+			args = append(args, name)
+		}
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, " AND last_update >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, " AND last_update < ?")
+		args = append(args, f.To)
+	}
+	return strings.Join(conditions, ""), args
+}
+
+// getImagesByFilter returns every image matching filter, ordered by id.
+func getImagesByFilter(ctx context.Context, filter imageFilter) ([]Image, error) {
+	conditions, args := filter.where()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE 1 = 1%s ORDER BY id",
+		imageColumns, dbTableName, conditions,
+	), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []Image
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// getImageByName returns the image with the given name, or sql.ErrNoRows.
+func getImageByName(ctx context.Context, q querier, name string) (Image, error) {
+	return scanImage(q.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE name = ? ORDER BY id LIMIT 1",
+		imageColumns, dbTableName,
+	), name))
+}
+
+// upsertImage inserts the image, or refreshes the size, type and date of the
+// row with the same name when they differ. It reports which of "inserted",
+// "updated" or "unchanged" applied; with dryRun nothing is written.
+func upsertImage(ctx context.Context, q querier, image Image, dryRun bool) (string, error) {
+	existing, err := getImageByName(ctx, q, image.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		if !dryRun {
+			if _, err := insertImage(ctx, q, image); err != nil {
+				return "", err
+			}
+		}
+		return "inserted", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if existing.Size == image.Size &&
+		existing.ContentType == image.ContentType &&
+		existing.LastUpdate.Equal(image.LastUpdate.UTC().Truncate(time.Second)) {
+		return "unchanged", nil
+	}
+	if !dryRun {
+		_, err = q.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE %s SET size = ?, extension = ?, content_type = ?, last_update = ? WHERE id = ?",
+			dbTableName,
+		), image.Size, image.Extension, image.ContentType, image.LastUpdate, existing.ID)
+		if err != nil {
+			return "", err
+		}
+	}
+	return "updated", nil
+}
+
+func deleteImageByName(ctx context.Context, name string) (int64, error) {
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
 		"DELETE FROM %s WHERE name=?",
 		dbTableName,
 	))
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 	defer stmt.Close() // Prepared statements take up server resources and should be closed after use.
 
-	result, err := stmt.Exec(name)
+	result, err := stmt.ExecContext(ctx, name)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 	// Get the new album's generated ID for the client.
 	numRowsDeleted, err := result.RowsAffected()
 	if err != nil {
-		log.Fatalf("AddAlbum: %v", err)
 		return 0, err
 	}
 	// Return the new album's ID.
 	return numRowsDeleted, nil
 }
 
-func logImages(images []Image) {
+func logImages(ctx context.Context, images []Image) {
 	for _, image := range images {
-		log.Printf(
-			"Name: %d, Size: %d, Extension: %s, Last Update: %s",
-			image.Name,
-			image.Size,
-			image.Extension,
-			image.LastUpdate,
+		slog.InfoContext(ctx, "Image metadata",
+			"name", image.Name,
+			"size", image.Size,
+			"extension", image.Extension,
+			"last_update", image.LastUpdate,
 		)
 	}
 }
 
 func readEnv() {
 	s3Bucket = getParameter("s3Bucket")
+	// The parameter may carry a key prefix after the bucket name, e.g. "my-bucket/image/"
+	s3Name, s3Prefix, _ = strings.Cut(s3Bucket, "/")
 	dbUser = getParameter("dbUser")
 	dbPass = getParameter("dbPass")
 	dbHost = getParameter("dbHost")
@@ -533,10 +814,44 @@ func getParameter(paramName string) string {
 		WithDecryption: aws.Bool(false),
 	})
 	if err != nil || paramOutput == nil {
-		fmt.Fprintf(os.Stderr, "failed to retrieve parameter value: %v", err)
-		os.Exit(1)
+		fatal("Failed to retrieve parameter value", "parameter", paramName, "error", err)
 	}
 	value := *paramOutput.Parameter.Value
-	log.Println(paramName, value)
+	// Values are left out, some of them are secrets
+	slog.Info("Parameter read", "parameter", paramName)
 	return value
 }
+
+// getEnv returns the value of the environment variable key, or fallback when
+// it is not set. Optional settings are read from the environment so the
+// instance does not need a Parameter Store entry for each of them.
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		fatal("Setting must be a number", "key", key, "error", err)
+	}
+	return number
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		fatal("Setting must be a duration such as 30s or 5m", "key", key, "error", err)
+	}
+	return duration
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsNamespace prefixes the names of the metrics of the application.
+const metricsNamespace = "simple_app"
+
+// Outcomes of the operations counted by the metrics.
+const (
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests, by route template and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	awsRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "aws_requests_total",
+		Help:      "AWS API calls, by service, operation and outcome, retries included.",
+	}, []string{"service", "operation", "outcome"})
+	awsRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "aws_request_duration_seconds",
+		Help:      "Time taken by AWS API calls, by service and operation, retries included.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service", "operation"})
+	s3TransferBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_transfer_bytes_total",
+		Help:      "Bytes of objects uploaded to and downloaded from S3, by direction.",
+	}, []string{"direction"})
+
+	sqlQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sql_queries_total",
+		Help:      "SQL statements run, by operation (SELECT, INSERT, COMMIT...) and outcome.",
+	}, []string{"operation", "outcome"})
+	sqlQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sql_query_duration_seconds",
+		Help:      "Time taken by SQL statements, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	sqsMessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sqs_messages_received_total",
+		Help:      "SQS messages received, by queue.",
+	}, []string{"queue"})
+	sqsMessagesHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sqs_messages_handled_total",
+		Help:      "SQS messages received and handled, by queue and outcome: success, retried or dead_lettered.",
+	}, []string{"queue", "outcome"})
+	sqsMessageAge = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sqs_message_age_seconds",
+		Help:      "Time SQS messages waited in their queue before being received, by queue.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10),
+	}, []string{"queue"})
+	sqsMessagesPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sqs_messages_published_total",
+		Help:      "Image events sent to the queue, by event type and outcome.",
+	}, []string{"event_type", "outcome"})
+	snsDigestsPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sns_digests_published_total",
+		Help:      "Digests published to the topic, by outcome.",
+	}, []string{"outcome"})
+	webhookDeliveryAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_delivery_attempts_total",
+		Help:      "Webhook delivery attempts, by outcome.",
+	}, []string{"outcome"})
+
+	backlogSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "backlog_size",
+		Help:      "Work waiting in the database: pending_notifications for the next digest, webhook_deliveries still to be delivered.",
+	}, []string{"backlog"})
+	sqsQueueMessages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "sqs_queue_messages",
+		Help:      "Approximate number of messages in the queues, by queue and state: visible, in_flight or delayed.",
+	}, []string{"queue", "state"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequests, httpRequestDuration,
+		awsRequests, awsRequestDuration, s3TransferBytes,
+		sqlQueries, sqlQueryDuration,
+		sqsMessagesReceived, sqsMessagesHandled, sqsMessageAge, sqsMessagesPublished,
+		snsDigestsPublished, webhookDeliveryAttempts,
+		backlogSize, sqsQueueMessages,
+	)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return outcomeError
+	}
+	return outcomeSuccess
+}
+
+// metricsMiddleware counts and times the requests by the template of their
+// route, e.g. /webhooks/{id}, so the ids in paths do not make a series each.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		recorder := &statusRecorder{ResponseWriter: w}
+		started := time.Now()
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(started).Seconds())
+	})
+}
+
+// routeTemplate is the template of the route r matched, or "unknown".
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unknown"
+}
+
+// instrumentAWSSession measures every call made by the clients created from
+// sess, and the bytes of the objects they transfer to and from S3.
+func instrumentAWSSession(sess *session.Session) {
+	sess.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "simple-app.metrics",
+		Fn:   observeAWSRequest,
+	})
+}
+
+func observeAWSRequest(r *request.Request) {
+	service, operation := r.ClientInfo.ServiceName, "unknown"
+	if r.Operation != nil {
+		operation = r.Operation.Name
+	}
+	awsRequests.WithLabelValues(service, operation, outcome(r.Error)).Inc()
+	awsRequestDuration.WithLabelValues(service, operation).Observe(time.Since(r.Time).Seconds())
+	if r.Error != nil || service != "s3" {
+		return
+	}
+	switch operation {
+	case "PutObject", "UploadPart":
+		if r.HTTPRequest != nil && r.HTTPRequest.ContentLength > 0 {
+			s3TransferBytes.WithLabelValues("upload").Add(float64(r.HTTPRequest.ContentLength))
+		}
+	case "GetObject":
+		if r.HTTPResponse != nil && r.HTTPResponse.ContentLength > 0 {
+			s3TransferBytes.WithLabelValues("download").Add(float64(r.HTTPResponse.ContentLength))
+		}
+	}
+}
+
+// observeSQL starts measuring and tracing a statement sent to the database
+// for ctx, and returns the function to call with its error once it is done.
+func observeSQL(ctx context.Context, query string) func(error) {
+	operation := sqlOperation(query)
+	span := startSQLSpan(ctx, query)
+	started := time.Now()
+	return func(err error) {
+		endSpan(span, err)
+		sqlQueries.WithLabelValues(operation, outcome(err)).Inc()
+		sqlQueryDuration.WithLabelValues(operation).Observe(time.Since(started).Seconds())
+	}
+}
+
+// sqlOperation is the first keyword of query, e.g. SELECT.
+func sqlOperation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// queueName is the name of a queue, the last part of its URL, to label its
+// metrics with.
+func queueName(queueURL string) string {
+	return path.Base(queueURL)
+}
+
+// observeReceived counts the messages received from queueURL and how long
+// they waited in it.
+func observeReceived(queueURL string, messages []*sqs.Message) {
+	queue := queueName(queueURL)
+	sqsMessagesReceived.WithLabelValues(queue).Add(float64(len(messages)))
+	for _, msg := range messages {
+		sent, err := strconv.ParseInt(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64)
+		if err == nil {
+			sqsMessageAge.WithLabelValues(queue).Observe(time.Since(time.UnixMilli(sent)).Seconds())
+		}
+	}
+}
+
+// runBacklogMetrics refreshes the backlog gauges every METRICS_BACKLOG_INTERVAL
+// (default 30s) until ctx is done, rather than on each scrape, so scrapes do
+// not load the database and the queues.
+func runBacklogMetrics(ctx context.Context) {
+	interval := getEnvDuration("METRICS_BACKLOG_INTERVAL", 30*time.Second)
+	queues := []string{queueURL}
+	for _, key := range []string{"SQS_DLQ_URL", "INGEST_QUEUE_URL"} {
+		if url := getEnv(key, ""); url != "" {
+			queues = append(queues, url)
+		}
+	}
+	client := sqs.New(awsSession)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for backlog, table := range map[string]string{
+			"pending_notifications": pendingTableName(),
+			"webhook_deliveries":    webhookDeliveriesTableName(),
+		} {
+			var size int64
+			query := fmt.Sprintf("SELECT COUNT(*) FROM %s", table)
+			if backlog == "webhook_deliveries" {
+				query += fmt.Sprintf(" WHERE status = '%s'", deliveryPending)
+			}
+			if err := db.QueryRowContext(ctx, query).Scan(&size); err != nil {
+				slog.WarnContext(ctx, "Error measuring backlog", "backlog", backlog, "error", err)
+				continue
+			}
+			backlogSize.WithLabelValues(backlog).Set(float64(size))
+		}
+		for _, url := range queues {
+			if err := updateQueueMetrics(ctx, client, url); err != nil && ctx.Err() == nil {
+				slog.WarnContext(ctx, "Error measuring queue", "queue_url", url, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func updateQueueMetrics(ctx context.Context, client sqsiface.SQSAPI, url string) error {
+	states := map[string]string{
+		sqs.QueueAttributeNameApproximateNumberOfMessages:           "visible",
+		sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: "in_flight",
+		sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed:    "delayed",
+	}
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	resp, err := client.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(url),
+		AttributeNames: aws.StringSlice(names),
+	})
+	if err != nil {
+		return err
+	}
+	for name, state := range states {
+		count, err := strconv.ParseFloat(aws.StringValue(resp.Attributes[name]), 64)
+		if err != nil {
+			continue
+		}
+		sqsQueueMessages.WithLabelValues(queueName(url), state).Set(count)
+	}
+	return nil
+}
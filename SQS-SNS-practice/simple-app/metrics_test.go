@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The metrics are global and other tests add to them, so the tests compare
+// them before and after.
+
+func counterDelta(t *testing.T, counter prometheus.Counter, action func()) float64 {
+	t.Helper()
+	before := testutil.ToFloat64(counter)
+	action()
+	return testutil.ToFloat64(counter) - before
+}
+
+// observations returns how many values the histogram of the labels has.
+func observations(t *testing.T, histogram *prometheus.HistogramVec, labels ...string) uint64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := histogram.WithLabelValues(labels...).(prometheus.Histogram).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestMetricsMiddlewareLabelsRequestsByRouteTemplate(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(metricsMiddleware)
+	router.HandleFunc("/webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+	router.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+
+	deleted := httpRequests.WithLabelValues("/webhooks/{id}", "DELETE", "204")
+	timed := observations(t, httpRequestDuration, "/webhooks/{id}", "DELETE")
+	if got := counterDelta(t, deleted, func() {
+		for _, id := range []string{"1", "2", "3"} {
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/webhooks/"+id, nil))
+		}
+	}); got != 3 {
+		t.Errorf("counted %v deletions under the route template, want 3", got)
+	}
+	if got := observations(t, httpRequestDuration, "/webhooks/{id}", "DELETE") - timed; got != 3 {
+		t.Errorf("timed %d deletions, want 3", got)
+	}
+
+	// A handler writing nothing answers 200
+	healthy := httpRequests.WithLabelValues("/healthz", "GET", "200")
+	if got := counterDelta(t, healthy, func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	}); got != 1 {
+		t.Errorf("counted %v probes with status 200, want 1", got)
+	}
+}
+
+func TestRouteTemplateOutsideRouter(t *testing.T) {
+	if got := routeTemplate(httptest.NewRequest(http.MethodGet, "/image", nil)); got != "unknown" {
+		t.Errorf("routeTemplate() = %q, want unknown", got)
+	}
+}
+
+func TestObserveAWSRequest(t *testing.T) {
+	awsCall := func(service, operation string, err error) *request.Request {
+		return &request.Request{
+			ClientInfo:   metadata.ClientInfo{ServiceName: service},
+			Operation:    &request.Operation{Name: operation},
+			Time:         time.Now().Add(-time.Second),
+			HTTPRequest:  &http.Request{ContentLength: 2048},
+			HTTPResponse: &http.Response{ContentLength: 512},
+			Error:        err,
+		}
+	}
+	uploaded := s3TransferBytes.WithLabelValues("upload")
+	downloaded := s3TransferBytes.WithLabelValues("download")
+
+	t.Run("upload counts the bytes sent", func(t *testing.T) {
+		calls := awsRequests.WithLabelValues("s3", "PutObject", outcomeSuccess)
+		bytes := counterDelta(t, uploaded, func() {
+			if got := counterDelta(t, calls, func() { observeAWSRequest(awsCall("s3", "PutObject", nil)) }); got != 1 {
+				t.Errorf("counted %v calls, want 1", got)
+			}
+		})
+		if bytes != 2048 {
+			t.Errorf("counted %v bytes uploaded, want 2048", bytes)
+		}
+	})
+
+	t.Run("download counts the bytes received", func(t *testing.T) {
+		if got := counterDelta(t, downloaded, func() { observeAWSRequest(awsCall("s3", "GetObject", nil)) }); got != 512 {
+			t.Errorf("counted %v bytes downloaded, want 512", got)
+		}
+	})
+
+	t.Run("failed upload transfers nothing", func(t *testing.T) {
+		failed := awsRequests.WithLabelValues("s3", "PutObject", outcomeError)
+		bytes := counterDelta(t, uploaded, func() {
+			if got := counterDelta(t, failed, func() { observeAWSRequest(awsCall("s3", "PutObject", errors.New("SlowDown"))) }); got != 1 {
+				t.Errorf("counted %v failed calls, want 1", got)
+			}
+		})
+		if bytes != 0 {
+			t.Errorf("counted %v bytes for a failed upload", bytes)
+		}
+	})
+
+	t.Run("other services transfer nothing", func(t *testing.T) {
+		if got := counterDelta(t, uploaded, func() { observeAWSRequest(awsCall("sqs", "SendMessage", nil)) }); got != 0 {
+			t.Errorf("counted %v bytes for SQS", got)
+		}
+	})
+
+	t.Run("request without operation", func(t *testing.T) {
+		call := awsCall("sns", "", nil)
+		call.Operation = nil
+		unknown := awsRequests.WithLabelValues("sns", "unknown", outcomeSuccess)
+		if got := counterDelta(t, unknown, func() { observeAWSRequest(call) }); got != 1 {
+			t.Errorf("counted %v calls of an unknown operation, want 1", got)
+		}
+	})
+}
+
+func TestObserveSQLCountsByOperation(t *testing.T) {
+	failed := sqlQueries.WithLabelValues("UPDATE", outcomeError)
+	if got := counterDelta(t, failed, func() {
+		observeSQL(context.Background(), "\n\tupdate images SET tags = ? WHERE id = ?")(errors.New("deadlock"))
+	}); got != 1 {
+		t.Errorf("counted %v failed updates, want 1", got)
+	}
+
+	for query, want := range map[string]string{
+		"SELECT id FROM images": "SELECT",
+		"  insert INTO images":  "INSERT",
+		"COMMIT":                "COMMIT",
+		"":                      "unknown",
+	} {
+		if got := sqlOperation(query); got != want {
+			t.Errorf("sqlOperation(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestObserveReceived(t *testing.T) {
+	queueURL := "https://sqs.eu-west-1.amazonaws.com/123456789012/received-" + t.Name()
+	queue := queueName(queueURL)
+	sent := strconv.FormatInt(time.Now().Add(-3*time.Second).UnixMilli(), 10)
+	messages := []*sqs.Message{
+		{Attributes: map[string]*string{sqs.MessageSystemAttributeNameSentTimestamp: aws.String(sent)}},
+		{Attributes: map[string]*string{sqs.MessageSystemAttributeNameSentTimestamp: aws.String("yesterday")}},
+		{},
+	}
+
+	observeReceived(queueURL, messages)
+
+	if got := testutil.ToFloat64(sqsMessagesReceived.WithLabelValues(queue)); got != 3 {
+		t.Errorf("counted %v messages received, want 3", got)
+	}
+	if got := observations(t, sqsMessageAge, queue); got != 1 {
+		t.Errorf("measured the age of %d messages, want the one with a sent time", got)
+	}
+}
+
+// queueAttributesSQS answers GetQueueAttributes with attributes.
+type queueAttributesSQS struct {
+	fakeSQS
+	attributes map[string]string
+	err        error
+}
+
+func (f *queueAttributesSQS) GetQueueAttributesWithContext(ctx aws.Context, in *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: aws.StringMap(f.attributes)}, nil
+}
+
+func TestUpdateQueueMetrics(t *testing.T) {
+	url := "https://sqs.eu-west-1.amazonaws.com/123456789012/uploads-dlq"
+	client := &queueAttributesSQS{attributes: map[string]string{
+		sqs.QueueAttributeNameApproximateNumberOfMessages:           "12",
+		sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: "3",
+		sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed:    "not a number",
+	}}
+	sqsQueueMessages.WithLabelValues("uploads-dlq", "delayed").Set(7)
+
+	if err := updateQueueMetrics(context.Background(), client, url); err != nil {
+		t.Fatal(err)
+	}
+	for state, want := range map[string]float64{"visible": 12, "in_flight": 3, "delayed": 7} {
+		if got := testutil.ToFloat64(sqsQueueMessages.WithLabelValues("uploads-dlq", state)); got != want {
+			t.Errorf("%s = %v, want %v", state, got, want)
+		}
+	}
+
+	client.err = errors.New("AccessDenied")
+	if err := updateQueueMetrics(context.Background(), client, url); err == nil {
+		t.Error("updateQueueMetrics() hid the error of the queue")
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// digestCheckInterval is how often the notifier checks whether a digest is due.
+const digestCheckInterval = 10 * time.Second
+
+// sentEventsPurgeBatch bounds the number of sent events forgotten at once.
+const sentEventsPurgeBatch = 1000
+
+// digest gathers the events published together in one notification.
+type digest struct {
+	Events   []eventEnvelope
+	Uploaded []eventImage
+	Deleted  []eventImage
+	From     time.Time
+	To       time.Time
+	// UnsubscribeURL is the one-click unsubscribe link of the recipient, only
+	// set on the copy of the digest published for a single recipient.
+	UnsubscribeURL string
+}
+
+// forRecipient returns d with the unsubscribe link of the endpoint.
+func (d digest) forRecipient(protocol, endpoint string) digest {
+	d.UnsubscribeURL = unsubscribeURL(protocol, endpoint)
+	return d
+}
+
+// pendingTableName is the table holding the events waiting for the next
+// digest, so they survive a restart of the application.
+func pendingTableName() string {
+	return dbTableName + "_pending_notifications"
+}
+
+func createPendingTable() {
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id int NOT NULL AUTO_INCREMENT,
+			event_id VARCHAR(64) NOT NULL,
+			event MEDIUMTEXT NOT NULL,
+			received_at DATETIME NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			parked_at DATETIME NULL,
+			PRIMARY KEY (id),
+			UNIQUE KEY (event_id)
+		)`, pendingTableName()))
+	if err != nil {
+		panic(err.Error())
+	}
+	slog.Info("Table created or already exists", "table", pendingTableName())
+
+	// Tables created before a batch event could exceed 64KB, or before
+	// rejected digests were retried, need them altered explicitly
+	if err = widenTextColumn(pendingTableName(), "event", "MEDIUMTEXT NOT NULL"); err != nil {
+		panic(err.Error())
+	}
+	if err = addColumnIfMissing(pendingTableName(), "attempts", "INT NOT NULL DEFAULT 0"); err != nil {
+		panic(err.Error())
+	}
+	if err = addColumnIfMissing(pendingTableName(), "parked_at", "DATETIME NULL"); err != nil {
+		panic(err.Error())
+	}
+}
+
+// sentEventsTableName is the table holding the ids of the events already
+// sent in a digest, for as long as a copy of them may still be delivered.
+func sentEventsTableName() string {
+	return dbTableName + "_sent_notifications"
+}
+
+func createSentEventsTable() {
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			event_id VARCHAR(64) NOT NULL,
+			sent_at DATETIME NOT NULL,
+			PRIMARY KEY (event_id),
+			KEY (sent_at)
+		)`, sentEventsTableName()))
+	if err != nil {
+		panic(err.Error())
+	}
+	slog.Info("Table created or already exists", "table", sentEventsTableName())
+}
+
+// addPendingEvent stores event until the next digest. Storing the same event
+// twice, e.g. when its message is redelivered, keeps a single copy while it
+// is pending, and none once it was sent within the dedup retention, see
+// runDigestNotifier.
+func addPendingEvent(ctx context.Context, event eventEnvelope) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`
+		INSERT IGNORE INTO %s(event_id, event, received_at)
+		SELECT ?, ?, UTC_TIMESTAMP() FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM %s WHERE event_id = ?)`,
+		pendingTableName(), sentEventsTableName(),
+	), event.ID, string(body), event.ID)
+	return err
+}
+
+// purgeSentEvents forgets the events sent more than retention ago, and
+// returns how many it forgot.
+func purgeSentEvents(ctx context.Context, retention time.Duration) (int64, error) {
+	result, err := db.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE sent_at < DATE_SUB(UTC_TIMESTAMP(), INTERVAL ? SECOND) LIMIT ?",
+		sentEventsTableName(),
+	), int64(retention.Seconds()), sentEventsPurgeBatch)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// runDigestNotifier publishes the pending events to the SNS topic as a single
+// digest once DIGEST_MAX_EVENTS (default 50) have accumulated or the oldest
+// has waited DIGEST_WINDOW (default 5m), until ctx is done. A digest being
+// published then is not cancelled, or its events could be sent twice. The ids
+// of the events sent are kept for DIGEST_DEDUP_RETENTION (default 24h), so a
+// copy delivered meanwhile is not sent again.
+func runDigestNotifier(ctx context.Context) {
+	window := getEnvDuration("DIGEST_WINDOW", 5*time.Minute)
+	retention := getEnvDuration("DIGEST_DEDUP_RETENTION", 24*time.Hour)
+	maxEvents := getEnvInt("DIGEST_MAX_EVENTS", 50)
+	if maxEvents < 1 {
+		fatal("DIGEST_MAX_EVENTS must be at least 1")
+	}
+	snsClient := sns.New(awsSession)
+	publish := func(ctx context.Context, d digest) error {
+		return publishDigest(ctx, snsClient, d)
+	}
+
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Keep sending while full digests are waiting
+		for {
+			sent, err := publishDueDigest(context.WithoutCancel(ctx), pendingTable{}, publish, window, maxEvents)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error publishing digest to SNS", "error", err)
+			}
+			if sent < maxEvents || ctx.Err() != nil {
+				break
+			}
+		}
+
+		if _, err := purgeSentEvents(ctx, retention); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Error purging sent events", "error", err)
+		}
+	}
+}
+
+// digestQueue holds the events waiting for their digest: the pending table,
+// or a fake in the tests.
+type digestQueue interface {
+	// due returns how many of the oldest pending events the next digest
+	// takes, or 0 if no digest is due yet.
+	due(ctx context.Context, window time.Duration, maxEvents int) (int, error)
+	// claim locks up to n of the oldest pending events until the claim is
+	// released, skipping the ones claimed elsewhere.
+	claim(ctx context.Context, n int) (digestClaim, error)
+}
+
+// digestClaim is a set of pending events locked for a digest.
+type digestClaim interface {
+	// events returns the claimed events that could be read.
+	events() []eventEnvelope
+	// size returns the number of claimed events, unreadable ones included.
+	size() int
+	// sent records the events as sent and removes them.
+	sent(ctx context.Context) error
+	// rejected counts a rejected digest against the events, so the next
+	// digest takes fewer of them, and parks them for good if park is set.
+	rejected(ctx context.Context, park bool) error
+	// release unlocks what is left of the claim.
+	release()
+}
+
+// digestBatchSize is how many events the next digest takes when the oldest
+// pending event was in attempts rejected digests: half as many per rejection,
+// until the event is alone.
+func digestBatchSize(maxEvents, attempts int) int {
+	if attempts >= bits.UintSize-1 {
+		return 1
+	}
+	return max(maxEvents>>attempts, 1)
+}
+
+// isRejectedDigest reports whether err means the digest itself cannot be
+// published, e.g. it is too large for SNS or cannot be rendered, as opposed to
+// a failure worth retrying as is.
+func isRejectedDigest(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return true
+	}
+	switch awsErr.Code() {
+	case sns.ErrCodeInvalidParameterException, sns.ErrCodeInvalidParameterValueException:
+		return true
+	}
+	return false
+}
+
+// publishDueDigest publishes and removes the oldest pending events if a
+// digest is due, records them as sent, and returns how many it sent. The
+// events stay claimed until they are removed, so several instances never
+// send the same events twice.
+//
+// A rejected digest is retried with half as many events, so a single event
+// SNS refuses cannot hold back the ones after it; once alone, it is parked.
+func publishDueDigest(ctx context.Context, queue digestQueue, publish func(context.Context, digest) error, window time.Duration, maxEvents int) (int, error) {
+	n, err := queue.due(ctx, window, maxEvents)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	claim, err := queue.claim(ctx, n)
+	if err != nil {
+		return 0, err
+	}
+	defer claim.release()
+	if claim.size() == 0 {
+		return 0, nil
+	}
+
+	if events := claim.events(); len(events) > 0 {
+		if err := publish(ctx, newDigest(events)); err != nil {
+			if !isRejectedDigest(err) {
+				return 0, err
+			}
+			park := claim.size() == 1
+			if rerr := claim.rejected(ctx, park); rerr != nil {
+				return 0, errors.Join(err, rerr)
+			}
+			if park {
+				slog.ErrorContext(ctx, "Parked pending event rejected by SNS", "event_id", events[0].ID, "error", err)
+			} else {
+				slog.WarnContext(ctx, "Digest rejected, retrying with fewer events", "events", claim.size(), "error", err)
+			}
+			return 0, err
+		}
+	}
+	return claim.size(), claim.sent(ctx)
+}
+
+// pendingTable is the digestQueue backed by the pending table.
+type pendingTable struct{}
+
+func (pendingTable) due(ctx context.Context, window time.Duration, maxEvents int) (int, error) {
+	var pending, attempts int
+	var waitedSeconds int64
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT COUNT(*), COALESCE(TIMESTAMPDIFF(SECOND, MIN(received_at), UTC_TIMESTAMP()), 0),
+			COALESCE((SELECT attempts FROM %s WHERE parked_at IS NULL ORDER BY id LIMIT 1), 0)
+		FROM %s WHERE parked_at IS NULL`,
+		pendingTableName(), pendingTableName(),
+	)).Scan(&pending, &waitedSeconds, &attempts)
+	if err != nil {
+		return 0, err
+	}
+	if pending == 0 || (pending < maxEvents && time.Duration(waitedSeconds)*time.Second < window) {
+		return 0, nil
+	}
+	return digestBatchSize(maxEvents, attempts), nil
+}
+
+func (pendingTable) claim(ctx context.Context, n int) (digestClaim, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &pendingClaim{tx: tx}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(
+		"SELECT id, event FROM %s WHERE parked_at IS NULL ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED",
+		pendingTableName(),
+	), n)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var body string
+		if err := rows.Scan(&id, &body); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		var event eventEnvelope
+		if err := json.Unmarshal([]byte(body), &event); err != nil {
+			slog.WarnContext(ctx, "Dropping unreadable pending event", "id", id, "error", err)
+		} else {
+			c.readable = append(c.readable, event)
+		}
+		c.ids = append(c.ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return c, nil
+}
+
+// pendingClaim holds the claimed rows of the pending table locked in tx.
+type pendingClaim struct {
+	tx       *sql.Tx
+	ids      []interface{}
+	readable []eventEnvelope
+}
+
+func (c *pendingClaim) events() []eventEnvelope { return c.readable }
+
+func (c *pendingClaim) size() int { return len(c.ids) }
+
+func (c *pendingClaim) sent(ctx context.Context) error {
+	placeholders := strings.Repeat(", ?", len(c.ids)-1)
+	_, err := c.tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT IGNORE INTO %s(event_id, sent_at) SELECT event_id, UTC_TIMESTAMP() FROM %s WHERE id IN (?%s)",
+		sentEventsTableName(), pendingTableName(), placeholders,
+	), c.ids...)
+	if err != nil {
+		return err
+	}
+	_, err = c.tx.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE id IN (?%s)",
+		pendingTableName(), placeholders,
+	), c.ids...)
+	if err != nil {
+		return err
+	}
+	return c.tx.Commit()
+}
+
+func (c *pendingClaim) rejected(ctx context.Context, park bool) error {
+	parkedAt := "parked_at"
+	if park {
+		parkedAt = "UTC_TIMESTAMP()"
+	}
+	_, err := c.tx.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET attempts = attempts + 1, parked_at = %s WHERE id IN (?%s)",
+		pendingTableName(), parkedAt, strings.Repeat(", ?", len(c.ids)-1),
+	), c.ids...)
+	if err != nil {
+		return err
+	}
+	return c.tx.Commit()
+}
+
+func (c *pendingClaim) release() { c.tx.Rollback() }
+
+func newDigest(events []eventEnvelope) digest {
+	d := digest{Events: events, From: events[0].OccurredAt, To: events[0].OccurredAt}
+	for _, event := range events {
+		if event.OccurredAt.Before(d.From) {
+			d.From = event.OccurredAt
+		}
+		if event.OccurredAt.After(d.To) {
+			d.To = event.OccurredAt
+		}
+
+		var payload imageEventPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			slog.Warn("Skipping unreadable payload of event", "event_id", event.ID, "error", err)
+			continue
+		}
+		if event.Type == eventImageDeleted {
+			d.Deleted = append(d.Deleted, payload.Images...)
+		} else {
+			d.Uploaded = append(d.Uploaded, payload.Images...)
+		}
+	}
+	return d
+}
+
+// publishDigest renders d and publishes it to the topic, with a body per
+// protocol so email gets readable text while HTTP and SQS subscribers get JSON.
+// Email recipients get a copy of their own, carrying their unsubscribe link;
+// the other subscribers share one, see recipientAttribute. Once the shared copy
+// is published, a copy failing to publish is logged, not returned, as
+// publishing d again would send the others twice.
+func publishDigest(ctx context.Context, snsClient *sns.SNS, d digest) error {
+	recipients, err := digestRecipients(ctx, snsClient)
+	if err != nil {
+		return fmt.Errorf("listing the recipients of the digest: %w", err)
+	}
+	subject, err := publishDigestCopy(ctx, snsClient, d, broadcastRecipient)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range recipients {
+		if _, err := publishDigestCopy(ctx, snsClient, d.forRecipient("email", endpoint), endpoint); err != nil {
+			slog.ErrorContext(ctx, "Error publishing digest to recipient", "endpoint", endpoint, "error", err)
+		}
+	}
+	slog.InfoContext(ctx, "Published digest to SNS", "events", len(d.Events), "recipients", len(recipients), "subject", subject)
+	return nil
+}
+
+// publishDigestCopy renders d and publishes it to the subscribers whose filter
+// policy matches recipient, and returns its subject.
+func publishDigestCopy(ctx context.Context, snsClient *sns.SNS, d digest, recipient string) (string, error) {
+	n, err := renderer.render(d)
+	if err != nil {
+		return "", fmt.Errorf("rendering digest: %w", err)
+	}
+	message, err := n.snsMessage()
+	if err != nil {
+		return "", err
+	}
+
+	attributes := digestAttributes(d)
+	attributes[recipientAttribute] = &sns.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(recipient),
+	}
+	subject := n.snsSubject()
+	_, err = snsClient.PublishWithContext(ctx, &sns.PublishInput{
+		Subject:           aws.String(subject),
+		Message:           aws.String(message),
+		MessageStructure:  aws.String("json"),
+		MessageAttributes: attributes,
+		TopicArn:          aws.String(topicARN),
+	})
+	snsDigestsPublished.WithLabelValues(outcome(err)).Inc()
+	return subject, err
+}
+
+// getPendingEvents returns up to limit of the events waiting for the next digest.
+func getPendingEvents(ctx context.Context, limit int) ([]eventEnvelope, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT event FROM %s WHERE parked_at IS NULL ORDER BY id LIMIT ?",
+		pendingTableName(),
+	), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []eventEnvelope
+	for rows.Next() {
+		var body string
+		if err := rows.Scan(&body); err != nil {
+			return nil, err
+		}
+		var event eventEnvelope
+		if err := json.Unmarshal([]byte(body), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	return events, rows.Err()
+}
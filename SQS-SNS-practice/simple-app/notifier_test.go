@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// fakeQueue is a digestQueue in memory, in the order the events arrived.
+type fakeQueue struct {
+	pending []*fakePending
+	parked  []string
+	sent    []string
+}
+
+type fakePending struct {
+	event    eventEnvelope
+	attempts int
+}
+
+func newFakeQueue(ids ...string) *fakeQueue {
+	q := &fakeQueue{}
+	for _, id := range ids {
+		q.pending = append(q.pending, &fakePending{event: eventEnvelope{ID: id, Type: eventImageUploaded}})
+	}
+	return q
+}
+
+func (q *fakeQueue) due(ctx context.Context, window time.Duration, maxEvents int) (int, error) {
+	if len(q.pending) == 0 {
+		return 0, nil
+	}
+	return digestBatchSize(maxEvents, q.pending[0].attempts), nil
+}
+
+func (q *fakeQueue) claim(ctx context.Context, n int) (digestClaim, error) {
+	return &fakeClaim{queue: q, claimed: q.pending[:min(n, len(q.pending))]}, nil
+}
+
+type fakeClaim struct {
+	queue   *fakeQueue
+	claimed []*fakePending
+}
+
+func (c *fakeClaim) events() []eventEnvelope {
+	var events []eventEnvelope
+	for _, p := range c.claimed {
+		events = append(events, p.event)
+	}
+	return events
+}
+
+func (c *fakeClaim) size() int { return len(c.claimed) }
+
+func (c *fakeClaim) sent(ctx context.Context) error {
+	for _, p := range c.claimed {
+		c.queue.sent = append(c.queue.sent, p.event.ID)
+	}
+	c.queue.pending = c.queue.pending[len(c.claimed):]
+	return nil
+}
+
+func (c *fakeClaim) rejected(ctx context.Context, park bool) error {
+	for _, p := range c.claimed {
+		p.attempts++
+	}
+	if park {
+		c.queue.parked = append(c.queue.parked, c.claimed[0].event.ID)
+		c.queue.pending = c.queue.pending[1:]
+	}
+	return nil
+}
+
+func (c *fakeClaim) release() {}
+
+// rejecting publishes every digest except the ones holding the poison event,
+// which SNS rejects as too long.
+func rejecting(poison string) func(context.Context, digest) error {
+	return func(ctx context.Context, d digest) error {
+		for _, event := range d.Events {
+			if event.ID == poison {
+				return awserr.New(sns.ErrCodeInvalidParameterException, "Invalid parameter: Message too long", nil)
+			}
+		}
+		return nil
+	}
+}
+
+func TestPublishDueDigestParksRejectedEvent(t *testing.T) {
+	var ids []string
+	for i := 1; i <= 20; i++ {
+		ids = append(ids, fmt.Sprintf("event-%d", i))
+	}
+	queue := newFakeQueue(ids...)
+	publish := rejecting("event-3")
+
+	for round := 0; len(queue.pending) > 0; round++ {
+		if round == 50 {
+			t.Fatalf("events still pending after %d digests: %d", round, len(queue.pending))
+		}
+		publishDueDigest(context.Background(), queue, publish, time.Minute, 8)
+	}
+
+	if len(queue.parked) != 1 || queue.parked[0] != "event-3" {
+		t.Errorf("parked = %v, want [event-3]", queue.parked)
+	}
+	if len(queue.sent) != len(ids)-1 {
+		t.Errorf("sent %d events, want %d", len(queue.sent), len(ids)-1)
+	}
+	for _, id := range queue.sent {
+		if id == "event-3" {
+			t.Errorf("rejected event was sent")
+		}
+	}
+}
+
+func TestPublishDueDigestShrinksAfterRejection(t *testing.T) {
+	queue := newFakeQueue("event-1", "event-2", "event-3", "event-4")
+	publish := rejecting("event-4")
+
+	var sizes []int
+	record := func(ctx context.Context, d digest) error {
+		sizes = append(sizes, len(d.Events))
+		return publish(ctx, d)
+	}
+	for i := 0; i < 4; i++ {
+		publishDueDigest(context.Background(), queue, record, time.Minute, 4)
+	}
+
+	// 4 rejected, 2 sent, the 2 left rejected, then the oldest sent alone
+	want := []int{4, 2, 2, 1}
+	if fmt.Sprint(sizes) != fmt.Sprint(want) {
+		t.Errorf("digest sizes = %v, want %v", sizes, want)
+	}
+}
+
+func TestPublishDueDigestRetriesFailureAsIs(t *testing.T) {
+	queue := newFakeQueue("event-1", "event-2")
+	outage := awserr.New("RequestError", "send request failed", errors.New("connection reset"))
+	publish := func(ctx context.Context, d digest) error { return outage }
+
+	for i := 0; i < 3; i++ {
+		if _, err := publishDueDigest(context.Background(), queue, publish, time.Minute, 2); !errors.Is(err, outage) {
+			t.Fatalf("err = %v, want %v", err, outage)
+		}
+	}
+	if len(queue.pending) != 2 || queue.pending[0].attempts != 0 {
+		t.Errorf("an outage counted against the events: %d pending, %d attempts", len(queue.pending), queue.pending[0].attempts)
+	}
+	if len(queue.parked) != 0 {
+		t.Errorf("parked = %v, want none", queue.parked)
+	}
+}
+
+func TestDigestBatchSize(t *testing.T) {
+	if got := digestBatchSize(50, 0); got != 50 {
+		t.Errorf("digestBatchSize(50, 0) = %d, want 50", got)
+	}
+	if got := digestBatchSize(50, 2); got != 12 {
+		t.Errorf("digestBatchSize(50, 2) = %d, want 12", got)
+	}
+	if got := digestBatchSize(50, 100); got != 1 {
+		t.Errorf("digestBatchSize(50, 100) = %d, want 1", got)
+	}
+}
+
+func TestNewDigestGroupsImagesByEvent(t *testing.T) {
+	at := time.Date(2026, 3, 14, 9, 0, 0, 0, time.UTC)
+	uploaded, _ := newImageEvent(eventImageUploaded, []Image{{Name: "cat.png"}, {Name: "dog.png"}})
+	uploaded.OccurredAt = at.Add(2 * time.Minute)
+	deleted, _ := newImageEvent(eventImageDeleted, []Image{{Name: "old.gif"}})
+	deleted.OccurredAt = at
+	unreadable := eventEnvelope{ID: "broken", Type: eventImageUploaded, OccurredAt: at.Add(time.Minute), Payload: json.RawMessage(`"not an object"`)}
+
+	d := newDigest([]eventEnvelope{uploaded, unreadable, deleted})
+
+	if len(d.Events) != 3 {
+		t.Errorf("digest holds %d events, want all 3", len(d.Events))
+	}
+	if len(d.Uploaded) != 2 || d.Uploaded[1].Name != "dog.png" || len(d.Deleted) != 1 || d.Deleted[0].Name != "old.gif" {
+		t.Errorf("uploaded %v, deleted %v", d.Uploaded, d.Deleted)
+	}
+	if !d.From.Equal(at) || !d.To.Equal(at.Add(2*time.Minute)) {
+		t.Errorf("digest spans %s to %s, want the first and last events", d.From, d.To)
+	}
+	if d.UnsubscribeURL != "" {
+		t.Error("shared digest carries an unsubscribe link")
+	}
+}
+
+func TestPendingTableDue(t *testing.T) {
+	// pending events, seconds the oldest waited, attempts of the oldest
+	for name, tc := range map[string]struct {
+		pending, waited, attempts int64
+		want                      int
+	}{
+		"nothing pending":         {0, 0, 0, 0},
+		"few and recent":          {3, 60, 0, 0},
+		"oldest waited a window":  {3, 300, 0, 10},
+		"enough for a digest":     {10, 1, 0, 10},
+		"oldest rejected twice":   {3, 900, 2, 2},
+		"rejected past one event": {1, 900, 9, 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			useScriptedDB(t, &scriptedDB{query: func(query string, args []driver.Value) (*scriptedRows, error) {
+				return &scriptedRows{
+					columns: []string{"pending", "waited", "attempts"},
+					values:  [][]driver.Value{{tc.pending, tc.waited, tc.attempts}},
+				}, nil
+			}})
+			got, err := pendingTable{}.due(context.Background(), 5*time.Minute, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("due() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// pendingRows is a pending table of the events, with the ids from 1, and
+// the pending event with id 2 unreadable.
+func pendingRows(events ...eventEnvelope) *scriptedDB {
+	return &scriptedDB{
+		query: func(query string, args []driver.Value) (*scriptedRows, error) {
+			rows := &scriptedRows{columns: []string{"id", "event"}}
+			for i, event := range events {
+				body, _ := json.Marshal(event)
+				if i == 1 {
+					body = []byte("{truncated")
+				}
+				rows.values = append(rows.values, []driver.Value{int64(i + 1), string(body)})
+			}
+			return rows, nil
+		},
+		exec: func(query string, args []driver.Value) (int64, error) { return int64(len(args)), nil },
+	}
+}
+
+func TestPendingClaimSent(t *testing.T) {
+	table := pendingRows(eventEnvelope{ID: "event-1"}, eventEnvelope{ID: "event-2"}, eventEnvelope{ID: "event-3"})
+	useScriptedDB(t, table)
+
+	claim, err := pendingTable{}.claim(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim.size() != 3 || len(claim.events()) != 2 {
+		t.Fatalf("claimed %d rows with %d readable events, want 3 with 2", claim.size(), len(claim.events()))
+	}
+	if err := claim.sent(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unreadable event is claimed, so it goes with the digest instead of
+	// blocking the ones after it
+	ran := table.ran()
+	want := []string{"BEGIN", "SELECT", "INSERT IGNORE INTO images_sent_notifications", "DELETE FROM images_pending_notifications", "COMMIT"}
+	if len(ran) != len(want) {
+		t.Fatalf("ran %q", ran)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(strings.TrimSpace(ran[i]), prefix) {
+			t.Errorf("statement %d = %q, want %s", i, ran[i], prefix)
+		}
+	}
+	if !strings.Contains(ran[2], "WHERE id IN (?, ?, ?)") {
+		t.Errorf("marked sent with %q, want the 3 claimed rows", ran[2])
+	}
+}
+
+func TestPendingClaimRejected(t *testing.T) {
+	for _, park := range []bool{false, true} {
+		table := pendingRows(eventEnvelope{ID: "event-1"})
+		useScriptedDB(t, table)
+
+		claim, err := pendingTable{}.claim(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := claim.rejected(context.Background(), park); err != nil {
+			t.Fatal(err)
+		}
+		update := table.ranMatching("SET attempts")
+		if len(update) != 1 || !strings.Contains(update[0], "attempts = attempts + 1") {
+			t.Fatalf("park %t: updated with %q", park, update)
+		}
+		if parked := strings.Contains(update[0], "parked_at = UTC_TIMESTAMP()"); parked != park {
+			t.Errorf("park %t: %q", park, update[0])
+		}
+		if len(table.ranMatching("COMMIT")) != 1 {
+			t.Errorf("park %t: the rejection was not committed", park)
+		}
+	}
+}
+
+func TestPendingClaimRelease(t *testing.T) {
+	table := pendingRows(eventEnvelope{ID: "event-1"})
+	useScriptedDB(t, table)
+
+	claim, err := pendingTable{}.claim(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim.release()
+	if len(table.ranMatching("ROLLBACK")) != 1 || len(table.ranMatching("COMMIT")) != 0 {
+		t.Errorf("ran %q, want the claim rolled back", table.ran())
+	}
+}
+
+func TestAddPendingEventSkipsSentEvents(t *testing.T) {
+	var args []driver.Value
+	table := &scriptedDB{exec: func(query string, a []driver.Value) (int64, error) {
+		args = a
+		return 0, nil
+	}}
+	useScriptedDB(t, table)
+
+	if err := addPendingEvent(context.Background(), eventEnvelope{ID: "event-7", Type: eventImageUploaded}); err != nil {
+		t.Fatal(err)
+	}
+	insert := table.ranMatching("INSERT IGNORE INTO images_pending_notifications")
+	if len(insert) != 1 || !strings.Contains(insert[0], "NOT EXISTS (SELECT 1 FROM images_sent_notifications WHERE event_id = ?)") {
+		t.Fatalf("stored with %q, want sent events skipped", insert)
+	}
+	if len(args) != 3 || args[0] != "event-7" || args[2] != "event-7" {
+		t.Errorf("args = %v", args)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRandomCount caps the number of images returned by one random request.
+const maxRandomCount = 100
+
+func getRandomMetadata(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := imageFilter{
+		Extension: query.Get("extension"),
+		Tag:       strings.ToLower(strings.TrimSpace(query.Get("tag"))),
+		Album:     query.Get("album"),
+	}
+
+	count := 1
+	if value := query.Get("count"); value != "" {
+		var err error
+		count, err = strconv.Atoi(value)
+		if err != nil || count < 1 || count > maxRandomCount {
+			http.Error(w, fmt.Sprintf("count must be a number between 1 and %d", maxRandomCount), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A seed makes the selection reproducible for as long as the table does not change
+	seed := time.Now().UnixNano()
+	if value := query.Get("seed"); value != "" {
+		var err error
+		seed, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "seed must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	images, err := getRandomImages(r.Context(), filter, count, rand.New(rand.NewSource(seed)))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading metadata from RDS", "error", err)
+		http.Error(w, "Error reading metadata from RDS", http.StatusInternalServerError)
+		return
+	}
+	if len(images) == 0 {
+		http.Error(w, "No image matches the given filters", http.StatusNotFound)
+		return
+	}
+	logImages(r.Context(), images)
+
+	// Write the Image (or the Image list when a count was requested) as a JSON response
+	w.Header().Set("Content-Type", "application/json")
+	if query.Get("count") == "" {
+		json.NewEncoder(w).Encode(images[0])
+		return
+	}
+	json.NewEncoder(w).Encode(images)
+}
+
+// getRandomImages picks up to count distinct images matching filter.
+//
+// Instead of sorting the whole table with ORDER BY RAND(), each pick probes a
+// random id between MIN(id) and MAX(id) and takes the first matching row at
+// or after it (wrapping around to the rows before it), which is an index range
+// read on the primary key. Ids that follow large gaps are slightly more likely
+// to be picked. Fewer than count images are returned when not enough match.
+func getRandomImages(ctx context.Context, filter imageFilter, count int, rng *rand.Rand) ([]Image, error) {
+	var minID, maxID sql.NullInt64
+	err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT MIN(id), MAX(id) FROM %s", dbTableName)).Scan(&minID, &maxID)
+	if err != nil {
+		return nil, err
+	}
+	if !minID.Valid {
+		return nil, nil
+	}
+
+	var images []Image
+	var picked []interface{}
+	for len(images) < count {
+		probe := minID.Int64 + rng.Int63n(maxID.Int64-minID.Int64+1)
+		image, err := probeImage(ctx, filter, probe, picked)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Every matching image has already been picked
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+		picked = append(picked, image.ID)
+	}
+	return images, nil
+}
+
+// probeImage returns the first image matching filter with an id at or after
+// probe, or failing that the last one before it, skipping the excluded ids.
+func probeImage(ctx context.Context, filter imageFilter, probe int64, excluded []interface{}) (Image, error) {
+	conditions, args := filter.where()
+	if len(excluded) > 0 {
+		conditions += " AND id NOT IN (?" + strings.Repeat(", ?", len(excluded)-1) + ")"
+		args = append(args, excluded...)
+	}
+
+	image, err := scanImage(db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE id >= ?%s ORDER BY id LIMIT 1",
+		imageColumns, dbTableName, conditions,
+	), append([]interface{}{probe}, args...)...))
+	if !errors.Is(err, sql.ErrNoRows) {
+		return image, err
+	}
+	return scanImage(db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE id < ?%s ORDER BY id DESC LIMIT 1",
+		imageColumns, dbTableName, conditions,
+	), append([]interface{}{probe}, args...)...))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// randomTable answers the statements of getRandomImages from images, sorted
+// by id, supporting the extension filter only.
+func randomTable(images ...Image) *scriptedDB {
+	return &scriptedDB{query: func(query string, args []driver.Value) (*scriptedRows, error) {
+		if strings.HasPrefix(query, "SELECT MIN(id), MAX(id)") {
+			if len(images) == 0 {
+				return &scriptedRows{columns: []string{"min", "max"}, values: [][]driver.Value{{nil, nil}}}, nil
+			}
+			return &scriptedRows{columns: []string{"min", "max"}, values: [][]driver.Value{{images[0].ID, images[len(images)-1].ID}}}, nil
+		}
+
+		probe, args := args[0].(int64), args[1:]
+		extension := ""
+		if strings.Contains(query, "extension = ?") {
+			extension, args = args[0].(string), args[1:]
+		}
+		excluded := map[int64]bool{}
+		for _, id := range args {
+			excluded[id.(int64)] = true
+		}
+		matches := func(image Image) bool {
+			return !excluded[image.ID] && (extension == "" || image.Extension == extension)
+		}
+
+		if strings.Contains(query, "id >= ?") {
+			for _, image := range images {
+				if image.ID >= probe && matches(image) {
+					return imageRows(image), nil
+				}
+			}
+			return imageRows(), nil
+		}
+		for i := len(images) - 1; i >= 0; i-- {
+			if images[i].ID < probe && matches(images[i]) {
+				return imageRows(images[i]), nil
+			}
+		}
+		return imageRows(), nil
+	}}
+}
+
+func sparseImages() []Image {
+	return []Image{
+		{ID: 3, Name: "a.png", Extension: "png"},
+		{ID: 4, Name: "b.jpg", Extension: "jpg"},
+		{ID: 10, Name: "c.png", Extension: "png"},
+		{ID: 11, Name: "d.gif", Extension: "gif"},
+		{ID: 50, Name: "e.png", Extension: "png"},
+	}
+}
+
+func TestGetRandomImagesPicksDistinctImages(t *testing.T) {
+	useScriptedDB(t, randomTable(sparseImages()...))
+
+	images, err := getRandomImages(context.Background(), imageFilter{}, 10, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only five images exist, the picks stop once every one was taken
+	seen := map[string]bool{}
+	for _, image := range images {
+		if seen[image.Name] {
+			t.Errorf("%s was picked twice", image.Name)
+		}
+		seen[image.Name] = true
+	}
+	if len(seen) != 5 {
+		t.Errorf("picked %d images, want all 5", len(seen))
+	}
+}
+
+func TestGetRandomImagesAppliesFilter(t *testing.T) {
+	useScriptedDB(t, randomTable(sparseImages()...))
+
+	for seed := int64(0); seed < 20; seed++ {
+		images, err := getRandomImages(context.Background(), imageFilter{Extension: "png"}, 2, rand.New(rand.NewSource(seed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(images) != 2 {
+			t.Fatalf("seed %d: picked %d images, want 2", seed, len(images))
+		}
+		for _, image := range images {
+			if image.Extension != "png" {
+				t.Errorf("seed %d: picked %s, which does not match the filter", seed, image.Name)
+			}
+		}
+	}
+}
+
+func TestGetRandomImagesWrapsAroundPastLastMatch(t *testing.T) {
+	// Every probe above 4 finds no jpg after it and has to look before it
+	table := randomTable(sparseImages()...)
+	useScriptedDB(t, table)
+
+	images, err := getRandomImages(context.Background(), imageFilter{Extension: "jpg"}, 1, rand.New(rand.NewSource(7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Name != "b.jpg" {
+		t.Fatalf("images = %+v, want b.jpg", images)
+	}
+	if len(table.ranMatching("ORDER BY RAND()")) != 0 {
+		t.Error("the table was sorted with ORDER BY RAND()")
+	}
+}
+
+func TestGetRandomImagesEmptyTable(t *testing.T) {
+	useScriptedDB(t, randomTable())
+
+	images, err := getRandomImages(context.Background(), imageFilter{}, 3, rand.New(rand.NewSource(1)))
+	if err != nil || len(images) != 0 {
+		t.Errorf("getRandomImages() = %v, %v, want no images", images, err)
+	}
+}
+
+func TestGetRandomMetadataSeedIsReproducible(t *testing.T) {
+	useScriptedDB(t, randomTable(sparseImages()...))
+
+	pick := func() []string {
+		rec := httptest.NewRecorder()
+		getRandomMetadata(rec, httptest.NewRequest(http.MethodGet, "/random?count=3&seed=42", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		var images []Image
+		if err := json.NewDecoder(rec.Body).Decode(&images); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, image := range images {
+			names = append(names, image.Name)
+		}
+		return names
+	}
+
+	first, second := pick(), pick()
+	if strings.Join(first, ",") != strings.Join(second, ",") {
+		t.Errorf("the same seed picked %v then %v", first, second)
+	}
+}
+
+func TestGetRandomMetadataRejectsInvalidParameters(t *testing.T) {
+	for _, query := range []string{"count=0", "count=101", "count=many", "seed=abc"} {
+		rec := httptest.NewRecorder()
+		getRandomMetadata(rec, httptest.NewRequest(http.MethodGet, "/random?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestGetRandomMetadataNoMatch(t *testing.T) {
+	useScriptedDB(t, randomTable(sparseImages()...))
+
+	rec := httptest.NewRecorder()
+	getRandomMetadata(rec, httptest.NewRequest(http.MethodGet, "/random?extension=webp", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", rec.Code)
+	}
+}
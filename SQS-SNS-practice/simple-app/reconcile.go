@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Repair policies of the reconciler.
+const (
+	// repairNone only reports the drift.
+	repairNone = "none"
+	// repairFromBucket treats the bucket as the source of truth: orphan objects
+	// are imported and dangling rows are deleted.
+	repairFromBucket = "bucket"
+	// repairFromDatabase treats the table as the source of truth: orphan objects
+	// are deleted. Dangling rows cannot be repaired and are only reported.
+	repairFromDatabase = "database"
+)
+
+// defaultReconcileGracePeriod is how recent an object or a row must be to be
+// left out of a run, unless RECONCILE_GRACE_PERIOD says otherwise.
+const defaultReconcileGracePeriod = 15 * time.Minute
+
+// driftReport lists the differences found between the bucket and the table.
+// Size mismatches are repaired from the bucket under both repair policies,
+// since the object is what the size describes. Objects and rows changed
+// within the grace period are skipped, rather than reported: an upload or a
+// delete in flight has written one of them and not yet the other.
+type driftReport struct {
+	GeneratedAt    time.Time      `json:"generatedAt"`
+	Policy         string         `json:"policy"`
+	GracePeriod    string         `json:"gracePeriod"`
+	Objects        int            `json:"objects"`
+	Rows           int            `json:"rows"`
+	OrphanObjects  []orphanObject `json:"orphanObjects"`
+	DanglingRows   []danglingRow  `json:"danglingRows"`
+	SizeMismatches []sizeMismatch `json:"sizeMismatches"`
+	Skipped        []skippedImage `json:"skipped"`
+	Repairs        []repairAction `json:"repairs"`
+}
+
+// orphanObject is an object in the bucket without a row in the table.
+type orphanObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// danglingRow is a row of the table without an object in the bucket.
+type danglingRow struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	LastUpdate time.Time `json:"lastUpdate"`
+}
+
+// sizeMismatch is an image whose row disagrees with its object about the size.
+type sizeMismatch struct {
+	Name       string `json:"name"`
+	ObjectSize int64  `json:"objectSize"`
+	RowSize    int64  `json:"rowSize"`
+}
+
+// skippedImage is an image left out of a run, since its object or its row
+// changed within the grace period.
+type skippedImage struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+type repairAction struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Error  string `json:"error,omitempty"`
+}
+
+func reconcileCommand(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	policy := flags.String("repair", repairNone, "repair policy: none, bucket or database")
+	interval := flags.Duration("interval", 0, "run again after every interval instead of once, e.g. 1h")
+	grace := flags.Duration("grace", getEnvDuration("RECONCILE_GRACE_PERIOD", defaultReconcileGracePeriod),
+		"skip the objects and rows changed more recently, which uploads and deletes in flight may not have finished")
+	output := flags.String("output", "", "file the JSON report is written to (default stdout)")
+	flags.Parse(args)
+
+	if err := validateRepairPolicy(*policy); err != nil {
+		return err
+	}
+
+	for {
+		report, err := reconcile(context.Background(), *policy, *grace)
+		if err != nil {
+			return err
+		}
+		if err := writeDriftReport(report, *output); err != nil {
+			return err
+		}
+		if *interval <= 0 {
+			return nil
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// runReconciler reconciles in the background every interval, for the web
+// server, until ctx is done. A run cut short is only done again next time.
+func runReconciler(ctx context.Context, interval time.Duration, policy string) {
+	grace := getEnvDuration("RECONCILE_GRACE_PERIOD", defaultReconcileGracePeriod)
+	for {
+		sleepContext(ctx, interval)
+		if ctx.Err() != nil {
+			return
+		}
+
+		report, err := reconcile(ctx, policy, grace)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reconciling bucket and table", "error", err)
+			continue
+		}
+		if len(report.OrphanObjects)+len(report.DanglingRows)+len(report.SizeMismatches) == 0 {
+			continue
+		}
+		slog.WarnContext(ctx, "Drift between bucket and table found",
+			"orphan_objects", len(report.OrphanObjects),
+			"dangling_rows", len(report.DanglingRows),
+			"size_mismatches", len(report.SizeMismatches),
+			"skipped", len(report.Skipped),
+			"repairs", len(report.Repairs),
+		)
+	}
+}
+
+func validateRepairPolicy(policy string) error {
+	switch policy {
+	case repairNone, repairFromBucket, repairFromDatabase:
+		return nil
+	default:
+		return fmt.Errorf("unknown repair policy '%s', expected one of: none, bucket, database", policy)
+	}
+}
+
+func writeDriftReport(report driftReport, output string) error {
+	var w io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// reconcile compares the bucket listing with the table and, unless the policy
+// is repairNone, repairs what it can. Objects modified and rows updated less
+// than grace before the run are skipped.
+func reconcile(ctx context.Context, policy string, grace time.Duration) (driftReport, error) {
+	report := driftReport{GeneratedAt: time.Now(), Policy: policy, GracePeriod: grace.String()}
+	cutoff := report.GeneratedAt.Add(-grace)
+	s3Svc := s3.New(awsSession)
+
+	objects := map[string]*s3.Object{}
+	err := s3Svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3Name),
+		Prefix: aws.String(s3Prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			if !strings.HasSuffix(key, "/") {
+				objects[strings.TrimPrefix(key, s3Prefix)] = object
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return report, fmt.Errorf("listing bucket: %w", err)
+	}
+
+	images, err := getAllImages(ctx)
+	if err != nil {
+		return report, fmt.Errorf("reading table: %w", err)
+	}
+	report.Objects = len(objects)
+	report.Rows = len(images)
+	findDrift(&report, objects, images, cutoff)
+
+	if policy != repairNone {
+		report.Repairs = repairDrift(ctx, s3Svc, report, policy)
+	}
+	return report, nil
+}
+
+// findDrift adds to report the objects, keyed by image name, and the rows
+// that disagree, skipping the ones changed after cutoff.
+func findDrift(report *driftReport, objects map[string]*s3.Object, images []Image, cutoff time.Time) {
+	skip := func(name, reason string) {
+		report.Skipped = append(report.Skipped, skippedImage{Name: name, Reason: reason})
+	}
+	rows := map[string]bool{}
+	for _, image := range images {
+		rows[image.Name] = true
+		recentRow := image.LastUpdate.After(cutoff)
+		object, ok := objects[image.Name]
+		if !ok {
+			if recentRow {
+				skip(image.Name, "recent_row")
+				continue
+			}
+			report.DanglingRows = append(report.DanglingRows, danglingRow{
+				ID:         image.ID,
+				Name:       image.Name,
+				Size:       image.Size,
+				LastUpdate: image.LastUpdate,
+			})
+			continue
+		}
+		size := aws.Int64Value(object.Size)
+		if size == image.Size {
+			continue
+		}
+		switch {
+		case recentRow:
+			skip(image.Name, "recent_row")
+		case aws.TimeValue(object.LastModified).After(cutoff):
+			skip(image.Name, "recent_object")
+		default:
+			report.SizeMismatches = append(report.SizeMismatches, sizeMismatch{
+				Name:       image.Name,
+				ObjectSize: size,
+				RowSize:    image.Size,
+			})
+		}
+	}
+	for name, object := range objects {
+		if rows[name] {
+			continue
+		}
+		if aws.TimeValue(object.LastModified).After(cutoff) {
+			skip(name, "recent_object")
+			continue
+		}
+		report.OrphanObjects = append(report.OrphanObjects, orphanObject{
+			Key:          aws.StringValue(object.Key),
+			Size:         aws.Int64Value(object.Size),
+			LastModified: aws.TimeValue(object.LastModified),
+		})
+	}
+}
+
+func repairDrift(ctx context.Context, s3Svc *s3.S3, report driftReport, policy string) []repairAction {
+	var repairs []repairAction
+	record := func(action, name string, err error) {
+		repair := repairAction{Action: action, Name: name}
+		if err != nil {
+			slog.ErrorContext(ctx, "Error repairing drift", "name", name, "action", action, "error", err)
+			repair.Error = err.Error()
+		}
+		repairs = append(repairs, repair)
+	}
+
+	for _, orphan := range report.OrphanObjects {
+		name := strings.TrimPrefix(orphan.Key, s3Prefix)
+		if policy == repairFromBucket {
+			image, err := headImage(ctx, s3Svc, orphan.Key)
+			if err == nil {
+				_, err = upsertImage(ctx, db, image, false)
+			}
+			record("import_object", name, err)
+			continue
+		}
+		var err error
+		if reason, failed := deleteObjects(ctx, s3Svc, []string{name})[name]; failed {
+			err = fmt.Errorf("%s", reason)
+		}
+		record("delete_object", name, err)
+	}
+
+	if policy == repairFromBucket {
+		for _, row := range report.DanglingRows {
+			_, err := deleteImageByName(ctx, row.Name)
+			record("delete_row", row.Name, err)
+		}
+	}
+
+	for _, mismatch := range report.SizeMismatches {
+		image, err := headImage(ctx, s3Svc, objectKey(mismatch.Name))
+		if err == nil {
+			_, err = upsertImage(ctx, db, image, false)
+		}
+		record("update_row", mismatch.Name, err)
+	}
+	return repairs
+}
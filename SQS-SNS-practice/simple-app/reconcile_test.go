@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func listedObject(key string, size int64, modified time.Time) *s3.Object {
+	return &s3.Object{Key: aws.String(key), Size: aws.Int64(size), LastModified: aws.Time(modified)}
+}
+
+func TestFindDrift(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-24 * time.Hour)
+	cutoff := now.Add(-time.Hour)
+
+	objects := map[string]*s3.Object{
+		"same.png":   listedObject("image/same.png", 100, old),
+		"orphan.png": listedObject("image/orphan.png", 300, old),
+		"grown.png":  listedObject("image/grown.png", 900, old),
+	}
+	images := []Image{
+		{ID: 1, Name: "same.png", Size: 100, LastUpdate: old},
+		{ID: 2, Name: "gone.png", Size: 200, LastUpdate: old},
+		{ID: 3, Name: "grown.png", Size: 400, LastUpdate: old},
+	}
+
+	var report driftReport
+	findDrift(&report, objects, images, cutoff)
+
+	if len(report.OrphanObjects) != 1 || report.OrphanObjects[0].Key != "image/orphan.png" || report.OrphanObjects[0].Size != 300 {
+		t.Errorf("OrphanObjects = %+v, want image/orphan.png", report.OrphanObjects)
+	}
+	if len(report.DanglingRows) != 1 || report.DanglingRows[0].ID != 2 {
+		t.Errorf("DanglingRows = %+v, want gone.png", report.DanglingRows)
+	}
+	want := sizeMismatch{Name: "grown.png", ObjectSize: 900, RowSize: 400}
+	if len(report.SizeMismatches) != 1 || report.SizeMismatches[0] != want {
+		t.Errorf("SizeMismatches = %+v, want %+v", report.SizeMismatches, want)
+	}
+	if len(report.Skipped) != 0 {
+		t.Errorf("Skipped = %+v, want none", report.Skipped)
+	}
+}
+
+func TestFindDriftSkipsChangesInFlight(t *testing.T) {
+	now := time.Now()
+	old, recent := now.Add(-24*time.Hour), now.Add(-time.Minute)
+	cutoff := now.Add(-time.Hour)
+
+	// An upload that wrote its object but not yet its row, a delete that
+	// removed the object but not yet the row, and an overwrite in progress
+	objects := map[string]*s3.Object{
+		"uploading.png":   listedObject("image/uploading.png", 10, recent),
+		"overwritten.png": listedObject("image/overwritten.png", 20, recent),
+	}
+	images := []Image{
+		{Name: "deleting.png", Size: 30, LastUpdate: recent},
+		{Name: "overwritten.png", Size: 5, LastUpdate: old},
+	}
+
+	var report driftReport
+	findDrift(&report, objects, images, cutoff)
+
+	if n := len(report.OrphanObjects) + len(report.DanglingRows) + len(report.SizeMismatches); n != 0 {
+		t.Errorf("reported %d drifts for changes in flight: %+v", n, report)
+	}
+	reasons := map[string]string{}
+	for _, skipped := range report.Skipped {
+		reasons[skipped.Name] = skipped.Reason
+	}
+	for name, reason := range map[string]string{
+		"uploading.png":   "recent_object",
+		"deleting.png":    "recent_row",
+		"overwritten.png": "recent_object",
+	} {
+		if reasons[name] != reason {
+			t.Errorf("%s skipped as %q, want %q", name, reasons[name], reason)
+		}
+	}
+}
+
+func TestRepairDriftDeletesDanglingRowsFromBucketPolicy(t *testing.T) {
+	table := &scriptedDB{exec: func(query string, args []driver.Value) (int64, error) {
+		if args[0] == "locked.png" {
+			return 0, errors.New("lock wait timeout exceeded")
+		}
+		return 1, nil
+	}}
+	useScriptedDB(t, table)
+	report := driftReport{DanglingRows: []danglingRow{{Name: "gone.png"}, {Name: "locked.png"}}}
+
+	repairs := repairDrift(context.Background(), nil, report, repairFromBucket)
+	if len(repairs) != 2 {
+		t.Fatalf("repairs = %+v, want 2", repairs)
+	}
+	if repairs[0] != (repairAction{Action: "delete_row", Name: "gone.png"}) {
+		t.Errorf("repairs[0] = %+v", repairs[0])
+	}
+	if repairs[1].Name != "locked.png" || repairs[1].Error == "" {
+		t.Errorf("repairs[1] = %+v, want the error of locked.png", repairs[1])
+	}
+
+	// The database is the reference under the other policy, its rows stay
+	if repairs := repairDrift(context.Background(), nil, report, repairFromDatabase); len(repairs) != 0 {
+		t.Errorf("database policy repairs = %+v, want none", repairs)
+	}
+	if deletes := table.ranMatching("DELETE"); len(deletes) != 2 {
+		t.Errorf("ran %d deletes, want 2", len(deletes))
+	}
+}
+
+func TestWriteDriftReport(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "drift.json")
+	report := driftReport{
+		Policy:       repairNone,
+		GracePeriod:  "15m0s",
+		DanglingRows: []danglingRow{{ID: 4, Name: "gone.png"}},
+	}
+	if err := writeDriftReport(report, output); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]json.RawMessage
+	if err := json.Unmarshal(written, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"generatedAt", "gracePeriod", "orphanObjects", "danglingRows", "sizeMismatches"} {
+		if _, ok := decoded[key]; !ok {
+			t.Errorf("report is missing %q:\n%s", key, written)
+		}
+	}
+}
+
+func TestValidateRepairPolicy(t *testing.T) {
+	for _, policy := range []string{repairNone, repairFromBucket, repairFromDatabase} {
+		if err := validateRepairPolicy(policy); err != nil {
+			t.Errorf("validateRepairPolicy(%q) = %v", policy, err)
+		}
+	}
+	if err := validateRepairPolicy("s3"); err == nil {
+		t.Error("validateRepairPolicy(\"s3\") accepted an unknown policy")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// defaultTemplates are the notification templates and message catalogs
+// built into the binary. Files in NOTIFICATION_TEMPLATE_DIR replace them.
+//
+//go:embed templates/*.tmpl locales/*.json
+var defaultTemplates embed.FS
+
+// defaultLocale is used for the messages missing from the selected locale.
+const defaultLocale = "en"
+
+// localePattern matches locale names such as "en" or "pt-BR".
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}([_-][A-Za-z0-9]{2,8})*$`)
+
+// notification is a digest rendered for every kind of subscriber.
+type notification struct {
+	Subject string
+	Text    string
+	HTML    string
+	JSON    []byte
+}
+
+// digestMessage is the body sent to subscribers that read JSON. It carries
+// the digest rendered in HTML, for the ones that mail it on, as SNS only sends
+// plain text emails.
+type digestMessage struct {
+	Type   string          `json:"type"`
+	From   time.Time       `json:"from"`
+	To     time.Time       `json:"to"`
+	Events []eventEnvelope `json:"events"`
+	HTML   string          `json:"html"`
+}
+
+// translator is the localization hook of the templates, called through the
+// "t" template function with a message key and its arguments.
+type translator interface {
+	Translate(key string, args ...interface{}) string
+}
+
+// catalogTranslator formats the messages of a JSON catalog, mapping keys to
+// fmt formats, falling back to the default locale and then to the key.
+type catalogTranslator struct {
+	messages map[string]string
+	fallback map[string]string
+}
+
+func (c catalogTranslator) Translate(key string, args ...interface{}) string {
+	format, ok := c.messages[key]
+	if !ok {
+		format, ok = c.fallback[key]
+	}
+	if !ok {
+		return key
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// notificationRenderer renders digests with the text and HTML templates:
+// subject.txt.tmpl, digest.txt.tmpl and digest.html.tmpl, which include one
+// template per event type, e.g. {{template "image.uploaded" .}}.
+type notificationRenderer struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// renderer renders the notifications sent by the application.
+var renderer *notificationRenderer
+
+// newNotificationRenderer loads the templates and the message catalog of the
+// given locale, from NOTIFICATION_TEMPLATE_DIR when set and otherwise from
+// the ones built in.
+func newNotificationRenderer(locale string) (*notificationRenderer, error) {
+	dir := getEnv("NOTIFICATION_TEMPLATE_DIR", "")
+	fallback, err := loadCatalog(dir, defaultLocale)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := loadCatalog(dir, locale)
+	if err != nil {
+		return nil, err
+	}
+	return newRendererWithTranslator(dir, catalogTranslator{messages: messages, fallback: fallback})
+}
+
+func newRendererWithTranslator(dir string, t translator) (*notificationRenderer, error) {
+	funcs := map[string]interface{}{
+		"t": t.Translate,
+		"date": func(date time.Time) string {
+			return date.Format(timeLayout)
+		},
+	}
+
+	text, err := texttemplate.New("").Funcs(funcs).ParseFS(defaultTemplates, "templates/*.txt.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	html, err := htmltemplate.New("").Funcs(funcs).ParseFS(defaultTemplates, "templates/*.html.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	// Templates of the same name in the directory redefine the built-in ones
+	if dir != "" {
+		if files, _ := filepath.Glob(filepath.Join(dir, "*.txt.tmpl")); len(files) > 0 {
+			if text, err = text.ParseFiles(files...); err != nil {
+				return nil, err
+			}
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "*.html.tmpl")); len(files) > 0 {
+			if html, err = html.ParseFiles(files...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &notificationRenderer{text: text, html: html}, nil
+}
+
+// loadCatalog reads locales/<locale>.json from dir, or from the built-in
+// catalogs when dir does not have it.
+func loadCatalog(dir, locale string) (map[string]string, error) {
+	if !localePattern.MatchString(locale) {
+		return nil, fmt.Errorf("invalid locale '%s'", locale)
+	}
+	var body []byte
+	err := fs.ErrNotExist
+	if dir != "" {
+		body, err = os.ReadFile(filepath.Join(dir, "locales", locale+".json"))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		body, err = defaultTemplates.ReadFile("locales/" + locale + ".json")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading message catalog '%s': %w", locale, err)
+	}
+
+	messages := map[string]string{}
+	if err := json.Unmarshal(body, &messages); err != nil {
+		return nil, fmt.Errorf("decoding message catalog '%s': %w", locale, err)
+	}
+	return messages, nil
+}
+
+func (r *notificationRenderer) render(d digest) (notification, error) {
+	var n notification
+	var subject, text, html bytes.Buffer
+	if err := r.text.ExecuteTemplate(&subject, "subject.txt.tmpl", d); err != nil {
+		return n, err
+	}
+	if err := r.text.ExecuteTemplate(&text, "digest.txt.tmpl", d); err != nil {
+		return n, err
+	}
+	if err := r.html.ExecuteTemplate(&html, "digest.html.tmpl", d); err != nil {
+		return n, err
+	}
+	body, err := json.Marshal(digestMessage{Type: "image.digest", From: d.From, To: d.To, Events: d.Events, HTML: html.String()})
+	if err != nil {
+		return n, err
+	}
+
+	n.Subject = subject.String()
+	n.Text = text.String()
+	n.HTML = html.String()
+	n.JSON = body
+	return n, nil
+}
+
+// snsMessage builds the message for a publish with MessageStructure "json":
+// readable text for email and SMS, and JSON for every other protocol, which
+// gets the default body. Each body counts against the 256KB SNS allows for
+// the whole message, so no body is repeated.
+func (n notification) snsMessage() (string, error) {
+	body, err := json.Marshal(map[string]string{
+		"default": string(n.JSON),
+		"email":   n.Text,
+		"sms":     n.Subject,
+	})
+	return string(body), err
+}
+
+// maxSNSSubjectLength is the limit SNS puts on the subject of a message.
+const maxSNSSubjectLength = 100
+
+// asciiFolding spells the accented letters of the bundled locales in ASCII.
+var asciiFolding = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ä", "a", "ã", "a", "å", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "ö", "o", "õ", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ñ", "n", "ç", "c", "ß", "ss",
+	"Á", "A", "À", "A", "Â", "A", "Ä", "A", "Ã", "A", "Å", "A",
+	"É", "E", "È", "E", "Ê", "E", "Ë", "E",
+	"Í", "I", "Ì", "I", "Î", "I", "Ï", "I",
+	"Ó", "O", "Ò", "O", "Ô", "O", "Ö", "O", "Õ", "O",
+	"Ú", "U", "Ù", "U", "Û", "U", "Ü", "U",
+	"Ñ", "N", "Ç", "C",
+	"¡", "", "¿", "",
+)
+
+// snsSubject returns the subject as SNS accepts it: printable ASCII on a
+// single line, shorter than 100 characters. Accented letters lose their
+// accents and the other characters outside ASCII are dropped, so a translated
+// subject never fails the publish.
+func (n notification) snsSubject() string {
+	folded := asciiFolding.Replace(n.Subject)
+	var b strings.Builder
+	for _, c := range folded {
+		switch {
+		case c == '\n' || c == '\r' || c == '\t':
+			c = ' '
+		case c < ' ' || c > '~':
+			continue
+		}
+		b.WriteRune(c)
+	}
+	subject := strings.Join(strings.Fields(b.String()), " ")
+	if len(subject) >= maxSNSSubjectLength {
+		subject = strings.TrimSpace(subject[:maxSNSSubjectLength-1])
+	}
+	return subject
+}
+
+// previewNotification renders a digest of the pending events without sending
+// it, in the format given by the format query parameter: text, html or json.
+func previewNotification(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	preview := renderer
+	if locale := query.Get("locale"); locale != "" {
+		var err error
+		if preview, err = newNotificationRenderer(locale); err != nil {
+			http.Error(w, "Unknown locale: "+locale, http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := getPendingEvents(r.Context(), 50)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading pending notifications from RDS", "error", err)
+		http.Error(w, "Error reading pending notifications from RDS", http.StatusInternalServerError)
+		return
+	}
+	d := digest{From: time.Now(), To: time.Now()}
+	if len(events) > 0 {
+		d = newDigest(events)
+	}
+	n, err := preview.render(d)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error rendering notification", "error", err)
+		http.Error(w, "Error rendering notification", http.StatusInternalServerError)
+		return
+	}
+
+	switch query.Get("format") {
+	case "", "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s\n\n%s", n.Subject, n.Text)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(n.HTML))
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(n.JSON)
+	default:
+		http.Error(w, "format must be one of: text, html, json", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSNSSubject(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		want    string
+	}{
+		{"ASCII", "Image activity: 2 uploaded, 1 deleted", "Image activity: 2 uploaded, 1 deleted"},
+		{"accents", "Actividad de imágenes: 2 subidas, 1 eliminadas", "Actividad de imagenes: 2 subidas, 1 eliminadas"},
+		{"punctuation", "¿Nuevas imágenes? ¡Sí!", "Nuevas imagenes? Si!"},
+		{"other scripts dropped", "画像 activity ✓", "activity"},
+		{"line breaks", "Image\nactivity\r\n\tnow", "Image activity now"},
+		{"control characters", "Image\x00 activity\x7f", "Image activity"},
+		{"truncated", strings.Repeat("a", 150), strings.Repeat("a", 99)},
+		{"truncated on a space", strings.Repeat("a", 98) + " bc", strings.Repeat("a", 98)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := notification{Subject: tt.subject}.snsSubject()
+			if got != tt.want {
+				t.Errorf("snsSubject() = %q, want %q", got, tt.want)
+			}
+			if len(got) >= maxSNSSubjectLength {
+				t.Errorf("snsSubject() is %d characters long", len(got))
+			}
+		})
+	}
+}
+
+func TestSNSMessageBodies(t *testing.T) {
+	r, err := newNotificationRenderer(defaultLocale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	n, err := r.render(digest{
+		Uploaded: []eventImage{{Name: "<cat>.png", Size: 2048}},
+		From:     now,
+		To:       now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := n.snsMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bodies map[string]string
+	if err := json.Unmarshal([]byte(message), &bodies); err != nil {
+		t.Fatalf("message is not a JSON object: %v", err)
+	}
+	if len(bodies) != 3 {
+		t.Errorf("message has %d bodies, want default, email and sms", len(bodies))
+	}
+	if bodies["email"] != n.Text || bodies["sms"] != n.Subject {
+		t.Errorf("email and sms bodies are not the text and the subject")
+	}
+
+	var body digestMessage
+	if err := json.Unmarshal([]byte(bodies["default"]), &body); err != nil {
+		t.Fatalf("default body is not a digest message: %v", err)
+	}
+	if !strings.Contains(body.HTML, "&lt;cat&gt;.png") {
+		t.Errorf("default body has no escaped HTML digest: %q", body.HTML)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// scriptedDB is a database/sql driver answering the statements it is sent
+// with the functions of the test, so the code running SQL can be tested
+// without MySQL. Statements it has no answer for fail.
+type scriptedDB struct {
+	// query answers SELECT statements.
+	query func(query string, args []driver.Value) (*scriptedRows, error)
+	// exec answers the other statements with the number of rows affected.
+	exec func(query string, args []driver.Value) (int64, error)
+
+	mu           sync.Mutex
+	statements   []string
+	lastInsertID int64
+}
+
+// scriptedRows is the result of a query: one value per column in each row.
+type scriptedRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+// useScriptedDB makes s the database of the application, with the images in
+// the images table, until the test ends.
+func useScriptedDB(t *testing.T, s *scriptedDB) {
+	t.Helper()
+	previousDB, previousTable := db, dbTableName
+	db, dbTableName = sql.OpenDB(s), "images"
+	t.Cleanup(func() {
+		db.Close()
+		db, dbTableName = previousDB, previousTable
+	})
+}
+
+// ran returns the statements run so far, transactions included as BEGIN,
+// COMMIT and ROLLBACK.
+func (s *scriptedDB) ran() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.statements...)
+}
+
+// ranMatching returns the statements run so far containing substr.
+func (s *scriptedDB) ranMatching(substr string) []string {
+	var matching []string
+	for _, statement := range s.ran() {
+		if strings.Contains(statement, substr) {
+			matching = append(matching, statement)
+		}
+	}
+	return matching
+}
+
+func (s *scriptedDB) record(statement string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statements = append(s.statements, statement)
+}
+
+func (s *scriptedDB) Connect(ctx context.Context) (driver.Conn, error) { return scriptedConn{s}, nil }
+func (s *scriptedDB) Driver() driver.Driver                            { return scriptedDriver{s} }
+
+type scriptedDriver struct{ s *scriptedDB }
+
+func (d scriptedDriver) Open(name string) (driver.Conn, error) { return scriptedConn{d.s}, nil }
+
+type scriptedConn struct{ s *scriptedDB }
+
+func (c scriptedConn) Prepare(query string) (driver.Stmt, error) {
+	return scriptedStmt{s: c.s, query: query}, nil
+}
+
+func (c scriptedConn) Close() error { return nil }
+
+func (c scriptedConn) Begin() (driver.Tx, error) {
+	c.s.record("BEGIN")
+	return scriptedTx{c.s}, nil
+}
+
+type scriptedTx struct{ s *scriptedDB }
+
+func (tx scriptedTx) Commit() error {
+	tx.s.record("COMMIT")
+	return nil
+}
+
+func (tx scriptedTx) Rollback() error {
+	tx.s.record("ROLLBACK")
+	return nil
+}
+
+type scriptedStmt struct {
+	s     *scriptedDB
+	query string
+}
+
+func (st scriptedStmt) Close() error  { return nil }
+func (st scriptedStmt) NumInput() int { return -1 }
+
+func (st scriptedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	st.s.record(st.query)
+	if st.s.exec == nil {
+		return nil, errors.New("scriptedDB: no exec for " + st.query)
+	}
+	affected, err := st.s.exec(st.query, args)
+	if err != nil {
+		return nil, err
+	}
+	st.s.mu.Lock()
+	defer st.s.mu.Unlock()
+	if strings.HasPrefix(st.query, "INSERT") {
+		st.s.lastInsertID++
+	}
+	return scriptedResult{lastInsertID: st.s.lastInsertID, affected: affected}, nil
+}
+
+// scriptedResult numbers the inserted rows from 1, in the order they were
+// inserted.
+type scriptedResult struct {
+	lastInsertID int64
+	affected     int64
+}
+
+func (r scriptedResult) LastInsertId() (int64, error) { return r.lastInsertID, nil }
+func (r scriptedResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+func (st scriptedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	st.s.record(st.query)
+	if st.s.query == nil {
+		return nil, errors.New("scriptedDB: no query for " + st.query)
+	}
+	rows, err := st.s.query(st.query, args)
+	if err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		rows = &scriptedRows{}
+	}
+	return &scriptedCursor{rows: rows}, nil
+}
+
+type scriptedCursor struct {
+	rows *scriptedRows
+	next int
+}
+
+func (c *scriptedCursor) Columns() []string { return c.rows.columns }
+func (c *scriptedCursor) Close() error      { return nil }
+
+func (c *scriptedCursor) Next(dest []driver.Value) error {
+	if c.next == len(c.rows.values) {
+		return io.EOF
+	}
+	copy(dest, c.rows.values[c.next])
+	c.next++
+	return nil
+}
+
+// imageRows returns images as the rows of a query of imageColumns.
+func imageRows(images ...Image) *scriptedRows {
+	rows := &scriptedRows{columns: strings.Split(imageColumns, ", ")}
+	for _, image := range images {
+		rows.values = append(rows.values, []driver.Value{
+			image.ID, image.Name, image.Size, image.Extension, image.Tags,
+			image.Album, image.ContentType, image.LastUpdate.Format(timeLayout),
+		})
+	}
+	return rows
+}
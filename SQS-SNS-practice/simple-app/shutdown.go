@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// workerGroup runs the background workers of the web server with the same
+// context, until it is done or the group is stopped.
+type workerGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkerGroup(ctx context.Context) *workerGroup {
+	ctx, cancel := context.WithCancel(ctx)
+	return &workerGroup{ctx: ctx, cancel: cancel}
+}
+
+// start runs worker in the background until the context of the group is
+// done. Workers then stop taking new work, and return once they have
+// finished what they had started.
+func (g *workerGroup) start(name string, worker func(ctx context.Context)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		worker(g.ctx)
+		slog.Info("Background worker stopped", "worker", name)
+	}()
+}
+
+// stop cancels the context of the workers and waits for them to return, or
+// for ctx to be done, and reports whether they all returned.
+func (g *workerGroup) stop(ctx context.Context) bool {
+	g.cancel()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// serve serves handler on addr until ctx is done, typically on SIGINT or
+// SIGTERM, or the server fails. It then stops accepting connections and the
+// workers, and waits within SHUTDOWN_TIMEOUT (default 25s) overall for the
+// requests in flight and the workers to finish.
+func serve(ctx context.Context, addr string, handler http.Handler, workers *workerGroup) error {
+	server := &http.Server{Addr: addr, Handler: handler}
+	// The live feed streams never end by themselves, nor are the hijacked
+	// WebSocket connections waited for: end them so clients reconnect elsewhere
+	server.RegisterOnShutdown(liveFeed.close)
+
+	failed := make(chan error, 1)
+	go func() {
+		failed <- server.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-failed:
+	case <-ctx.Done():
+		slog.Info("Shutting down")
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), getEnvDuration("SHUTDOWN_TIMEOUT", 25*time.Second))
+	defer cancel()
+	if shutdownErr := server.Shutdown(drainCtx); shutdownErr != nil {
+		slog.Warn("Requests still in flight after the shutdown timeout", "error", shutdownErr)
+	}
+	if !workers.stop(drainCtx) {
+		slog.Warn("Background workers still running after the shutdown timeout")
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestWorkerGroupStopWaitsForWorkToFinish(t *testing.T) {
+	workers := newWorkerGroup(context.Background())
+	var finished atomic.Int32
+	for _, name := range []string{"sqs-consumer", "digest-notifier", "webhook-dispatcher"} {
+		workers.start(name, func(ctx context.Context) {
+			<-ctx.Done()
+			// Finish the work in flight
+			time.Sleep(20 * time.Millisecond)
+			finished.Add(1)
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !workers.stop(ctx) {
+		t.Fatal("stop() gave up on workers that return")
+	}
+	if finished.Load() != 3 {
+		t.Errorf("stop() returned with %d of 3 workers finished", finished.Load())
+	}
+}
+
+func TestWorkerGroupStopGivesUpAfterTimeout(t *testing.T) {
+	workers := newWorkerGroup(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+	workers.start("stuck", func(ctx context.Context) { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if workers.stop(ctx) {
+		t.Error("stop() reported a stuck worker as returned")
+	}
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestServeFinishesRequestsInFlight(t *testing.T) {
+	previousFeed := liveFeed
+	liveFeed = newEventFeed(10)
+	t.Cleanup(func() { liveFeed = previousFeed })
+	t.Setenv("SHUTDOWN_TIMEOUT", "5s")
+
+	addr := freeAddr(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "uploaded")
+	})
+	var workerStopped atomic.Bool
+	ctx, stop := context.WithCancel(context.Background())
+	workers := newWorkerGroup(ctx)
+	workers.start("sqs-consumer", func(ctx context.Context) {
+		<-ctx.Done()
+		workerStopped.Store(true)
+	})
+
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, addr, handler, workers) }()
+
+	var body []byte
+	var status int
+	responded := make(chan struct{})
+	go func() {
+		defer close(responded)
+		var resp *http.Response
+		var err error
+		for attempt := 0; attempt < 100; attempt++ {
+			if resp, err = http.Post("http://"+addr+"/image", "image/png", nil); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		status = resp.StatusCode
+		body, _ = io.ReadAll(resp.Body)
+	}()
+
+	<-started
+	// SIGTERM arrives while the upload is being handled
+	stop()
+	select {
+	case err := <-served:
+		t.Fatalf("serve() returned %v before the request in flight finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-responded
+	if status != http.StatusOK || string(body) != "uploaded" {
+		t.Errorf("request in flight answered %d %q", status, body)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve() = %v", err)
+	}
+	if !workerStopped.Load() {
+		t.Error("serve() returned before the workers stopped")
+	}
+}
+
+func TestServeReturnsListenError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	previousFeed := liveFeed
+	liveFeed = newEventFeed(10)
+	t.Cleanup(func() { liveFeed = previousFeed })
+
+	var workerStopped atomic.Bool
+	workers := newWorkerGroup(context.Background())
+	workers.start("digest-notifier", func(ctx context.Context) {
+		<-ctx.Done()
+		workerStopped.Store(true)
+	})
+
+	if err := serve(context.Background(), listener.Addr().String(), http.NotFoundHandler(), workers); err == nil {
+		t.Error("serve() on an address in use succeeded")
+	}
+	if !workerStopped.Load() {
+		t.Error("the workers kept running after the server failed")
+	}
+}
+
+func TestConsumerFinishesHandlersAfterCancel(t *testing.T) {
+	client := newFakeSQS(queuedMessage("in-flight", 1))
+	handling, release := make(chan struct{}), make(chan struct{})
+	var handlerCtxDone atomic.Bool
+	consumer := testConsumer(client, func(ctx context.Context, msg *sqs.Message) error {
+		close(handling)
+		<-release
+		handlerCtxDone.Store(ctx.Err() != nil)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		consumer.run(ctx)
+		close(stopped)
+	}()
+
+	<-handling
+	cancel()
+	select {
+	case <-stopped:
+		t.Fatal("run() returned with a handler in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-stopped
+	if handlerCtxDone.Load() {
+		t.Error("the handler was cancelled with the consumer")
+	}
+	if client.deletedCount() != 1 {
+		t.Errorf("deleted %d messages, want the one handled during shutdown", client.deletedCount())
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// openDB opens the MySQL database at dsn through instrumentedConnector, so every
+// statement is observed with observeSQL whichever part of the application
+// runs it, in the trace of the context it is run with.
+func openDB(dsn string) *sql.DB {
+	return sql.OpenDB(instrumentedConnector{dsn: dsn, driver: mysql.MySQLDriver{}})
+}
+
+type instrumentedConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedConn{conn}, nil
+}
+
+func (c instrumentedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// observe runs query through observeSQL, unless the driver skipped it: the
+// MySQL driver does so for statements with arguments, which database/sql
+// then prepares and runs through instrumentedStmt.
+func observe(ctx context.Context, query string, run func() error) error {
+	done := observeSQL(ctx, query)
+	err := run()
+	if !errors.Is(err, driver.ErrSkip) {
+		done(err)
+	}
+	return err
+}
+
+// instrumentedConn observes the statements run on a connection of the
+// driver. It implements the optional interfaces of the MySQL connections, so
+// database/sql uses them as it would without it.
+type instrumentedConn struct {
+	driver.Conn
+}
+
+func (c instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedStmt{Stmt: stmt, query: query}, nil
+}
+
+func (c instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	err := observe(ctx, "BEGIN", func() (err error) {
+		if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+			tx, err = beginner.BeginTx(ctx, opts)
+		} else {
+			tx, err = c.Conn.Begin()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedTx{Tx: tx, ctx: ctx}, nil
+}
+
+func (c instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	var result driver.Result
+	err := observe(ctx, query, func() (err error) {
+		result, err = execer.ExecContext(ctx, query, args)
+		return err
+	})
+	return result, err
+}
+
+func (c instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	var rows driver.Rows
+	err := observe(ctx, query, func() (err error) {
+		rows, err = queryer.QueryContext(ctx, query, args)
+		return err
+	})
+	return rows, err
+}
+
+func (c instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c instrumentedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c instrumentedConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// instrumentedStmt observes each run of a prepared statement.
+type instrumentedStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var result driver.Result
+	err := observe(ctx, s.query, func() (err error) {
+		if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+			result, err = execer.ExecContext(ctx, args)
+			return err
+		}
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return err
+		}
+		result, err = s.Stmt.Exec(values)
+		return err
+	})
+	return result, err
+}
+
+func (s instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	err := observe(ctx, s.query, func() (err error) {
+		if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+			rows, err = queryer.QueryContext(ctx, args)
+			return err
+		}
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return err
+		}
+		rows, err = s.Stmt.Query(values)
+		return err
+	})
+	return rows, err
+}
+
+func (s instrumentedStmt) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("the driver does not support named parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+// instrumentedTx observes the end of a transaction, in the trace of the
+// context it was begun with.
+type instrumentedTx struct {
+	driver.Tx
+	ctx context.Context
+}
+
+func (t instrumentedTx) Commit() error {
+	return observe(t.ctx, "COMMIT", t.Tx.Commit)
+}
+
+func (t instrumentedTx) Rollback() error {
+	return observe(t.ctx, "ROLLBACK", t.Tx.Rollback)
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// pendingConfirmation is the subscription ARN SNS reports until the owner of
+// the endpoint confirms the subscription.
+const pendingConfirmation = "PendingConfirmation"
+
+// Message attributes of the digests that subscription filter policies can match.
+const (
+	extensionsAttribute = "extensions"
+	eventTypesAttribute = "event_types"
+	// recipientAttribute is the email address a copy of a digest is for, or
+	// broadcastRecipient on the copy shared by every other subscriber. Every
+	// subscription filters on it, so each gets a single copy.
+	recipientAttribute = "recipient"
+)
+
+// broadcastRecipient is the recipient of the copy of a digest without an
+// unsubscribe link.
+const broadcastRecipient = "*"
+
+var (
+	sqsARNPattern      = regexp.MustCompile(`^arn:aws[a-z-]*:sqs:[a-z0-9-]+:\d{12}:[A-Za-z0-9_-]{1,80}(\.fifo)?$`)
+	phoneNumberPattern = regexp.MustCompile(`^\+[1-9]\d{1,14}$`)
+)
+
+// subscriptionRequest subscribes an endpoint to the topic. Extensions and
+// EventTypes, when given, become the filter policy of the subscription, so
+// only the digests including such images or events are delivered.
+type subscriptionRequest struct {
+	Protocol   string   `json:"protocol"`
+	Endpoint   string   `json:"endpoint"`
+	Extensions []string `json:"extensions"`
+	EventTypes []string `json:"eventTypes"`
+}
+
+type subscriptionInfo struct {
+	SubscriptionARN string `json:"subscriptionARN,omitempty"`
+	Protocol        string `json:"protocol"`
+	Endpoint        string `json:"endpoint"`
+	Status          string `json:"status"`
+}
+
+func createSubscription(w http.ResponseWriter, r *http.Request) {
+	var request subscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Please provide a JSON body such as {\"protocol\": \"email\", \"endpoint\": \"me@example.com\"}", http.StatusBadRequest)
+		return
+	}
+	if err := validateEndpoint(request.Protocol, request.Endpoint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, eventType := range request.EventTypes {
+		if eventType != eventImageUploaded && eventType != eventImageDeleted {
+			http.Error(w, "Unknown event type: "+eventType, http.StatusBadRequest)
+			return
+		}
+	}
+
+	input := &sns.SubscribeInput{
+		Protocol:              aws.String(request.Protocol),
+		Endpoint:              aws.String(request.Endpoint),
+		TopicArn:              aws.String(topicARN),
+		ReturnSubscriptionArn: aws.Bool(true),
+	}
+	input.Attributes = map[string]*string{"FilterPolicy": aws.String(filterPolicy(request))}
+
+	snsSvc := sns.New(awsSession)
+	subResp, err := snsSvc.SubscribeWithContext(r.Context(), input)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error subscribing endpoint to topic",
+			"protocol", request.Protocol, "endpoint", request.Endpoint, "error", err)
+		http.Error(w, "Error subscribing endpoint to topic: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	subscriptionIndex.set(request.Protocol, request.Endpoint, aws.StringValue(subResp.SubscriptionArn))
+
+	info := newSubscriptionInfo(aws.StringValue(subResp.SubscriptionArn), request.Protocol, request.Endpoint)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+func listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subscriptions := []subscriptionInfo{}
+	arns := map[string]string{}
+	err := sns.New(awsSession).ListSubscriptionsByTopicPagesWithContext(r.Context(), &sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(topicARN),
+	}, func(page *sns.ListSubscriptionsByTopicOutput, lastPage bool) bool {
+		for _, sub := range page.Subscriptions {
+			arns[endpointKey(aws.StringValue(sub.Protocol), aws.StringValue(sub.Endpoint))] = aws.StringValue(sub.SubscriptionArn)
+			subscriptions = append(subscriptions, newSubscriptionInfo(
+				aws.StringValue(sub.SubscriptionArn),
+				aws.StringValue(sub.Protocol),
+				aws.StringValue(sub.Endpoint),
+			))
+		}
+		return true
+	})
+	if err != nil {
+		http.Error(w, "Error listing subscriptions for topic: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Having walked every subscription, refresh the index with them
+	subscriptionIndex.replace(arns)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// deleteSubscription removes the subscription of any endpoint, given a JSON
+// body such as {"protocol": "email", "endpoint": "me@example.com"}. It is an
+// admin route: recipients unsubscribe themselves with a token, through
+// unsubscription.
+func deleteSubscription(w http.ResponseWriter, r *http.Request) {
+	var request subscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Protocol == "" || request.Endpoint == "" {
+		http.Error(w, "Please provide a JSON body such as {\"protocol\": \"email\", \"endpoint\": \"me@example.com\"}", http.StatusBadRequest)
+		return
+	}
+	unsubscribeEndpoint(r.Context(), w, request.Protocol, request.Endpoint)
+}
+
+// unsubscribeEndpoint removes the subscription of the endpoint and writes the
+// outcome to w.
+func unsubscribeEndpoint(ctx context.Context, w http.ResponseWriter, protocol, endpoint string) {
+	snsSvc := sns.New(awsSession)
+	subARN, err := findSubscriptionARN(ctx, snsSvc, protocol, endpoint)
+	if err != nil {
+		http.Error(w, "Error listing subscriptions for topic: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if subARN == "" {
+		http.Error(w, fmt.Sprintf("%s endpoint is not subscribed to the topic", protocol), http.StatusBadRequest)
+		return
+	}
+	if subARN == pendingConfirmation {
+		// SNS cannot remove a subscription before it is confirmed, it expires after three days
+		http.Error(w, "The subscription is pending confirmation and cannot be removed yet", http.StatusConflict)
+		return
+	}
+
+	// Unsubscribe the endpoint from the SNS topic
+	_, err = snsSvc.UnsubscribeWithContext(ctx, &sns.UnsubscribeInput{
+		SubscriptionArn: aws.String(subARN),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == sns.ErrCodeNotFoundException {
+		// The index was stale, the subscription was removed elsewhere
+		subscriptionIndex.remove(protocol, endpoint)
+		http.Error(w, fmt.Sprintf("%s endpoint is not subscribed to the topic", protocol), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error unsubscribing endpoint from topic: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	subscriptionIndex.remove(protocol, endpoint)
+
+	// Return success message as JSON
+	resp := struct {
+		Message string `json:"message"`
+	}{
+		Message: fmt.Sprintf("%s endpoint unsubscribed successfully", protocol),
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// findSubscriptionARN returns the ARN of the subscription of the endpoint to
+// the topic, or "" when there is none. Confirmed subscriptions are answered
+// from the index, anything else walks the subscriptions of the topic.
+func findSubscriptionARN(ctx context.Context, snsSvc snsiface.SNSAPI, protocol, endpoint string) (string, error) {
+	if subARN := subscriptionIndex.lookup(protocol, endpoint); subARN != "" && subARN != pendingConfirmation {
+		return subARN, nil
+	}
+
+	var subARN string
+	err := snsSvc.ListSubscriptionsByTopicPagesWithContext(ctx, &sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(topicARN),
+	}, func(page *sns.ListSubscriptionsByTopicOutput, lastPage bool) bool {
+		for _, sub := range page.Subscriptions {
+			subscriptionIndex.set(aws.StringValue(sub.Protocol), aws.StringValue(sub.Endpoint), aws.StringValue(sub.SubscriptionArn))
+			if aws.StringValue(sub.Protocol) == protocol && aws.StringValue(sub.Endpoint) == endpoint {
+				subARN = aws.StringValue(sub.SubscriptionArn)
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	if subARN == "" {
+		subscriptionIndex.remove(protocol, endpoint)
+	}
+	return subARN, nil
+}
+
+// endpointIndex caches the subscription ARN of every endpoint subscribed to
+// the topic, so unsubscribing does not list every subscription each time.
+// Subscribing and unsubscribing through the API keep it up to date; changes
+// made elsewhere are picked up when a lookup misses or on a rebuild.
+type endpointIndex struct {
+	mu   sync.RWMutex
+	arns map[string]string
+}
+
+// subscriptionIndex is the index of the subscriptions to topicARN.
+var subscriptionIndex = &endpointIndex{arns: map[string]string{}}
+
+func endpointKey(protocol, endpoint string) string {
+	return protocol + ":" + endpoint
+}
+
+func (x *endpointIndex) lookup(protocol, endpoint string) string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.arns[endpointKey(protocol, endpoint)]
+}
+
+func (x *endpointIndex) set(protocol, endpoint, subARN string) {
+	if subARN == "" {
+		subARN = pendingConfirmation
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.arns[endpointKey(protocol, endpoint)] = subARN
+}
+
+func (x *endpointIndex) remove(protocol, endpoint string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.arns, endpointKey(protocol, endpoint))
+}
+
+// rebuild replaces the index with every subscription of the topic and
+// returns how many there are.
+func (x *endpointIndex) rebuild(ctx context.Context, snsSvc snsiface.SNSAPI) (int, error) {
+	arns := map[string]string{}
+	err := snsSvc.ListSubscriptionsByTopicPagesWithContext(ctx, &sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(topicARN),
+	}, func(page *sns.ListSubscriptionsByTopicOutput, lastPage bool) bool {
+		for _, sub := range page.Subscriptions {
+			arns[endpointKey(aws.StringValue(sub.Protocol), aws.StringValue(sub.Endpoint))] = aws.StringValue(sub.SubscriptionArn)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	x.replace(arns)
+	return len(arns), nil
+}
+
+// replace swaps the index for arns, keyed by endpointKey.
+func (x *endpointIndex) replace(arns map[string]string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.arns = arns
+}
+
+// reindexSubscriptions rebuilds the subscription index from SNS.
+func reindexSubscriptions(w http.ResponseWriter, r *http.Request) {
+	count, err := subscriptionIndex.rebuild(r.Context(), sns.New(awsSession))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error rebuilding the subscription index", "error", err)
+		http.Error(w, "Error listing subscriptions for topic: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Subscription index rebuilt", "subscriptions", count)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Subscriptions int `json:"subscriptions"`
+	}{count})
+}
+
+func newSubscriptionInfo(subARN, protocol, endpoint string) subscriptionInfo {
+	info := subscriptionInfo{
+		SubscriptionARN: subARN,
+		Protocol:        protocol,
+		Endpoint:        endpoint,
+		Status:          "confirmed",
+	}
+	if subARN == pendingConfirmation || subARN == "" {
+		info.SubscriptionARN = ""
+		info.Status = "pending"
+	}
+	return info
+}
+
+// validateEndpoint checks that endpoint is an address the protocol can deliver to.
+func validateEndpoint(protocol, endpoint string) error {
+	if endpoint == "" {
+		return fmt.Errorf("missing endpoint")
+	}
+	switch protocol {
+	case "email":
+		address, err := mail.ParseAddress(endpoint)
+		if err != nil || address.Address != endpoint {
+			return fmt.Errorf("endpoint must be an email address such as me@example.com")
+		}
+	case "https":
+		webhook, err := url.Parse(endpoint)
+		if err != nil || webhook.Scheme != "https" || webhook.Host == "" {
+			return fmt.Errorf("endpoint must be an https:// URL")
+		}
+	case "sqs":
+		if !sqsARNPattern.MatchString(endpoint) {
+			return fmt.Errorf("endpoint must be the ARN of an SQS queue")
+		}
+	case "sms":
+		if !phoneNumberPattern.MatchString(endpoint) {
+			return fmt.Errorf("endpoint must be a phone number in E.164 format such as +14155550100")
+		}
+	default:
+		return fmt.Errorf("protocol must be one of: email, https, sqs, sms")
+	}
+	return nil
+}
+
+// filterPolicy returns the SNS filter policy for the subscription: the copy
+// of the digests it receives, and the images or events it is limited to.
+func filterPolicy(request subscriptionRequest) string {
+	policy := map[string][]string{
+		recipientAttribute: {digestRecipient(request.Protocol, request.Endpoint)},
+	}
+	for _, extension := range request.Extensions {
+		policy[extensionsAttribute] = append(policy[extensionsAttribute], strings.ToLower(strings.TrimPrefix(extension, ".")))
+	}
+	if len(request.EventTypes) > 0 {
+		policy[eventTypesAttribute] = request.EventTypes
+	}
+	body, _ := json.Marshal(policy)
+	return string(body)
+}
+
+// digestRecipient returns the recipient of the copy of the digests the
+// endpoint receives: its own for an email address, the shared one otherwise.
+func digestRecipient(protocol, endpoint string) string {
+	if protocol == "email" {
+		return endpoint
+	}
+	return broadcastRecipient
+}
+
+// scopedSubscriptions holds the ARNs of the subscriptions known to filter on
+// recipientAttribute.
+var scopedSubscriptions sync.Map
+
+// digestRecipients returns the email addresses with a confirmed subscription,
+// which get a copy of each digest of their own. Subscriptions that do not
+// filter on the recipient yet, created before it existed or outside the API,
+// are made to, or they would receive every copy.
+func digestRecipients(ctx context.Context, snsSvc *sns.SNS) ([]string, error) {
+	var subscriptions []*sns.Subscription
+	err := snsSvc.ListSubscriptionsByTopicPagesWithContext(ctx, &sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(topicARN),
+	}, func(page *sns.ListSubscriptionsByTopicOutput, lastPage bool) bool {
+		subscriptions = append(subscriptions, page.Subscriptions...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var recipients []string
+	for _, sub := range subscriptions {
+		subARN := aws.StringValue(sub.SubscriptionArn)
+		protocol, endpoint := aws.StringValue(sub.Protocol), aws.StringValue(sub.Endpoint)
+		subscriptionIndex.set(protocol, endpoint, subARN)
+		if subARN == "" || subARN == pendingConfirmation {
+			continue
+		}
+		if err := scopeSubscription(ctx, snsSvc, subARN, digestRecipient(protocol, endpoint)); err != nil {
+			return nil, fmt.Errorf("scoping subscription %s: %w", subARN, err)
+		}
+		if protocol == "email" {
+			recipients = append(recipients, endpoint)
+		}
+	}
+	return recipients, nil
+}
+
+// scopeSubscription adds recipient to the filter policy of the subscription
+// unless it already filters on recipientAttribute.
+func scopeSubscription(ctx context.Context, snsSvc *sns.SNS, subARN, recipient string) error {
+	if _, ok := scopedSubscriptions.Load(subARN); ok {
+		return nil
+	}
+	attributes, err := snsSvc.GetSubscriptionAttributesWithContext(ctx, &sns.GetSubscriptionAttributesInput{
+		SubscriptionArn: aws.String(subARN),
+	})
+	if err != nil {
+		return err
+	}
+	policy := map[string]interface{}{}
+	if body := aws.StringValue(attributes.Attributes["FilterPolicy"]); body != "" {
+		if err := json.Unmarshal([]byte(body), &policy); err != nil {
+			return fmt.Errorf("decoding filter policy: %w", err)
+		}
+	}
+	if _, ok := policy[recipientAttribute]; !ok {
+		policy[recipientAttribute] = []string{recipient}
+		body, _ := json.Marshal(policy)
+		_, err = snsSvc.SetSubscriptionAttributesWithContext(ctx, &sns.SetSubscriptionAttributesInput{
+			SubscriptionArn: aws.String(subARN),
+			AttributeName:   aws.String("FilterPolicy"),
+			AttributeValue:  aws.String(string(body)),
+		})
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Subscription scoped to its copy of the digests", "subscription", subARN, "recipient", recipient)
+	}
+	scopedSubscriptions.Store(subARN, true)
+	return nil
+}
+
+// digestAttributes describes a digest with the message attributes the filter
+// policies match: the extensions of its images and the types of its events.
+func digestAttributes(d digest) map[string]*sns.MessageAttributeValue {
+	extensions := map[string]bool{}
+	for _, image := range append(append([]eventImage{}, d.Uploaded...), d.Deleted...) {
+		extensions[strings.ToLower(image.Extension)] = true
+	}
+	eventTypes := map[string]bool{}
+	for _, event := range d.Events {
+		eventTypes[event.Type] = true
+	}
+
+	attributes := map[string]*sns.MessageAttributeValue{}
+	for name, values := range map[string]map[string]bool{extensionsAttribute: extensions, eventTypesAttribute: eventTypes} {
+		if len(values) == 0 {
+			continue
+		}
+		var list []string
+		for value := range values {
+			list = append(list, value)
+		}
+		sort.Strings(list)
+		body, _ := json.Marshal(list)
+		attributes[name] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String.Array"),
+			StringValue: aws.String(string(body)),
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+func TestValidateEndpoint(t *testing.T) {
+	valid := map[string][]string{
+		"email": {"me@example.com", "first.last+images@mail.example.org"},
+		"https": {"https://example.com/hooks/images", "https://hooks.example.com:8443/"},
+		"sqs":   {"arn:aws:sqs:eu-west-1:123456789012:images", "arn:aws-us-gov:sqs:us-gov-west-1:123456789012:images.fifo"},
+		"sms":   {"+14155550100", "+34600000000"},
+	}
+	invalid := map[string][]string{
+		"email": {"", "me", "Me <me@example.com>", "me@example.com, you@example.com"},
+		"https": {"http://example.com/hook", "https://", "example.com/hook"},
+		"sqs":   {"arn:aws:sns:eu-west-1:123456789012:images", "arn:aws:sqs:eu-west-1:1234:images", "images"},
+		"sms":   {"4155550100", "+0155550100", "+1 415 555 0100"},
+		"http":  {"http://example.com/hook"},
+		"":      {"me@example.com"},
+	}
+
+	for protocol, endpoints := range valid {
+		for _, endpoint := range endpoints {
+			if err := validateEndpoint(protocol, endpoint); err != nil {
+				t.Errorf("validateEndpoint(%q, %q) = %v, want it accepted", protocol, endpoint, err)
+			}
+		}
+	}
+	for protocol, endpoints := range invalid {
+		for _, endpoint := range endpoints {
+			if err := validateEndpoint(protocol, endpoint); err == nil {
+				t.Errorf("validateEndpoint(%q, %q) accepted an invalid endpoint", protocol, endpoint)
+			}
+		}
+	}
+}
+
+func TestFilterPolicyLimitsExtensionsAndEvents(t *testing.T) {
+	policy := map[string][]string{}
+	body := filterPolicy(subscriptionRequest{
+		Protocol:   "https",
+		Endpoint:   "https://example.com/hook",
+		Extensions: []string{".PNG", "jpg"},
+		EventTypes: []string{eventImageUploaded},
+	})
+	if err := json.Unmarshal([]byte(body), &policy); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(policy[extensionsAttribute], ","); got != "png,jpg" {
+		t.Errorf("extensions = %s, want png,jpg", got)
+	}
+	if got := policy[eventTypesAttribute]; len(got) != 1 || got[0] != eventImageUploaded {
+		t.Errorf("event types = %v", got)
+	}
+
+	// Without limits, the subscription only filters on its copy
+	body = filterPolicy(subscriptionRequest{Protocol: "sms", Endpoint: "+14155550100"})
+	if body != `{"recipient":["*"]}` {
+		t.Errorf("filterPolicy() = %s", body)
+	}
+}
+
+func TestDigestAttributesMatchFilterPolicies(t *testing.T) {
+	d := digest{
+		Events:   []eventEnvelope{{Type: eventImageUploaded}, {Type: eventImageDeleted}, {Type: eventImageUploaded}},
+		Uploaded: []eventImage{{Name: "a.PNG", Extension: "PNG"}, {Name: "b.jpg", Extension: "jpg"}},
+		Deleted:  []eventImage{{Name: "c.png", Extension: "png"}},
+	}
+	attributes := digestAttributes(d)
+
+	if got := aws.StringValue(attributes[extensionsAttribute].StringValue); got != `["jpg","png"]` {
+		t.Errorf("extensions = %s, want each lowercase extension once, sorted", got)
+	}
+	if got := aws.StringValue(attributes[eventTypesAttribute].StringValue); got != `["`+eventImageDeleted+`","`+eventImageUploaded+`"]` {
+		t.Errorf("event types = %s", got)
+	}
+	if got := aws.StringValue(attributes[extensionsAttribute].DataType); got != "String.Array" {
+		t.Errorf("DataType = %s, filter policies only match arrays as String.Array", got)
+	}
+
+	if attributes := digestAttributes(digest{}); len(attributes) != 0 {
+		t.Errorf("empty digest has attributes %v", attributes)
+	}
+}
+
+func TestCreateSubscriptionRejectsInvalidRequests(t *testing.T) {
+	for _, body := range []string{
+		`not json`,
+		`{"protocol": "email", "endpoint": "not an address"}`,
+		`{"protocol": "lambda", "endpoint": "arn:aws:lambda:eu-west-1:123456789012:function:f"}`,
+		`{"protocol": "email", "endpoint": "me@example.com", "eventTypes": ["image.renamed"]}`,
+	} {
+		rec := httptest.NewRecorder()
+		createSubscription(rec, httptest.NewRequest(http.MethodPost, "/subscriptions", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, rec.Code)
+		}
+	}
+}
+
+func TestNewSubscriptionInfo(t *testing.T) {
+	confirmed := newSubscriptionInfo("arn:aws:sns:eu-west-1:123456789012:uploads:5f1c", "sqs", "arn:aws:sqs:eu-west-1:123456789012:images")
+	if confirmed.Status != "confirmed" || confirmed.SubscriptionARN == "" {
+		t.Errorf("confirmed = %+v", confirmed)
+	}
+	for _, subARN := range []string{pendingConfirmation, ""} {
+		pending := newSubscriptionInfo(subARN, "email", "me@example.com")
+		if pending.Status != "pending" || pending.SubscriptionARN != "" {
+			t.Errorf("newSubscriptionInfo(%q) = %+v, want pending without an ARN", subARN, pending)
+		}
+	}
+}
+
+// pagedSNS lists the subscriptions of the topic a page at a time, the way
+// SNS returns up to 100 per call.
+type pagedSNS struct {
+	snsiface.SNSAPI
+	pages  [][]*sns.Subscription
+	listed int
+	served int
+}
+
+func (p *pagedSNS) ListSubscriptionsByTopicPagesWithContext(ctx aws.Context, in *sns.ListSubscriptionsByTopicInput, fn func(*sns.ListSubscriptionsByTopicOutput, bool) bool, opts ...request.Option) error {
+	p.listed++
+	for i, page := range p.pages {
+		p.served++
+		if !fn(&sns.ListSubscriptionsByTopicOutput{Subscriptions: page}, i == len(p.pages)-1) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// emailPages returns pages of perPage email subscriptions, user0@example.com
+// first.
+func emailPages(pages, perPage int) [][]*sns.Subscription {
+	var result [][]*sns.Subscription
+	for p := 0; p < pages; p++ {
+		var page []*sns.Subscription
+		for i := 0; i < perPage; i++ {
+			n := p*perPage + i
+			page = append(page, &sns.Subscription{
+				Protocol:        aws.String("email"),
+				Endpoint:        aws.String(fmt.Sprintf("user%d@example.com", n)),
+				SubscriptionArn: aws.String(fmt.Sprintf("arn:aws:sns:eu-west-1:123456789012:uploads:%d", n)),
+			})
+		}
+		result = append(result, page)
+	}
+	return result
+}
+
+// emptySubscriptionIndex gives the test an index of its own.
+func emptySubscriptionIndex(t *testing.T) {
+	previous := subscriptionIndex
+	subscriptionIndex = &endpointIndex{arns: map[string]string{}}
+	t.Cleanup(func() { subscriptionIndex = previous })
+}
+
+func TestFindSubscriptionARNStopsAtItsPage(t *testing.T) {
+	emptySubscriptionIndex(t)
+	client := &pagedSNS{pages: emailPages(5, 100)}
+
+	subARN, err := findSubscriptionARN(context.Background(), client, "email", "user250@example.com")
+	if err != nil || subARN != "arn:aws:sns:eu-west-1:123456789012:uploads:250" {
+		t.Fatalf("findSubscriptionARN() = %q, %v", subARN, err)
+	}
+	if client.served != 3 {
+		t.Errorf("listed %d pages, want to stop at the third", client.served)
+	}
+
+	// The pages walked are indexed, so their endpoints need no listing
+	if subARN, _ := findSubscriptionARN(context.Background(), client, "email", "user12@example.com"); subARN == "" {
+		t.Error("user12@example.com not found")
+	}
+	if client.listed != 1 {
+		t.Errorf("listed the subscriptions %d times, want once", client.listed)
+	}
+}
+
+func TestFindSubscriptionARNListsPendingAgain(t *testing.T) {
+	emptySubscriptionIndex(t)
+	pending := &sns.Subscription{Protocol: aws.String("email"), Endpoint: aws.String("new@example.com"), SubscriptionArn: aws.String(pendingConfirmation)}
+	client := &pagedSNS{pages: [][]*sns.Subscription{{pending}}}
+
+	for i := 0; i < 2; i++ {
+		subARN, err := findSubscriptionARN(context.Background(), client, "email", "new@example.com")
+		if err != nil || subARN != pendingConfirmation {
+			t.Fatalf("findSubscriptionARN() = %q, %v", subARN, err)
+		}
+	}
+	if client.listed != 2 {
+		t.Errorf("listed %d times, want every lookup of a pending subscription to list", client.listed)
+	}
+
+	// Once confirmed, the next lookup finds the ARN and keeps it
+	pending.SubscriptionArn = aws.String("arn:aws:sns:eu-west-1:123456789012:uploads:new")
+	findSubscriptionARN(context.Background(), client, "email", "new@example.com")
+	findSubscriptionARN(context.Background(), client, "email", "new@example.com")
+	if client.listed != 3 {
+		t.Errorf("listed %d times after confirmation, want 3", client.listed)
+	}
+}
+
+func TestFindSubscriptionARNForgetsRemovedEndpoint(t *testing.T) {
+	emptySubscriptionIndex(t)
+	subscriptionIndex.set("sms", "+14155550100", pendingConfirmation)
+	client := &pagedSNS{pages: emailPages(2, 3)}
+
+	subARN, err := findSubscriptionARN(context.Background(), client, "sms", "+14155550100")
+	if err != nil || subARN != "" {
+		t.Fatalf("findSubscriptionARN() = %q, %v, want not found", subARN, err)
+	}
+	if got := subscriptionIndex.lookup("sms", "+14155550100"); got != "" {
+		t.Errorf("index still holds %q for the removed endpoint", got)
+	}
+}
+
+func TestEndpointIndexRebuild(t *testing.T) {
+	index := &endpointIndex{arns: map[string]string{endpointKey("email", "gone@example.com"): "arn:gone"}}
+	client := &pagedSNS{pages: emailPages(3, 2)}
+
+	count, err := index.rebuild(context.Background(), client)
+	if err != nil || count != 6 {
+		t.Fatalf("rebuild() = %d, %v, want 6", count, err)
+	}
+	if index.lookup("email", "gone@example.com") != "" {
+		t.Error("rebuild kept an endpoint no longer subscribed")
+	}
+	if index.lookup("email", "user5@example.com") != "arn:aws:sns:eu-west-1:123456789012:uploads:5" {
+		t.Error("rebuild missed the last page")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters of the spans, chosen with OTEL_TRACES_EXPORTER.
+const (
+	// tracesExporterNone records no spans, the trace context is still
+	// propagated.
+	tracesExporterNone = "none"
+	// tracesExporterOTLP sends the spans over OTLP/HTTP to the collector at
+	// OTEL_EXPORTER_OTLP_ENDPOINT (default http://localhost:4318).
+	tracesExporterOTLP = "otlp"
+	// tracesExporterStdout writes the spans to stdout, for local debugging.
+	tracesExporterStdout = "stdout"
+)
+
+// tracer starts the spans of the application. It follows the provider set by
+// setupTracing, even though it is created before.
+var tracer = otel.Tracer("simple-app")
+
+// setupTracing sets up the exporter chosen with OTEL_TRACES_EXPORTER (default
+// none) and the W3C trace context propagation, and returns the function that
+// flushes the spans left on shutdown. OTEL_TRACES_SAMPLE_RATIO (default 1)
+// samples the traces started here; those started upstream keep their
+// decision. In the Lambda modes the spans are exported before each
+// invocation returns, since the environment may be frozen right after.
+func setupTracing(mode string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch name := getEnv("OTEL_TRACES_EXPORTER", tracesExporterNone); name {
+	case tracesExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case tracesExporterOTLP:
+		otlpExporter, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("creating the OTLP exporter: %w", err)
+		}
+		exporter = otlpExporter
+	case tracesExporterStdout:
+		stdoutExporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("creating the stdout exporter: %w", err)
+		}
+		exporter = stdoutExporter
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER '%s', expected one of: none, otlp, stdout", name)
+	}
+
+	ratio, err := strconv.ParseFloat(getEnv("OTEL_TRACES_SAMPLE_RATIO", "1"), 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLE_RATIO, expected a number between 0 and 1")
+	}
+
+	processor := sdktrace.WithBatcher(exporter)
+	if mode != modeServer {
+		processor = sdktrace.WithSyncer(exporter)
+	}
+	provider := sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", getEnv("OTEL_SERVICE_NAME", "simple-app")),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("Tracing enabled", "exporter", getEnv("OTEL_TRACES_EXPORTER", tracesExporterNone), "sample_ratio", ratio)
+	return provider.Shutdown, nil
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingMiddleware continues the trace of the traceparent header of the
+// request, if any, in a span named after the template of its route.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeTemplate(r)
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("client.address", r.RemoteAddr),
+			),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// traceAWSSession traces every call made by the clients created from sess,
+// retries included, as a child of the span of the context it is made with.
+func traceAWSSession(sess *session.Session) {
+	sess.Handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "simple-app.tracing.start",
+		Fn:   startAWSSpan,
+	})
+	sess.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "simple-app.tracing.end",
+		Fn:   endAWSSpan,
+	})
+}
+
+func startAWSSpan(r *request.Request) {
+	service, operation := r.ClientInfo.ServiceName, "unknown"
+	if r.Operation != nil {
+		operation = r.Operation.Name
+	}
+	ctx, _ := tracer.Start(r.Context(), service+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "aws-api"),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", operation),
+		),
+	)
+	r.SetContext(ctx)
+}
+
+func endAWSSpan(r *request.Request) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(
+		attribute.String("aws.request_id", r.RequestID),
+		attribute.Int("aws.retry_count", r.RetryCount),
+	)
+	if r.HTTPResponse != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", r.HTTPResponse.StatusCode))
+	}
+	endSpan(span, r.Error)
+}
+
+// startSQLSpan starts the span of a statement sent to the database.
+func startSQLSpan(ctx context.Context, query string) trace.Span {
+	_, span := tracer.Start(ctx, sqlOperation(query),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mysql"),
+			attribute.String("db.operation.name", sqlOperation(query)),
+			attribute.String("db.query.text", query),
+		),
+	)
+	return span
+}
+
+// messageAttributesCarrier reads and writes the trace context in the
+// attributes of an SQS message.
+type messageAttributesCarrier map[string]*sqs.MessageAttributeValue
+
+func (c messageAttributesCarrier) Get(key string) string {
+	if value, ok := c[key]; ok {
+		return aws.StringValue(value.StringValue)
+	}
+	return ""
+}
+
+func (c messageAttributesCarrier) Set(key, value string) {
+	c[key] = stringAttribute(value)
+}
+
+func (c messageAttributesCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// injectTraceContext adds the trace context of ctx, e.g. a traceparent, to
+// the attributes of a message about to be sent.
+func injectTraceContext(ctx context.Context, attributes map[string]*sqs.MessageAttributeValue) {
+	otel.GetTextMapPropagator().Inject(ctx, messageAttributesCarrier(attributes))
+}
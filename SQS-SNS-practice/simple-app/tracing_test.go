@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The tracer of the application only delegates to the first provider set, so
+// the tests set one provider, whose spans go to the recorder of the current
+// test.
+var (
+	setupTestTracing sync.Once
+	spanSink         = &sinkProcessor{}
+)
+
+type sinkProcessor struct {
+	mu       sync.Mutex
+	recorder *tracetest.SpanRecorder
+}
+
+func (p *sinkProcessor) current() sdktrace.SpanProcessor {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.recorder == nil {
+		return tracetest.NewSpanRecorder()
+	}
+	return p.recorder
+}
+
+func (p *sinkProcessor) OnStart(ctx context.Context, s sdktrace.ReadWriteSpan) {
+	p.current().OnStart(ctx, s)
+}
+func (p *sinkProcessor) OnEnd(s sdktrace.ReadOnlySpan)        { p.current().OnEnd(s) }
+func (p *sinkProcessor) Shutdown(ctx context.Context) error   { return nil }
+func (p *sinkProcessor) ForceFlush(ctx context.Context) error { return nil }
+
+// recordSpans records the spans ended until the test ends, with the trace
+// context propagated as in setupTracing.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	setupTestTracing.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanSink)))
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	})
+	recorder := tracetest.NewSpanRecorder()
+	spanSink.mu.Lock()
+	spanSink.recorder = recorder
+	spanSink.mu.Unlock()
+	t.Cleanup(func() {
+		spanSink.mu.Lock()
+		spanSink.recorder = nil
+		spanSink.mu.Unlock()
+	})
+	return recorder
+}
+
+// endedSpan returns the only span ended with name.
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	var found []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			found = append(found, span)
+		}
+	}
+	if len(found) != 1 {
+		var names []string
+		for _, span := range recorder.Ended() {
+			names = append(names, span.Name())
+		}
+		t.Fatalf("ended %d spans named %q, spans: %q", len(found), name, names)
+	}
+	return found[0]
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func TestTracingMiddlewareContinuesTraceOfRequest(t *testing.T) {
+	recorder := recordSpans(t)
+	router := mux.NewRouter()
+	router.Use(tracingMiddleware)
+	var handlerSpan trace.SpanContext
+	router.HandleFunc("/webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlerSpan = trace.SpanContextFromContext(r.Context())
+		w.WriteHeader(http.StatusAccepted)
+	}).Methods("POST")
+
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/12", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	span := endedSpan(t, recorder, "POST /webhooks/{id}")
+	if got := span.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace id = %s, want the one of the traceparent", got)
+	}
+	if got := span.Parent().SpanID().String(); got != "00f067aa0ba902b7" || !span.Parent().IsRemote() {
+		t.Errorf("parent = %s, want the remote span of the traceparent", got)
+	}
+	if handlerSpan.SpanID() != span.SpanContext().SpanID() {
+		t.Error("the handler does not run in the span of the request")
+	}
+	attributes := spanAttributes(span)
+	if attributes["http.route"].AsString() != "/webhooks/{id}" || attributes["url.path"].AsString() != "/webhooks/12" {
+		t.Errorf("attributes = %v", attributes)
+	}
+	if attributes["http.response.status_code"].AsInt64() != http.StatusAccepted || span.Status().Code != codes.Unset {
+		t.Errorf("status code %v, span status %v", attributes["http.response.status_code"], span.Status())
+	}
+}
+
+func TestTracingMiddlewareMarksServerErrors(t *testing.T) {
+	recorder := recordSpans(t)
+	router := mux.NewRouter()
+	router.Use(tracingMiddleware)
+	router.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Error reading metadata from RDS", http.StatusBadGateway)
+	})
+	router.HandleFunc("/image/metadata", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Missing name", http.StatusBadRequest)
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/image", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/image/metadata", nil))
+
+	if got := endedSpan(t, recorder, "GET /image").Status(); got.Code != codes.Error || got.Description != "Bad Gateway" {
+		t.Errorf("status of a 502 = %v, want an error", got)
+	}
+	if got := endedSpan(t, recorder, "GET /image/metadata").Status(); got.Code != codes.Unset {
+		t.Errorf("status of a 400 = %v, want unset: the client erred, not the server", got)
+	}
+}
+
+func TestEndSpanRecordsError(t *testing.T) {
+	recorder := recordSpans(t)
+	_, failed := tracer.Start(context.Background(), "failed")
+	endSpan(failed, errors.New("bucket not found"))
+	_, succeeded := tracer.Start(context.Background(), "succeeded")
+	endSpan(succeeded, nil)
+
+	span := endedSpan(t, recorder, "failed")
+	if span.Status().Code != codes.Error || span.Status().Description != "bucket not found" {
+		t.Errorf("status = %v", span.Status())
+	}
+	if events := span.Events(); len(events) != 1 || events[0].Name != "exception" {
+		t.Errorf("events = %v, want the error recorded", events)
+	}
+	if span := endedSpan(t, recorder, "succeeded"); span.Status().Code != codes.Unset || len(span.Events()) != 0 {
+		t.Errorf("successful span has status %v and events %v", span.Status(), span.Events())
+	}
+}
+
+func TestAWSSpanIsChildOfCaller(t *testing.T) {
+	recorder := recordSpans(t)
+	ctx, parent := tracer.Start(context.Background(), "POST /image")
+
+	call := &request.Request{
+		ClientInfo:  metadata.ClientInfo{ServiceName: "s3"},
+		Operation:   &request.Operation{Name: "PutObject"},
+		HTTPRequest: httptest.NewRequest(http.MethodPut, "/bucket/cat.png", nil),
+	}
+	call.SetContext(ctx)
+	startAWSSpan(call)
+	call.RequestID = "TX1234"
+	call.RetryCount = 2
+	call.HTTPResponse = &http.Response{StatusCode: http.StatusServiceUnavailable}
+	call.Error = awserr.New("SlowDown", "Please reduce your request rate.", nil)
+	endAWSSpan(call)
+	parent.End()
+
+	span := endedSpan(t, recorder, "s3.PutObject")
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() || span.SpanKind() != trace.SpanKindClient {
+		t.Errorf("span of kind %v is not a client span under the caller", span.SpanKind())
+	}
+	attributes := spanAttributes(span)
+	if attributes["aws.request_id"].AsString() != "TX1234" || attributes["aws.retry_count"].AsInt64() != 2 ||
+		attributes["http.response.status_code"].AsInt64() != 503 || attributes["rpc.method"].AsString() != "PutObject" {
+		t.Errorf("attributes = %v", attributes)
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("status = %v, want the error of the call", span.Status())
+	}
+}
+
+func TestTraceContextTravelsWithMessage(t *testing.T) {
+	recorder := recordSpans(t)
+	ctx, producer := tracer.Start(context.Background(), "POST /image")
+	attributes := map[string]*sqs.MessageAttributeValue{}
+	injectTraceContext(ctx, attributes)
+	producer.End()
+
+	if _, ok := attributes["traceparent"]; !ok {
+		t.Fatalf("attributes = %v, want a traceparent", messageAttributesCarrier(attributes).Keys())
+	}
+
+	msg := queuedMessage("traced", 1)
+	msg.MessageAttributes = attributes
+	var handled trace.SpanContext
+	consumer := testConsumer(newFakeSQS(), func(ctx context.Context, msg *sqs.Message) error {
+		handled = trace.SpanContextFromContext(ctx)
+		return errors.New("database is unreachable")
+	})
+	consumer.handle(msg)
+
+	span := endedSpan(t, recorder, "uploads process")
+	if span.SpanContext().TraceID() != producer.SpanContext().TraceID() || span.Parent().SpanID() != producer.SpanContext().SpanID() {
+		t.Error("the consumer span does not continue the trace of the producer")
+	}
+	if handled.SpanID() != span.SpanContext().SpanID() {
+		t.Error("the handler does not run in the consumer span")
+	}
+	if got := spanAttributes(span)["messaging.message.id"].AsString(); got != "traced" {
+		t.Errorf("message id = %q", got)
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("status = %v, want the error of the handler", span.Status())
+	}
+}
+
+func TestLogsCarryTraceOfContext(t *testing.T) {
+	recordSpans(t)
+	logs := captureLogs(t)
+	ctx, span := tracer.Start(context.Background(), "digest")
+	slog.InfoContext(ctx, "Digest published")
+	span.End()
+
+	record := logRecords(t, logs)[0]
+	if record["trace_id"] != span.SpanContext().TraceID().String() || record["span_id"] != span.SpanContext().SpanID().String() {
+		t.Errorf("record = %v, want the trace and span ids", record)
+	}
+}
+
+func TestInstrumentedDriverTracesStatements(t *testing.T) {
+	recorder := recordSpans(t)
+	table := &scriptedDB{
+		exec: func(query string, args []driver.Value) (int64, error) { return 1, nil },
+		query: func(query string, args []driver.Value) (*scriptedRows, error) {
+			return nil, errors.New("table images doesn't exist")
+		},
+	}
+	database := sql.OpenDB(instrumentedConnector{driver: scriptedDriver{table}})
+	defer database.Close()
+
+	ctx, request := tracer.Start(context.Background(), "DELETE /images")
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM images WHERE id = ?", 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.QueryContext(ctx, "SELECT id FROM images"); err == nil {
+		t.Fatal("query of a missing table succeeded")
+	}
+	request.End()
+
+	for _, name := range []string{"BEGIN", "DELETE", "COMMIT", "SELECT"} {
+		span := endedSpan(t, recorder, name)
+		if span.Parent().SpanID() != request.SpanContext().SpanID() {
+			t.Errorf("%s is not traced under the request", name)
+		}
+	}
+	if got := spanAttributes(endedSpan(t, recorder, "DELETE"))["db.query.text"].AsString(); got != "DELETE FROM images WHERE id = ?" {
+		t.Errorf("query text = %q", got)
+	}
+	if got := endedSpan(t, recorder, "SELECT").Status().Code; got != codes.Error {
+		t.Errorf("status of the failed query = %v", got)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unsubscribeTokenTTL is how long an unsubscribe token is valid unless
+// UNSUBSCRIBE_TOKEN_TTL says otherwise.
+const unsubscribeTokenTTL = 30 * 24 * time.Hour
+
+var (
+	errInvalidToken = errors.New("invalid unsubscribe token")
+	errExpiredToken = errors.New("the unsubscribe token has expired")
+)
+
+var (
+	unsubscribeSecretOnce sync.Once
+	unsubscribeSecret     []byte
+)
+
+// unsubscribeKey returns the key the tokens are signed with, UNSUBSCRIBE_SECRET.
+// Without it a random key is used, so the tokens stop working on restart and
+// differ between instances.
+func unsubscribeKey() []byte {
+	unsubscribeSecretOnce.Do(func() {
+		unsubscribeSecret = []byte(getEnv("UNSUBSCRIBE_SECRET", ""))
+		if len(unsubscribeSecret) == 0 {
+			slog.Warn("UNSUBSCRIBE_SECRET is not set, unsubscribe tokens will only be valid until the application restarts")
+			unsubscribeSecret = make([]byte, 32)
+			if _, err := rand.Read(unsubscribeSecret); err != nil {
+				panic(err)
+			}
+		}
+	})
+	return unsubscribeSecret
+}
+
+// newUnsubscribeToken returns a token that lets its holder, and nobody else,
+// unsubscribe the endpoint until it expires. Tokens only travel in the
+// notifications delivered to the endpoint, see unsubscribeURL: anyone may
+// create a subscription, so they are never returned by the API. It is the
+// base64url encoding of "<protocol>\n<endpoint>\n<expiry unix seconds>"
+// followed by "." and its HMAC-SHA256.
+func newUnsubscribeToken(protocol, endpoint string) string {
+	expires := time.Now().Add(getEnvDuration("UNSUBSCRIBE_TOKEN_TTL", unsubscribeTokenTTL)).Unix()
+	payload := fmt.Sprintf("%s\n%s\n%d", protocol, endpoint, expires)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(signUnsubscribe(payload))
+}
+
+// parseUnsubscribeToken returns the endpoint a token was issued for.
+func parseUnsubscribeToken(token string) (protocol, endpoint string, err error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return "", "", errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, signUnsubscribe(string(payload))) {
+		return "", "", errInvalidToken
+	}
+
+	fields := strings.Split(string(payload), "\n")
+	if len(fields) != 3 {
+		return "", "", errInvalidToken
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", "", errInvalidToken
+	}
+	if time.Now().Unix() > expires {
+		return "", "", errExpiredToken
+	}
+	return fields[0], fields[1], nil
+}
+
+func signUnsubscribe(payload string) []byte {
+	mac := hmac.New(sha256.New, unsubscribeKey())
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// unsubscribeURL returns the one-click unsubscribe link of the endpoint, under
+// PUBLIC_BASE_URL, or "" when the public address of the application is unknown.
+func unsubscribeURL(protocol, endpoint string) string {
+	base := getEnv("PUBLIC_BASE_URL", "")
+	if base == "" {
+		return ""
+	}
+	return strings.TrimSuffix(base, "/") + "/notification/unsubscribe?token=" + url.QueryEscape(newUnsubscribeToken(protocol, endpoint))
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Unsubscribe</title>
+</head>
+<body>
+  <form method="post" action="/notification/unsubscribe">
+    <input type="hidden" name="token" value="{{ .Token }}">
+    <p>Stop sending image notifications to {{ .Endpoint }}?</p>
+    <button type="submit">Unsubscribe</button>
+  </form>
+</body>
+</html>
+`))
+
+// confirmUnsubscription shows the page of an unsubscribe link. Following the
+// link never unsubscribes, so prefetchers and crawlers cannot; the page posts
+// the token back to unsubscribeWithToken.
+func confirmUnsubscription(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	_, endpoint, err := parseUnsubscribeToken(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	unsubscribePage.Execute(w, struct{ Token, Endpoint string }{token, endpoint})
+}
+
+// unsubscribeWithToken unsubscribes the endpoint of the token given in the
+// query or in the form. It also serves one-click unsubscribe requests
+// (RFC 8058), whose body is "List-Unsubscribe=One-Click".
+func unsubscribeWithToken(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "Missing token parameter", http.StatusBadRequest)
+		return
+	}
+	protocol, endpoint, err := parseUnsubscribeToken(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unsubscribeEndpoint(r.Context(), w, protocol, endpoint)
+}
+
+// unsubscription removes the subscription of the token holder, given a JSON
+// body such as {"token": "..."}.
+func unsubscription(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Token == "" {
+		http.Error(w, "Please provide a JSON body such as {\"token\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	protocol, endpoint, err := parseUnsubscribeToken(request.Token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unsubscribeEndpoint(r.Context(), w, protocol, endpoint)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedToken builds a token for payload the way newUnsubscribeToken does.
+func signedToken(payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(signUnsubscribe(payload))
+}
+
+func TestParseUnsubscribeToken(t *testing.T) {
+	valid := newUnsubscribeToken("email", "me@example.com")
+	encodedPayload, encodedSignature, _ := strings.Cut(valid, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(encodedPayload)
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(payload), "me@", "you@", 1))) +
+		"." + encodedSignature
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name         string
+		token        string
+		wantProtocol string
+		wantEndpoint string
+		wantErr      error
+	}{
+		{"valid", valid, "email", "me@example.com", nil},
+		{"https endpoint", signedToken(fmt.Sprintf("https\nhttps://example.com/hook\n%d", future)), "https", "https://example.com/hook", nil},
+		{"expired", signedToken(fmt.Sprintf("email\nme@example.com\n%d", past)), "", "", errExpiredToken},
+		{"tampered payload", tampered, "", "", errInvalidToken},
+		{"tampered signature", encodedPayload + "." + base64.RawURLEncoding.EncodeToString([]byte("forged")), "", "", errInvalidToken},
+		{"missing signature", encodedPayload, "", "", errInvalidToken},
+		{"invalid base64", "not base64!." + encodedSignature, "", "", errInvalidToken},
+		{"missing field", signedToken("email\nme@example.com"), "", "", errInvalidToken},
+		{"invalid expiry", signedToken("email\nme@example.com\nsoon"), "", "", errInvalidToken},
+		{"empty", "", "", "", errInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protocol, endpoint, err := parseUnsubscribeToken(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if protocol != tt.wantProtocol || endpoint != tt.wantEndpoint {
+				t.Errorf("got (%q, %q), want (%q, %q)", protocol, endpoint, tt.wantProtocol, tt.wantEndpoint)
+			}
+		})
+	}
+}
+
+func TestNewUnsubscribeTokenExpiry(t *testing.T) {
+	t.Setenv("UNSUBSCRIBE_TOKEN_TTL", "-1s")
+	if _, _, err := parseUnsubscribeToken(newUnsubscribeToken("email", "me@example.com")); !errors.Is(err, errExpiredToken) {
+		t.Errorf("error = %v, want %v", err, errExpiredToken)
+	}
+}
+
+func TestDigestCarriesRecipientUnsubscribeLink(t *testing.T) {
+	t.Setenv("PUBLIC_BASE_URL", "https://images.example.com/")
+	r, err := newNotificationRenderer(defaultLocale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := digest{Uploaded: []eventImage{{Name: "cat.png", Size: 1}}, From: time.Now(), To: time.Now()}
+
+	shared, err := r.render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(shared.Text, "/notification/unsubscribe") {
+		t.Errorf("shared copy carries an unsubscribe link:\n%s", shared.Text)
+	}
+
+	own, err := r.render(d.forRecipient("email", "me@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "https://images.example.com/notification/unsubscribe?token="
+	start := strings.Index(own.Text, prefix)
+	if start < 0 {
+		t.Fatalf("recipient copy has no unsubscribe link:\n%s", own.Text)
+	}
+	link := strings.Fields(own.Text[start:])[0]
+	if !strings.Contains(own.HTML, `href="`+strings.ReplaceAll(link, "&", "&amp;")+`"`) {
+		t.Errorf("HTML copy does not link to %s", link)
+	}
+
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocol, endpoint, err := parseUnsubscribeToken(parsed.Query().Get("token"))
+	if err != nil || protocol != "email" || endpoint != "me@example.com" {
+		t.Errorf("link unsubscribes %s %s (%v), want the recipient", protocol, endpoint, err)
+	}
+}
+
+func TestFilterPolicyScopesRecipient(t *testing.T) {
+	for _, request := range []subscriptionRequest{
+		{Protocol: "email", Endpoint: "me@example.com"},
+		{Protocol: "sqs", Endpoint: "arn:aws:sqs:us-east-1:123456789012:images", EventTypes: []string{eventImageDeleted}},
+	} {
+		var policy map[string][]string
+		if err := json.Unmarshal([]byte(filterPolicy(request)), &policy); err != nil {
+			t.Fatal(err)
+		}
+		want := broadcastRecipient
+		if request.Protocol == "email" {
+			want = request.Endpoint
+		}
+		if got := policy[recipientAttribute]; len(got) != 1 || got[0] != want {
+			t.Errorf("%s subscription filters on recipient %v, want [%s]", request.Protocol, got, want)
+		}
+	}
+}
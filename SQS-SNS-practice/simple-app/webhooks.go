@@ -0,0 +1,844 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Status of a webhook delivery.
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+// Headers of every webhook request. The signature is "t=<unix seconds>,v1=<hex>"
+// where v1 is the HMAC-SHA256, keyed with the secret of the webhook, of
+// "<unix seconds>.<body>"; receivers should also reject old timestamps.
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventIDHeader   = "X-Webhook-Event-Id"
+	webhookEventTypeHeader = "X-Webhook-Event-Type"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// Delays between the attempts of a delivery: exponential from
+// webhookBaseBackoff up to webhookMaxBackoff, with jitter.
+const (
+	webhookBaseBackoff = 10 * time.Second
+	webhookMaxBackoff  = time.Hour
+)
+
+// webhook is an HTTPS endpoint receiving the image events as they are consumed.
+// An empty EventTypes receives every type. The secret is only shown once,
+// when the webhook is created.
+type webhook struct {
+	ID                  int64     `json:"id"`
+	URL                 string    `json:"url"`
+	EventTypes          []string  `json:"eventTypes"`
+	Secret              string    `json:"secret,omitempty"`
+	Enabled             bool      `json:"enabled"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	DisabledReason      string    `json:"disabledReason,omitempty"`
+	CreatedAt           time.Time `json:"createdAt"`
+}
+
+// webhookDelivery is an event to deliver to a webhook, tried until it succeeds
+// or WEBHOOK_MAX_ATTEMPTS is reached.
+type webhookDelivery struct {
+	ID             int64            `json:"id"`
+	WebhookID      int64            `json:"webhookId"`
+	EventID        string           `json:"eventId"`
+	EventType      string           `json:"eventType"`
+	Status         string           `json:"status"`
+	Attempts       int              `json:"attempts"`
+	NextAttemptAt  time.Time        `json:"nextAttemptAt"`
+	LastStatusCode int              `json:"lastStatusCode,omitempty"`
+	LastError      string           `json:"lastError,omitempty"`
+	CreatedAt      time.Time        `json:"createdAt"`
+	AttemptLog     []webhookAttempt `json:"attemptLog,omitempty"`
+
+	payload string
+	url     string
+	secret  string
+}
+
+// webhookAttempt records a request made for a delivery.
+type webhookAttempt struct {
+	AttemptedAt time.Time `json:"attemptedAt"`
+	StatusCode  int       `json:"statusCode,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	DurationMS  int64     `json:"durationMs"`
+}
+
+func webhooksTableName() string {
+	return dbTableName + "_webhooks"
+}
+
+func webhookDeliveriesTableName() string {
+	return dbTableName + "_webhook_deliveries"
+}
+
+func webhookAttemptsTableName() string {
+	return dbTableName + "_webhook_attempts"
+}
+
+func createWebhookTables() {
+	statements := []string{
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id int NOT NULL AUTO_INCREMENT,
+			url VARCHAR(2048) NOT NULL,
+			event_types VARCHAR(255) NOT NULL DEFAULT '',
+			secret VARCHAR(255) NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			consecutive_failures INT NOT NULL DEFAULT 0,
+			disabled_reason VARCHAR(255) NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (id)
+		)`, webhooksTableName()),
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id int NOT NULL AUTO_INCREMENT,
+			webhook_id int NOT NULL,
+			event_id VARCHAR(64) NOT NULL,
+			event_type VARCHAR(64) NOT NULL,
+			payload MEDIUMTEXT NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NOT NULL,
+			last_status_code INT NOT NULL DEFAULT 0,
+			last_error VARCHAR(1024) NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (id),
+			UNIQUE KEY (webhook_id, event_id),
+			KEY (status, next_attempt_at)
+		)`, webhookDeliveriesTableName()),
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id int NOT NULL AUTO_INCREMENT,
+			delivery_id int NOT NULL,
+			attempted_at DATETIME NOT NULL,
+			status_code INT NOT NULL DEFAULT 0,
+			error VARCHAR(1024) NOT NULL DEFAULT '',
+			duration_ms INT NOT NULL,
+			PRIMARY KEY (id),
+			KEY (delivery_id)
+		)`, webhookAttemptsTableName()),
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			panic(err.Error())
+		}
+	}
+	slog.Info("Tables created or already exist",
+		"tables", []string{webhooksTableName(), webhookDeliveriesTableName(), webhookAttemptsTableName()})
+
+	// Tables created before a batch event could exceed 64KB need the payload
+	// widened explicitly
+	if err := widenTextColumn(webhookDeliveriesTableName(), "payload", "MEDIUMTEXT NOT NULL"); err != nil {
+		panic(err.Error())
+	}
+}
+
+// enqueueWebhookDeliveries schedules the delivery of event to every enabled
+// webhook listening for its type. Scheduling the same event twice, e.g. when
+// its message is redelivered, keeps a single delivery per webhook.
+func enqueueWebhookDeliveries(ctx context.Context, event eventEnvelope) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`
+		INSERT IGNORE INTO %s(webhook_id, event_id, event_type, payload, status, next_attempt_at, created_at)
+		SELECT id, ?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP() FROM %s
+		WHERE enabled AND (event_types = '' OR FIND_IN_SET(?, event_types))`,
+		webhookDeliveriesTableName(), webhooksTableName(),
+	), event.ID, event.Type, string(body), deliveryPending, event.Type)
+	return err
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, private in all but name.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP reports whether ip may be reached by a webhook: not loopback,
+// link-local, private, multicast or unspecified, so a webhook cannot make
+// the server call itself, the instance metadata or the internal network.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsPrivate() ||
+		ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// allowPrivateWebhooks lets webhooks reach any address, with
+// WEBHOOK_ALLOW_PRIVATE_NETWORKS=true, e.g. to receive them locally.
+func allowPrivateWebhooks() bool {
+	return getEnv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "false") == "true"
+}
+
+// validateWebhookURL checks that rawURL is an https:// URL whose host only
+// resolves to public addresses.
+func validateWebhookURL(ctx context.Context, rawURL string) error {
+	if err := validateEndpoint("https", rawURL); err != nil {
+		return err
+	}
+	if allowPrivateWebhooks() {
+		return nil
+	}
+	webhook, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	host := webhook.Hostname()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve the host of the URL: %s", host)
+	}
+	for _, address := range addresses {
+		if !isPublicIP(address.IP) {
+			return fmt.Errorf("the host of the URL resolves to a private address: %s", host)
+		}
+	}
+	return nil
+}
+
+// publicDialControl refuses the connections to the addresses webhooks may not
+// reach. It runs on the address actually dialed, so a host resolving to
+// another address since the webhook was registered is caught too.
+func publicDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// newWebhookClient returns the client of the deliveries, which only connects
+// to public addresses and ignores the proxy settings of the environment, as
+// the proxy would connect on its behalf.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !allowPrivateWebhooks() {
+		transport.Proxy = nil
+		transport.DialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   publicDialControl,
+		}).DialContext
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		// A redirect is a failed delivery, the webhook should be updated
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// webhookDispatcher sends the due webhook deliveries.
+type webhookDispatcher struct {
+	client       *http.Client
+	concurrency  int
+	maxAttempts  int
+	disableAfter int
+}
+
+// runWebhookDispatcher sends the due deliveries every WEBHOOK_POLL_INTERVAL
+// (default 2s), WEBHOOK_CONCURRENCY (default 4) at a time, until ctx is done.
+// A failed delivery is retried up to WEBHOOK_MAX_ATTEMPTS (default 8) times,
+// and a webhook failing WEBHOOK_DISABLE_AFTER (default 20) attempts in a row
+// is disabled until it is enabled again through the API. The deliveries
+// claimed when ctx is done are still attempted and recorded.
+func runWebhookDispatcher(ctx context.Context) {
+	interval := getEnvDuration("WEBHOOK_POLL_INTERVAL", 2*time.Second)
+	d := &webhookDispatcher{
+		client:       newWebhookClient(getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second)),
+		concurrency:  getEnvInt("WEBHOOK_CONCURRENCY", 4),
+		maxAttempts:  getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		disableAfter: getEnvInt("WEBHOOK_DISABLE_AFTER", 20),
+	}
+	if d.concurrency < 1 || d.maxAttempts < 1 || d.disableAfter < 1 {
+		fatal("WEBHOOK_CONCURRENCY, WEBHOOK_MAX_ATTEMPTS and WEBHOOK_DISABLE_AFTER must be at least 1")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Once claimed, deliveries are only retried after their lease, so the
+		// attempts are not cancelled with ctx
+		deliveries, err := d.claimDue(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Error reading due webhook deliveries", "error", err)
+			}
+			continue
+		}
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, d.concurrency)
+		for _, delivery := range deliveries {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(delivery webhookDelivery) {
+				defer func() { <-sem; wg.Done() }()
+				if err := d.attempt(context.WithoutCancel(ctx), delivery); err != nil {
+					slog.ErrorContext(ctx, "Error recording webhook delivery", "delivery_id", delivery.ID, "error", err)
+				}
+			}(delivery)
+		}
+		wg.Wait()
+	}
+}
+
+// claimDue returns the deliveries due now and postpones them for as long as
+// an attempt can take, so other instances do not send them at the same time.
+func (d *webhookDispatcher) claimDue(ctx context.Context) ([]webhookDelivery, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		SELECT d.id, d.webhook_id, d.event_id, d.event_type, d.payload, d.attempts, w.url, w.secret
+		FROM %s d JOIN %s w ON w.id = d.webhook_id
+		WHERE d.status = ? AND w.enabled AND d.next_attempt_at <= UTC_TIMESTAMP()
+		ORDER BY d.next_attempt_at LIMIT ? FOR UPDATE OF d SKIP LOCKED`,
+		webhookDeliveriesTableName(), webhooksTableName(),
+	), deliveryPending, d.concurrency*4)
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []webhookDelivery
+	var ids []interface{}
+	for rows.Next() {
+		var delivery webhookDelivery
+		err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventID, &delivery.EventType,
+			&delivery.payload, &delivery.Attempts, &delivery.url, &delivery.secret)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+		ids = append(ids, delivery.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// Every claimed delivery is attempted before the next claim, so the lease
+	// covers one timeout per round of concurrent attempts
+	lease := d.client.Timeout*time.Duration((len(ids)+d.concurrency-1)/d.concurrency) + time.Minute
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET next_attempt_at = DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND) WHERE id IN (?%s)",
+		webhookDeliveriesTableName(), strings.Repeat(", ?", len(ids)-1),
+	), append([]interface{}{int64(lease.Seconds())}, ids...)...)
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, tx.Commit()
+}
+
+// attempt sends delivery once and records the outcome.
+func (d *webhookDispatcher) attempt(ctx context.Context, delivery webhookDelivery) error {
+	started := time.Now()
+	statusCode, sendErr := d.send(ctx, delivery)
+	duration := time.Since(started)
+	webhookDeliveryAttempts.WithLabelValues(outcome(sendErr)).Inc()
+
+	var errorMessage string
+	if sendErr != nil {
+		errorMessage = truncate(sendErr.Error(), 1024)
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s(delivery_id, attempted_at, status_code, error, duration_ms) VALUES( ?, UTC_TIMESTAMP(), ?, ?, ? )",
+		webhookAttemptsTableName(),
+	), delivery.ID, statusCode, errorMessage, duration.Milliseconds())
+	if err != nil {
+		return err
+	}
+
+	attempts := delivery.Attempts + 1
+	if sendErr == nil {
+		_, err = db.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE %s SET status = ?, attempts = ?, last_status_code = ?, last_error = '' WHERE id = ?",
+			webhookDeliveriesTableName(),
+		), deliverySucceeded, attempts, statusCode, delivery.ID)
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE %s SET consecutive_failures = 0 WHERE id = ?", webhooksTableName(),
+		), delivery.WebhookID)
+		return err
+	}
+
+	slog.WarnContext(ctx, "Webhook delivery failed",
+		"delivery_id", delivery.ID,
+		"event_id", delivery.EventID,
+		"url", delivery.url,
+		"attempt", attempts,
+		"error", sendErr,
+	)
+	status := deliveryPending
+	if attempts >= d.maxAttempts {
+		status = deliveryFailed
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET status = ?, attempts = ?, last_status_code = ?, last_error = ?, next_attempt_at = DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND) WHERE id = ?",
+		webhookDeliveriesTableName(),
+	), status, attempts, statusCode, errorMessage, int64(webhookBackoff(attempts).Seconds()), delivery.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE %s SET
+			consecutive_failures = consecutive_failures + 1,
+			enabled = enabled AND consecutive_failures < ?,
+			disabled_reason = IF(enabled OR disabled_reason <> '', disabled_reason, ?)
+		WHERE id = ?`, webhooksTableName(),
+	), d.disableAfter, fmt.Sprintf("disabled after %d failed deliveries in a row", d.disableAfter), delivery.WebhookID)
+	return err
+}
+
+// send posts the event of delivery to its webhook and returns the status code
+// of the response. Anything but a 2xx response is an error.
+func (d *webhookDispatcher) send(ctx context.Context, delivery webhookDelivery) (int, error) {
+	body := []byte(delivery.payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "simple-app-webhooks/1")
+	req.Header.Set(webhookEventIDHeader, delivery.EventID)
+	req.Header.Set(webhookEventTypeHeader, delivery.EventType)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(delivery.secret, time.Now(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	excerpt, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response %s: %s", resp.Status, excerpt)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the signature header of a request sent at t with body.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff returns how long to wait after the given number of failed
+// attempts: exponential, capped at webhookMaxBackoff, with "equal jitter" so
+// that deliveries failing together do not retry together.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookMaxBackoff
+	if attempts < 20 {
+		if exponential := webhookBaseBackoff << (attempts - 1); exponential < webhookMaxBackoff {
+			backoff = exponential
+		}
+	}
+	return backoff/2 + time.Duration(mathrand.Int63n(int64(backoff/2)+1))
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
+
+func newWebhookSecret() string {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return "whsec_" + hex.EncodeToString(secret)
+}
+
+const webhookColumns = "id, url, event_types, enabled, consecutive_failures, disabled_reason, created_at"
+
+func scanWebhook(row rowScanner) (webhook, error) {
+	var hook webhook
+	var eventTypes, createdAtStr string
+	err := row.Scan(&hook.ID, &hook.URL, &eventTypes, &hook.Enabled, &hook.ConsecutiveFailures, &hook.DisabledReason, &createdAtStr)
+	if err != nil {
+		return hook, err
+	}
+	hook.EventTypes = []string{}
+	if eventTypes != "" {
+		hook.EventTypes = strings.Split(eventTypes, ",")
+	}
+	hook.CreatedAt, _ = time.Parse(timeLayout, createdAtStr)
+	return hook, nil
+}
+
+func getWebhook(ctx context.Context, id int64) (webhook, error) {
+	return scanWebhook(db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE id = ?", webhookColumns, webhooksTableName(),
+	), id))
+}
+
+// webhookID returns the id of the webhook in the path of r, writing the error
+// response when it is invalid or the webhook does not exist.
+func webhookID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook id", http.StatusBadRequest)
+		return 0, false
+	}
+	if _, err := getWebhook(r.Context(), id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+		} else {
+			slog.ErrorContext(r.Context(), "Error reading webhook from RDS", "error", err)
+			http.Error(w, "Error reading webhook from RDS", http.StatusInternalServerError)
+		}
+		return 0, false
+	}
+	return id, true
+}
+
+// createWebhook registers a webhook from a JSON body such as
+// {"url": "https://example.com/hook", "eventTypes": ["image.uploaded"]}.
+// The secret to verify the signatures with is generated unless one is given.
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		URL        string   `json:"url"`
+		EventTypes []string `json:"eventTypes"`
+		Secret     string   `json:"secret"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Please provide a JSON body such as {\"url\": \"https://example.com/hook\"}", http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookURL(r.Context(), request.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, eventType := range request.EventTypes {
+		if eventType != eventImageUploaded && eventType != eventImageDeleted {
+			http.Error(w, "Unknown event type: "+eventType, http.StatusBadRequest)
+			return
+		}
+	}
+	if request.Secret == "" {
+		request.Secret = newWebhookSecret()
+	}
+
+	result, err := db.ExecContext(r.Context(), fmt.Sprintf(
+		"INSERT INTO %s(url, event_types, secret, created_at) VALUES( ?, ?, ?, UTC_TIMESTAMP() )",
+		webhooksTableName(),
+	), request.URL, strings.Join(request.EventTypes, ","), request.Secret)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error storing webhook in RDS", "error", err)
+		http.Error(w, "Error storing webhook in RDS", http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+	hook, err := getWebhook(r.Context(), id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading webhook from RDS", "error", err)
+		http.Error(w, "Error reading webhook from RDS", http.StatusInternalServerError)
+		return
+	}
+	hook.Secret = request.Secret
+	slog.InfoContext(r.Context(), "Webhook created", "webhook_id", hook.ID, "url", hook.URL)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(
+		"SELECT %s FROM %s ORDER BY id", webhookColumns, webhooksTableName(),
+	))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading webhooks from RDS", "error", err)
+		http.Error(w, "Error reading webhooks from RDS", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	hooks := []webhook{}
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error reading webhooks from RDS", "error", err)
+			http.Error(w, "Error reading webhooks from RDS", http.StatusInternalServerError)
+			return
+		}
+		hooks = append(hooks, hook)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+func getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	hook, err := getWebhook(r.Context(), id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading webhook from RDS", "error", err)
+		http.Error(w, "Error reading webhook from RDS", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook)
+}
+
+// updateWebhook enables or disables a webhook with a JSON body such as
+// {"enabled": true}. Enabling it resets its count of failures, and its
+// pending deliveries are sent again.
+func updateWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Enabled == nil {
+		http.Error(w, "Please provide a JSON body such as {\"enabled\": true}", http.StatusBadRequest)
+		return
+	}
+
+	reason := ""
+	if !*request.Enabled {
+		reason = "disabled through the API"
+	}
+	_, err := db.ExecContext(r.Context(), fmt.Sprintf(
+		"UPDATE %s SET enabled = ?, consecutive_failures = 0, disabled_reason = ? WHERE id = ?",
+		webhooksTableName(),
+	), *request.Enabled, reason, id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error updating webhook in RDS", "error", err)
+		http.Error(w, "Error updating webhook in RDS", http.StatusInternalServerError)
+		return
+	}
+	getWebhookHandler(w, r)
+}
+
+// deleteWebhook removes a webhook with its deliveries and their attempts.
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting webhook from RDS", "error", err)
+		http.Error(w, "Error deleting webhook from RDS", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		fmt.Sprintf("DELETE a FROM %s a JOIN %s d ON d.id = a.delivery_id WHERE d.webhook_id = ?",
+			webhookAttemptsTableName(), webhookDeliveriesTableName()),
+		fmt.Sprintf("DELETE FROM %s WHERE webhook_id = ?", webhookDeliveriesTableName()),
+		fmt.Sprintf("DELETE FROM %s WHERE id = ?", webhooksTableName()),
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(r.Context(), statement, id); err != nil {
+			slog.ErrorContext(r.Context(), "Error deleting webhook from RDS", "error", err)
+			http.Error(w, "Error deleting webhook from RDS", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting webhook from RDS", "error", err)
+		http.Error(w, "Error deleting webhook from RDS", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const deliveryColumns = "id, webhook_id, event_id, event_type, status, attempts, next_attempt_at, last_status_code, last_error, created_at"
+
+func scanDelivery(row rowScanner) (webhookDelivery, error) {
+	var delivery webhookDelivery
+	var nextAttemptStr, createdAtStr string
+	err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventID, &delivery.EventType, &delivery.Status,
+		&delivery.Attempts, &nextAttemptStr, &delivery.LastStatusCode, &delivery.LastError, &createdAtStr)
+	if err != nil {
+		return delivery, err
+	}
+	delivery.NextAttemptAt, _ = time.Parse(timeLayout, nextAttemptStr)
+	delivery.CreatedAt, _ = time.Parse(timeLayout, createdAtStr)
+	return delivery, nil
+}
+
+// listWebhookDeliveries is the delivery log of a webhook, newest first,
+// optionally only those of a status and at most limit (default 50).
+func listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	limit := 50
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "limit must be a number between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+	condition, args := "", []interface{}{id}
+	if status := query.Get("status"); status != "" {
+		if status != deliveryPending && status != deliverySucceeded && status != deliveryFailed {
+			http.Error(w, "status must be one of: pending, succeeded, failed", http.StatusBadRequest)
+			return
+		}
+		condition = " AND status = ?"
+		args = append(args, status)
+	}
+
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(
+		"SELECT %s FROM %s WHERE webhook_id = ?%s ORDER BY id DESC LIMIT ?",
+		deliveryColumns, webhookDeliveriesTableName(), condition,
+	), append(args, limit)...)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading webhook deliveries from RDS", "error", err)
+		http.Error(w, "Error reading webhook deliveries from RDS", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []webhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error reading webhook deliveries from RDS", "error", err)
+			http.Error(w, "Error reading webhook deliveries from RDS", http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// getWebhookDelivery returns a delivery with the log of its attempts.
+func getWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := webhookDeliveryFromPath(w, r)
+	if !ok {
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(
+		"SELECT attempted_at, status_code, error, duration_ms FROM %s WHERE delivery_id = ? ORDER BY id",
+		webhookAttemptsTableName(),
+	), delivery.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading webhook attempts from RDS", "error", err)
+		http.Error(w, "Error reading webhook attempts from RDS", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var attempt webhookAttempt
+		var attemptedAtStr string
+		if err := rows.Scan(&attemptedAtStr, &attempt.StatusCode, &attempt.Error, &attempt.DurationMS); err != nil {
+			slog.ErrorContext(r.Context(), "Error reading webhook attempts from RDS", "error", err)
+			http.Error(w, "Error reading webhook attempts from RDS", http.StatusInternalServerError)
+			return
+		}
+		attempt.AttemptedAt, _ = time.Parse(timeLayout, attemptedAtStr)
+		delivery.AttemptLog = append(delivery.AttemptLog, attempt)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// redeliverWebhookDelivery schedules a delivery to be sent again right away,
+// whatever its status.
+func redeliverWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := webhookDeliveryFromPath(w, r)
+	if !ok {
+		return
+	}
+	_, err := db.ExecContext(r.Context(), fmt.Sprintf(
+		"UPDATE %s SET status = ?, attempts = 0, next_attempt_at = UTC_TIMESTAMP() WHERE id = ?",
+		webhookDeliveriesTableName(),
+	), deliveryPending, delivery.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error updating webhook delivery in RDS", "error", err)
+		http.Error(w, "Error updating webhook delivery in RDS", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func webhookDeliveryFromPath(w http.ResponseWriter, r *http.Request) (webhookDelivery, bool) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return webhookDelivery{}, false
+	}
+	deliveryID, err := strconv.ParseInt(mux.Vars(r)["deliveryID"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid delivery id", http.StatusBadRequest)
+		return webhookDelivery{}, false
+	}
+	delivery, err := scanDelivery(db.QueryRowContext(r.Context(), fmt.Sprintf(
+		"SELECT %s FROM %s WHERE id = ? AND webhook_id = ?", deliveryColumns, webhookDeliveriesTableName(),
+	), deliveryID, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return delivery, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading webhook delivery from RDS", "error", err)
+		http.Error(w, "Error reading webhook delivery from RDS", http.StatusInternalServerError)
+		return delivery, false
+	}
+	return delivery, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	sentAt := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+		want   string
+	}{
+		{"event", "whsec_test", `{"id":"event-1"}`, "t=1700000000,v1=8e2971dac7c4d9294c7c65f1bd33cef904855a225900e22ee05f866f468078eb"},
+		{"other secret", "other", `{"id":"event-1"}`, "t=1700000000,v1=f78153b2907b315f53820b38985b90154e8f57acd255e3d971a3addad223816e"},
+		{"empty body", "whsec_test", "", "t=1700000000,v1=5967f3c560522fa40cf2876ebc3c3a08551dd6959aaade3b413460591895bdcc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signWebhook(tt.secret, sentAt, []byte(tt.body)); got != tt.want {
+				t.Errorf("signWebhook() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		base     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{8, 1280 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{19, time.Hour},
+		{20, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.attempts), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := webhookBackoff(tt.attempts); got < tt.base/2 || got > tt.base {
+					t.Fatalf("webhookBackoff(%d) = %s, want between %s and %s", tt.attempts, got, tt.base/2, tt.base)
+				}
+			}
+		})
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublicDialControl(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{"93.184.216.34:443", false},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", false},
+		{"127.0.0.1:443", true},
+		{"169.254.169.254:80", true},
+		{"[::1]:443", true},
+		{"localhost:443", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			if err := publicDialControl("tcp", tt.address, nil); (err != nil) != tt.wantErr {
+				t.Errorf("publicDialControl(%s) = %v, want error %v", tt.address, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// Invokers lambdaTrigger can use, chosen with LAMBDA_INVOKER.
+const (
+	// invokerAWS invokes the functions deployed to AWS Lambda, the default.
+	invokerAWS = "aws"
+	// invokerLocal runs the handlers registered in this process.
+	invokerLocal = "local"
+	// invokerRIE calls a Lambda Runtime Interface Emulator, e.g. a function
+	// image run with docker run -p 9000:8080.
+	invokerRIE = "rie"
+)
+
+// maxLogTail is how much of the end of the log an invocation returns, as
+// Lambda does with LogType Tail.
+const maxLogTail = 4096
+
+// invocation is a request to run a function.
+type invocation struct {
+	FunctionName   string
+	InvocationType string
+	LogType        string
+	Payload        []byte
+}
+
+// invocationResult is the outcome of an invocation, as Lambda reports it.
+// LogResult is base64 encoded.
+type invocationResult struct {
+	StatusCode      int64
+	ExecutedVersion string
+	FunctionError   string
+	LogResult       string
+	Payload         []byte
+}
+
+// lambdaInvoker runs functions with the semantics of the Lambda Invoke API:
+// Event returns 202 once the invocation is queued, RequestResponse waits for
+// the result and reports failures of the function in FunctionError, and
+// DryRun only checks the function can be invoked.
+type lambdaInvoker interface {
+	Invoke(ctx context.Context, in invocation) (invocationResult, error)
+}
+
+// invoker is the lambdaInvoker lambdaTrigger uses.
+var invoker lambdaInvoker
+
+// newLambdaInvoker returns the invoker named by LAMBDA_INVOKER. The local
+// invoker times handlers out after LAMBDA_LOCAL_TIMEOUT (default 60s, as the
+// deployed function), the emulator is reached at LAMBDA_RIE_ENDPOINT
+// (default http://localhost:9000).
+func newLambdaInvoker() (lambdaInvoker, error) {
+	switch name := getEnv("LAMBDA_INVOKER", invokerAWS); name {
+	case invokerAWS:
+		return awsInvoker{client: lambda.New(awsSession)}, nil
+	case invokerLocal:
+		timeout, err := time.ParseDuration(getEnv("LAMBDA_LOCAL_TIMEOUT", "60s"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid LAMBDA_LOCAL_TIMEOUT: %w", err)
+		}
+		return localInvoker{timeout: timeout}, nil
+	case invokerRIE:
+		return rieInvoker{
+			endpoint: strings.TrimSuffix(getEnv("LAMBDA_RIE_ENDPOINT", "http://localhost:9000"), "/"),
+			client:   &http.Client{},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown LAMBDA_INVOKER '%s', expected one of: aws, local, rie", name)
+	}
+}
+
+// awsInvoker invokes the functions deployed to AWS Lambda.
+type awsInvoker struct {
+	client *lambda.Lambda
+}
+
+func (a awsInvoker) Invoke(ctx context.Context, in invocation) (invocationResult, error) {
+	input := &lambda.InvokeInput{
+		FunctionName:   aws.String(in.FunctionName),
+		InvocationType: aws.String(in.InvocationType),
+		Payload:        in.Payload,
+	}
+	if in.LogType != "" {
+		input.LogType = aws.String(in.LogType)
+	}
+	result, err := a.client.InvokeWithContext(ctx, input)
+	if err != nil {
+		return invocationResult{}, err
+	}
+	return invocationResult{
+		StatusCode:      aws.Int64Value(result.StatusCode),
+		ExecutedVersion: aws.StringValue(result.ExecutedVersion),
+		FunctionError:   aws.StringValue(result.FunctionError),
+		LogResult:       aws.StringValue(result.LogResult),
+		Payload:         result.Payload,
+	}, nil
+}
+
+// localHandler is a function run in-process by the local invoker. What it
+// logs through functionLogger(ctx) is captured as the log of the invocation.
+type localHandler func(ctx context.Context, payload json.RawMessage) (interface{}, error)
+
+var (
+	localHandlersMu sync.RWMutex
+	localHandlers   = map[string]localHandler{}
+)
+
+// registerLocalHandler makes handler available to the local invoker as the
+// function name.
+func registerLocalHandler(name string, handler localHandler) {
+	localHandlersMu.Lock()
+	defer localHandlersMu.Unlock()
+	localHandlers[name] = handler
+}
+
+func lookupLocalHandler(name string) (localHandler, bool) {
+	localHandlersMu.RLock()
+	defer localHandlersMu.RUnlock()
+	handler, ok := localHandlers[name]
+	return handler, ok
+}
+
+// localInvoker runs the registered handlers in this process, so the trigger
+// works without a deployed function.
+type localInvoker struct {
+	timeout time.Duration
+}
+
+func (l localInvoker) Invoke(ctx context.Context, in invocation) (invocationResult, error) {
+	handler, ok := lookupLocalHandler(in.FunctionName)
+	if !ok {
+		return invocationResult{}, awserr.New(lambda.ErrCodeResourceNotFoundException,
+			fmt.Sprintf("Function not found: %s (no local handler is registered with this name)", in.FunctionName), nil)
+	}
+
+	switch in.InvocationType {
+	case lambda.InvocationTypeDryRun:
+		return invocationResult{StatusCode: http.StatusNoContent}, nil
+	case lambda.InvocationTypeEvent:
+		// Like Lambda, run it after replying, independently of the request
+		go func() {
+			result := l.run(context.Background(), in, handler)
+			if result.FunctionError != "" {
+				log.Printf("Asynchronous invocation of %s failed: %s %s", in.FunctionName, result.FunctionError, result.Payload)
+			}
+		}()
+		return invocationResult{StatusCode: http.StatusAccepted}, nil
+	}
+
+	result := l.run(ctx, in, handler)
+	if in.LogType != lambda.LogTypeTail {
+		result.LogResult = ""
+	}
+	return result, nil
+}
+
+// run executes handler with the timeout of the invoker, capturing its log and
+// turning errors, panics and timeouts into function errors.
+func (l localInvoker) run(ctx context.Context, in invocation, handler localHandler) invocationResult {
+	requestID := newRequestID()
+	logs := &logCapture{prefix: fmt.Sprintf("[%s %s] ", in.FunctionName, requestID)}
+	logger := log.New(logs, "", log.LstdFlags|log.Lmicroseconds)
+	ctx, cancel := context.WithTimeout(withFunctionLogger(ctx, logger), l.timeout)
+	defer cancel()
+
+	type outcome struct {
+		response interface{}
+		err      error
+	}
+	done := make(chan outcome, 1)
+	started := time.Now()
+	logger.Printf("START RequestId: %s Version: $LATEST", requestID)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- outcome{err: fmt.Errorf("panic: %v", recovered)}
+			}
+		}()
+		response, err := handler(ctx, json.RawMessage(in.Payload))
+		done <- outcome{response, err}
+	}()
+
+	var result outcome
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		// The handler keeps running until it notices, but its result is dropped
+		result.err = fmt.Errorf("Task timed out after %.2f seconds", l.timeout.Seconds())
+	}
+	logger.Printf("END RequestId: %s", requestID)
+	logger.Printf("REPORT RequestId: %s Duration: %.2f ms", requestID, float64(time.Since(started).Microseconds())/1000)
+
+	out := invocationResult{StatusCode: http.StatusOK, ExecutedVersion: "$LATEST", LogResult: logs.tail()}
+	if result.err != nil {
+		out.FunctionError = "Unhandled"
+		out.Payload, _ = json.Marshal(map[string]string{
+			"errorMessage": result.err.Error(),
+			"errorType":    fmt.Sprintf("%T", result.err),
+		})
+		return out
+	}
+	payload, err := json.Marshal(result.response)
+	if err != nil {
+		out.FunctionError = "Unhandled"
+		out.Payload, _ = json.Marshal(map[string]string{
+			"errorMessage": "marshaling the response: " + err.Error(),
+			"errorType":    "Runtime.MarshalError",
+		})
+		return out
+	}
+	out.Payload = payload
+	return out
+}
+
+// logCapture writes the log of an invocation to the application log and
+// keeps it to return its tail.
+type logCapture struct {
+	prefix string
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprint(log.Writer(), c.prefix+string(p))
+	return c.buffer.Write(p)
+}
+
+// tail returns the end of the log, base64 encoded.
+func (c *logCapture) tail() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	logs := c.buffer.Bytes()
+	if len(logs) > maxLogTail {
+		logs = logs[len(logs)-maxLogTail:]
+	}
+	return base64.StdEncoding.EncodeToString(logs)
+}
+
+type functionLoggerKey struct{}
+
+func withFunctionLogger(ctx context.Context, logger *log.Logger) context.Context {
+	return context.WithValue(ctx, functionLoggerKey{}, logger)
+}
+
+// functionLogger returns the logger of the invocation running with ctx, or
+// the application logger outside of one.
+func functionLogger(ctx context.Context) *log.Logger {
+	if logger, ok := ctx.Value(functionLoggerKey{}).(*log.Logger); ok {
+		return logger
+	}
+	return log.Default()
+}
+
+// rieInvoker calls a Lambda Runtime Interface Emulator running the function.
+// The emulator serves a single function whatever its name and only runs
+// requests synchronously, so Event invocations are sent in the background.
+type rieInvoker struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (e rieInvoker) Invoke(ctx context.Context, in invocation) (invocationResult, error) {
+	switch in.InvocationType {
+	case lambda.InvocationTypeDryRun:
+		return invocationResult{StatusCode: http.StatusNoContent}, nil
+	case lambda.InvocationTypeEvent:
+		go func() {
+			if _, err := e.post(context.Background(), in.Payload); err != nil {
+				log.Printf("Error invoking %s through the emulator: %v", in.FunctionName, err)
+			}
+		}()
+		return invocationResult{StatusCode: http.StatusAccepted}, nil
+	}
+	return e.post(ctx, in.Payload)
+}
+
+func (e rieInvoker) post(ctx context.Context, payload []byte) (invocationResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		e.endpoint+"/2015-03-31/functions/function/invocations", bytes.NewReader(payload))
+	if err != nil {
+		return invocationResult{}, err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return invocationResult{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return invocationResult{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return invocationResult{}, fmt.Errorf("emulator replied %s: %s", resp.Status, body)
+	}
+
+	result := invocationResult{StatusCode: http.StatusOK, ExecutedVersion: "$LATEST", Payload: body}
+	// The emulator does not set X-Amz-Function-Error, errors are told apart by their body
+	var functionError struct {
+		ErrorMessage *string `json:"errorMessage"`
+		ErrorType    string  `json:"errorType"`
+	}
+	if json.Unmarshal(body, &functionError) == nil && functionError.ErrorMessage != nil && functionError.ErrorType != "" {
+		result.FunctionError = "Unhandled"
+	}
+	return result, nil
+}
+
+// newRequestID returns an id for a local invocation.
+func newRequestID() string {
+	return fmt.Sprintf("local-%d", time.Now().UnixNano())
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// invokeLocal registers handler under a name of its own and invokes it with
+// the local invoker.
+func invokeLocal(t *testing.T, handler localHandler, in invocation) invocationResult {
+	t.Helper()
+	in.FunctionName = t.Name()
+	registerLocalHandler(in.FunctionName, handler)
+	result, err := localInvoker{timeout: time.Second}.Invoke(context.Background(), in)
+	if err != nil {
+		t.Fatalf("Invoke() error = %v", err)
+	}
+	return result
+}
+
+func decodeLog(t *testing.T, result invocationResult) string {
+	t.Helper()
+	logs, err := base64.StdEncoding.DecodeString(result.LogResult)
+	if err != nil {
+		t.Fatalf("LogResult is not base64: %v", err)
+	}
+	return string(logs)
+}
+
+func TestLocalInvokerRequestResponse(t *testing.T) {
+	handler := func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		functionLogger(ctx).Printf("got %s", payload)
+		return map[string]int{"statusCode": 200}, nil
+	}
+	result := invokeLocal(t, handler, invocation{
+		InvocationType: lambda.InvocationTypeRequestResponse,
+		LogType:        lambda.LogTypeTail,
+		Payload:        []byte(`{"a":1}`),
+	})
+
+	if result.StatusCode != http.StatusOK || result.FunctionError != "" {
+		t.Errorf("StatusCode = %d, FunctionError = %q", result.StatusCode, result.FunctionError)
+	}
+	if string(result.Payload) != `{"statusCode":200}` {
+		t.Errorf("Payload = %s", result.Payload)
+	}
+	logs := decodeLog(t, result)
+	for _, want := range []string{"START RequestId: local-", `got {"a":1}`, "END RequestId:", "REPORT RequestId:"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("log is missing %q:\n%s", want, logs)
+		}
+	}
+}
+
+func TestLocalInvokerOnlyTailsLogWhenAsked(t *testing.T) {
+	handler := func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		functionLogger(ctx).Print("hello")
+		return nil, nil
+	}
+	result := invokeLocal(t, handler, invocation{InvocationType: lambda.InvocationTypeRequestResponse})
+	if result.LogResult != "" {
+		t.Errorf("LogResult = %q without LogType Tail", result.LogResult)
+	}
+}
+
+func TestLocalInvokerFunctionErrors(t *testing.T) {
+	t.Run("error", func(t *testing.T) {
+		result := invokeLocal(t, func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+			return nil, errors.New("queue unreachable")
+		}, invocation{InvocationType: lambda.InvocationTypeRequestResponse})
+		assertFunctionError(t, result, "queue unreachable")
+	})
+	t.Run("panic", func(t *testing.T) {
+		result := invokeLocal(t, func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+			panic("nil topic")
+		}, invocation{InvocationType: lambda.InvocationTypeRequestResponse})
+		assertFunctionError(t, result, "panic: nil topic")
+	})
+	t.Run("unmarshalable response", func(t *testing.T) {
+		result := invokeLocal(t, func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+			return func() {}, nil
+		}, invocation{InvocationType: lambda.InvocationTypeRequestResponse})
+		assertFunctionError(t, result, "marshaling the response")
+	})
+}
+
+func assertFunctionError(t *testing.T, result invocationResult, message string) {
+	t.Helper()
+	if result.StatusCode != http.StatusOK || result.FunctionError != "Unhandled" {
+		t.Errorf("StatusCode = %d, FunctionError = %q, want 200 and Unhandled", result.StatusCode, result.FunctionError)
+	}
+	var payload struct {
+		ErrorMessage string `json:"errorMessage"`
+	}
+	if err := json.Unmarshal(result.Payload, &payload); err != nil || !strings.Contains(payload.ErrorMessage, message) {
+		t.Errorf("Payload = %s, want an errorMessage with %q", result.Payload, message)
+	}
+}
+
+func TestLocalInvokerTimeout(t *testing.T) {
+	released := make(chan struct{})
+	defer close(released)
+	registerLocalHandler(t.Name(), func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		select {
+		case <-released:
+		case <-time.After(time.Minute):
+		}
+		return "too late", nil
+	})
+
+	started := time.Now()
+	result, err := localInvoker{timeout: 50 * time.Millisecond}.Invoke(context.Background(), invocation{
+		FunctionName:   t.Name(),
+		InvocationType: lambda.InvocationTypeRequestResponse,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Invoke() waited %s for a handler past its timeout", elapsed)
+	}
+	assertFunctionError(t, result, "Task timed out after 0.05 seconds")
+}
+
+func TestLocalInvokerEventRunsInBackground(t *testing.T) {
+	ran := make(chan json.RawMessage, 1)
+	result := invokeLocal(t, func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		ran <- payload
+		return nil, nil
+	}, invocation{InvocationType: lambda.InvocationTypeEvent, Payload: []byte(`{"async":true}`)})
+
+	if result.StatusCode != http.StatusAccepted {
+		t.Errorf("StatusCode = %d, want 202", result.StatusCode)
+	}
+	select {
+	case payload := <-ran:
+		if string(payload) != `{"async":true}` {
+			t.Errorf("handler got %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler of an Event invocation never ran")
+	}
+}
+
+func TestLocalInvokerDryRunDoesNotRun(t *testing.T) {
+	result := invokeLocal(t, func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		t.Error("DryRun ran the handler")
+		return nil, nil
+	}, invocation{InvocationType: lambda.InvocationTypeDryRun})
+	if result.StatusCode != http.StatusNoContent {
+		t.Errorf("StatusCode = %d, want 204", result.StatusCode)
+	}
+}
+
+func TestLocalInvokerUnknownFunction(t *testing.T) {
+	_, err := localInvoker{timeout: time.Second}.Invoke(context.Background(), invocation{FunctionName: "missing"})
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) || awsErr.Code() != lambda.ErrCodeResourceNotFoundException {
+		t.Errorf("Invoke() error = %v, want %s", err, lambda.ErrCodeResourceNotFoundException)
+	}
+}
+
+func TestLogCaptureTail(t *testing.T) {
+	logs := &logCapture{}
+	io.WriteString(logs, strings.Repeat("a", maxLogTail))
+	io.WriteString(logs, "the end")
+
+	tail, err := base64.StdEncoding.DecodeString(logs.tail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tail) != maxLogTail || !strings.HasSuffix(string(tail), "the end") {
+		t.Errorf("tail() is %d bytes ending with %q", len(tail), tail[len(tail)-10:])
+	}
+}
+
+func TestRIEInvoker(t *testing.T) {
+	var gotPath, gotBody string
+	reply, status := `{"statusCode":200}`, http.StatusOK
+	emulator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotPath, gotBody = r.URL.Path, string(body)
+		w.WriteHeader(status)
+		io.WriteString(w, reply)
+	}))
+	defer emulator.Close()
+	rie := rieInvoker{endpoint: emulator.URL, client: emulator.Client()}
+	in := invocation{FunctionName: "any", InvocationType: lambda.InvocationTypeRequestResponse, Payload: []byte(`{"a":1}`)}
+
+	result, err := rie.Invoke(context.Background(), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/2015-03-31/functions/function/invocations" || gotBody != `{"a":1}` {
+		t.Errorf("emulator got %s %s", gotPath, gotBody)
+	}
+	if result.FunctionError != "" || string(result.Payload) != reply {
+		t.Errorf("result = %+v", result)
+	}
+
+	reply = `{"errorMessage":"boom","errorType":"errorString"}`
+	if result, err = rie.Invoke(context.Background(), in); err != nil || result.FunctionError != "Unhandled" {
+		t.Errorf("function error: FunctionError = %q, err = %v", result.FunctionError, err)
+	}
+
+	status = http.StatusBadGateway
+	if _, err = rie.Invoke(context.Background(), in); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("emulator failure: err = %v", err)
+	}
+}
+
+func TestBatchNotifierHandlerRunsNotifyCommand(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "notifier")
+	script := "#!/bin/sh\n" +
+		"echo \"$@\" > " + filepath.Join(dir, "args") + "\n" +
+		"cat > " + filepath.Join(dir, "stdin") + "\n" +
+		"echo 'published 2 events' >&2\n" +
+		"echo '{\"statusCode\":200}'\n"
+	if err := os.WriteFile(binary, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BATCH_NOTIFIER_BINARY", binary)
+
+	result := invokeLocal(t, batchNotifierHandler, invocation{
+		InvocationType: lambda.InvocationTypeRequestResponse,
+		LogType:        lambda.LogTypeTail,
+		Payload:        []byte(`{"detail-type":"Web Application"}`),
+	})
+	if result.FunctionError != "" || strings.TrimSpace(string(result.Payload)) != `{"statusCode":200}` {
+		t.Fatalf("result = %+v, payload %s", result, result.Payload)
+	}
+	if args, _ := os.ReadFile(filepath.Join(dir, "args")); !strings.HasPrefix(string(args), "notify -timeout ") {
+		t.Errorf("notifier ran with %q, want notify and the time left", args)
+	}
+	if stdin, _ := os.ReadFile(filepath.Join(dir, "stdin")); string(stdin) != `{"detail-type":"Web Application"}` {
+		t.Errorf("notifier read %q, want the event", stdin)
+	}
+	if logs := decodeLog(t, result); !strings.Contains(logs, "published 2 events") {
+		t.Errorf("notifier output is missing from the log:\n%s", logs)
+	}
+}
+
+func TestBatchNotifierHandlerRejectsInvalidEvent(t *testing.T) {
+	t.Setenv("BATCH_NOTIFIER_BINARY", "/bin/false")
+	_, err := batchNotifierHandler(context.Background(), json.RawMessage(`not json`))
+	if err == nil || !strings.Contains(err.Error(), "decoding the event") {
+		t.Errorf("batchNotifierHandler() error = %v, want a decoding error", err)
+	}
+}
@@ -14,7 +14,6 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/sns"
@@ -69,6 +68,13 @@ func main() {
 
 	createTable()
 
+	// lambdaTrigger invokes the deployed functions, or runs them locally
+	registerLocalHandler(batchNotifierFunction, batchNotifierHandler)
+	invoker, err = newLambdaInvoker()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Define routes and their handlers
 	router := mux.NewRouter()
 	router.HandleFunc("/image", getImage).Methods("GET")
@@ -84,34 +90,6 @@ func main() {
 	log.Fatal(http.ListenAndServe(":8080", router))
 }
 
-func lambdaTrigger(w http.ResponseWriter, r *http.Request) {
-	// Create a new Lambda client
-	svc := lambda.New(awsSession)
-
-	// Define the input payload for the Lambda function
-	payload := []byte(`{"detail-type": "Web Application"}`)
-
-	// Set the input parameters
-	input := &lambda.InvokeInput{
-		FunctionName:   aws.String("lambda-uploads-batch-notifier"),
-		InvocationType: aws.String("Event"),
-		Payload:        payload,
-	}
-
-	// Invoke the Lambda function
-	result, err := svc.Invoke(input)
-	if err != nil {
-		error_message := "Failed to invoke Lambda function. "
-		log.Println(error_message, err)
-		fmt.Fprintf(w, error_message)
-		return
-	}
-
-	success_message := "Lambda function successfully invoked. "
-	log.Println(success_message, result)
-	fmt.Fprintf(w, success_message)
-}
-
 func subscribeEmail(w http.ResponseWriter, r *http.Request) {
 	// Get the email address from the query parameters
 	email := r.URL.Query().Get("email")
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// batchNotifierFunction is the function lambdaTrigger invokes by default.
+const batchNotifierFunction = "lambda-uploads-batch-notifier"
+
+// batchNotifierHandler runs the function the trigger invokes with the code
+// deployed as it, the notifier of SQS-SNS-practice/simple-app, through its
+// notify command. BATCH_NOTIFIER_BINARY is the binary built from that app; it
+// reads its configuration from the environment of this process.
+func batchNotifierHandler(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var event map[string]interface{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("decoding the event: %w", err)
+	}
+	binary := getEnv("BATCH_NOTIFIER_BINARY", "")
+	if binary == "" {
+		return nil, errors.New("BATCH_NOTIFIER_BINARY is not set, build SQS-SNS-practice/simple-app and set it to the binary")
+	}
+
+	args := []string{"notify"}
+	if deadline, ok := ctx.Deadline(); ok {
+		args = append(args, "-timeout", time.Until(deadline).String())
+	}
+	var response bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &response
+	cmd.Stderr = functionLogger(ctx).Writer()
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("running %s notify: %w", binary, err)
+	}
+	return json.RawMessage(response.Bytes()), nil
+}
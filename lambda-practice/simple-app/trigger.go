@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// Defaults of the lambdaTrigger configuration.
+const (
+	defaultLambdaFunctionName   = batchNotifierFunction
+	defaultLambdaPayload        = `{"detail-type": "Web Application"}`
+	defaultLambdaInvocationType = lambda.InvocationTypeEvent
+)
+
+// triggerPayloadData is what the payload template is executed with.
+type triggerPayloadData struct {
+	// Time is when the trigger was requested, in RFC 3339.
+	Time string
+	// Query holds the first value of each query parameter of the request.
+	Query map[string]string
+}
+
+// triggerResponse is the body lambdaTrigger replies with.
+type triggerResponse struct {
+	FunctionName    string          `json:"functionName"`
+	InvocationType  string          `json:"invocationType"`
+	StatusCode      int64           `json:"statusCode,omitempty"`
+	ExecutedVersion string          `json:"executedVersion,omitempty"`
+	FunctionError   string          `json:"functionError,omitempty"`
+	Payload         json.RawMessage `json:"payload,omitempty"`
+	LogTail         string          `json:"logTail,omitempty"`
+	DurationMS      int64           `json:"durationMs"`
+	Error           string          `json:"error,omitempty"`
+}
+
+// lambdaTrigger invokes the function LAMBDA_FUNCTION_NAME (default
+// lambda-uploads-batch-notifier) with the payload rendered from the
+// LAMBDA_PAYLOAD_TEMPLATE text/template (default {"detail-type": "Web
+// Application"}), as the LAMBDA_INVOCATION_TYPE (default Event) or the
+// invocationType query parameter says:
+//
+//   - Event queues the invocation and replies 202.
+//   - RequestResponse waits for the function and replies 200 with its result,
+//     or 502 with the result and its FunctionError when the function failed.
+//   - DryRun only checks the function can be invoked and replies 200.
+//
+// Synchronous invocations include the tail of the function log with ?logs=true.
+// The function runs on AWS Lambda or locally, depending on LAMBDA_INVOKER.
+func lambdaTrigger(w http.ResponseWriter, r *http.Request) {
+	response := triggerResponse{
+		FunctionName:   getEnv("LAMBDA_FUNCTION_NAME", defaultLambdaFunctionName),
+		InvocationType: getEnv("LAMBDA_INVOCATION_TYPE", defaultLambdaInvocationType),
+	}
+	if invocationType := r.URL.Query().Get("invocationType"); invocationType != "" {
+		response.InvocationType = invocationType
+	}
+	switch response.InvocationType {
+	case lambda.InvocationTypeEvent, lambda.InvocationTypeRequestResponse, lambda.InvocationTypeDryRun:
+	default:
+		response.Error = "invocationType must be one of: Event, RequestResponse, DryRun"
+		writeJSON(w, http.StatusBadRequest, response)
+		return
+	}
+
+	payload, err := renderTriggerPayload(r)
+	if err != nil {
+		log.Println("Failed to render the Lambda payload.", err)
+		response.Error = "Failed to render the Lambda payload: " + err.Error()
+		writeJSON(w, http.StatusInternalServerError, response)
+		return
+	}
+
+	// Set the input parameters
+	input := invocation{
+		FunctionName:   response.FunctionName,
+		InvocationType: response.InvocationType,
+		Payload:        payload,
+	}
+	if response.InvocationType == lambda.InvocationTypeRequestResponse && r.URL.Query().Get("logs") == "true" {
+		input.LogType = lambda.LogTypeTail
+	}
+
+	// Invoke the Lambda function, or its local stand-in
+	started := time.Now()
+	result, err := invoker.Invoke(r.Context(), input)
+	response.DurationMS = time.Since(started).Milliseconds()
+	if err != nil {
+		log.Printf("Failed to invoke Lambda function %s (%s) after %dms. %v", response.FunctionName, response.InvocationType, response.DurationMS, err)
+		response.Error = "Failed to invoke Lambda function: " + err.Error()
+		writeJSON(w, invokeErrorStatus(err), response)
+		return
+	}
+
+	response.StatusCode = result.StatusCode
+	response.ExecutedVersion = result.ExecutedVersion
+	response.FunctionError = result.FunctionError
+	if len(result.Payload) > 0 {
+		if json.Valid(result.Payload) {
+			response.Payload = result.Payload
+		} else {
+			response.Payload, _ = json.Marshal(string(result.Payload))
+		}
+	}
+	if logTail, err := base64.StdEncoding.DecodeString(result.LogResult); err == nil {
+		response.LogTail = string(logTail)
+	}
+	log.Printf("Lambda function %s invoked (%s): status %d, function error '%s', %dms",
+		response.FunctionName, response.InvocationType, response.StatusCode, response.FunctionError, response.DurationMS)
+
+	status := http.StatusOK
+	switch {
+	case response.FunctionError != "":
+		status = http.StatusBadGateway
+	case response.InvocationType == lambda.InvocationTypeEvent:
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, response)
+}
+
+// renderTriggerPayload executes the payload template for r and checks the
+// result is JSON. The json template function quotes a value as JSON, e.g.
+// {"detail-type": "Web Application", "album": {{ json (index .Query "album") }}}.
+func renderTriggerPayload(r *http.Request) ([]byte, error) {
+	tmpl, err := template.New("payload").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			body, err := json.Marshal(v)
+			return string(body), err
+		},
+	}).Parse(getEnv("LAMBDA_PAYLOAD_TEMPLATE", defaultLambdaPayload))
+	if err != nil {
+		return nil, err
+	}
+
+	data := triggerPayloadData{
+		Time:  time.Now().UTC().Format(time.RFC3339),
+		Query: map[string]string{},
+	}
+	for name := range r.URL.Query() {
+		data.Query[name] = r.URL.Query().Get(name)
+	}
+	var payload bytes.Buffer
+	if err := tmpl.Execute(&payload, data); err != nil {
+		return nil, err
+	}
+	if !json.Valid(payload.Bytes()) {
+		return nil, fmt.Errorf("the payload is not valid JSON: %s", payload.String())
+	}
+	return payload.Bytes(), nil
+}
+
+// invokeErrorStatus is the status to reply with when invoking fails: the
+// function being throttled is worth retrying later, anything else is a
+// failure of the function or of its configuration.
+func invokeErrorStatus(err error) int {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == lambda.ErrCodeTooManyRequestsException {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusBadGateway
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// getEnv returns the environment variable name, or fallback when it is unset.
+func getEnv(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRenderTriggerPayload(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		target   string
+		want     string
+		wantErr  bool
+	}{
+		{"default", "", "/trigger", `{"detail-type": "Web Application"}`, false},
+		{
+			"query value quoted",
+			`{"album": {{ json (index .Query "album") }}}`,
+			`/trigger?album=a%22b%5C`,
+			`{"album": "a\"b\\"}`,
+			false,
+		},
+		{"missing query value", `{"album": {{ json (index .Query "album") }}}`, "/trigger", `{"album": ""}`, false},
+		{"first value of a parameter", `{"tag": {{ json (index .Query "tag") }}}`, "/trigger?tag=a&tag=b", `{"tag": "a"}`, false},
+		{"whole query", `{{ json .Query }}`, "/trigger?b=2&a=1", `{"a":"1","b":"2"}`, false},
+		{"unquoted value is not JSON", `{"album": {{ index .Query "album" }}}`, "/trigger?album=x", "", true},
+		{"invalid template", `{"album": {{ json }`, "/trigger", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.template != "" {
+				t.Setenv("LAMBDA_PAYLOAD_TEMPLATE", tt.template)
+			}
+			payload, err := renderTriggerPayload(httptest.NewRequest("POST", tt.target, nil))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", payload)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(payload) != tt.want {
+				t.Errorf("payload = %s, want %s", payload, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderTriggerPayloadTime(t *testing.T) {
+	t.Setenv("LAMBDA_PAYLOAD_TEMPLATE", `{"time": {{ json .Time }}}`)
+	payload, err := renderTriggerPayload(httptest.NewRequest("POST", "/trigger", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(payload) != len(`{"time": "2006-01-02T15:04:05Z"}`) {
+		t.Errorf("payload = %s, want an RFC 3339 UTC time", payload)
+	}
+}